@@ -2,16 +2,40 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/votanchat/cloudflared-desktop-tunnel/binaries"
+	"github.com/votanchat/cloudflared-desktop-tunnel/network"
+	"github.com/votanchat/cloudflared-desktop-tunnel/secrets"
+	wailsruntime "github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
 // App struct
 type App struct {
 	ctx           context.Context
 	tunnel        *TunnelManager
-	config        *Config
+	configMu      sync.RWMutex // Guards the config pointer; a published Config is never modified
+	config        *Config      // Read with currentConfig, replaced with saveConfig or updateConfig
 	backendClient *BackendClient
 	webServer     *WebServerManager
+	updater       *UpdateChecker
+	noticesMu     sync.Mutex
+	notices       []string           // Messages for the user collected before the UI was ready
+	configSync    configSync         // On-disk state of config.json for external edit detection
+	overrides     []ConfigOverride   // Env and command-line settings layered over every loaded profile
+	keyring       *secrets.Keyring   // OS keyring for tokens and credentials
+	secretFile    *secrets.FileStore // Passphrase-encrypted fallback when there is no keyring
+	deviceMu      sync.Mutex
+	deviceError   string                         // Why the device credential could not be loaded; guarded by deviceMu
+	startedAt     time.Time                      // For the uptime in status reports
+	statusQueue   statusQueue                    // Status reports waiting for the backend to be reachable
+	httpTransport atomic.Pointer[http.Transport] // Proxy and CA settings for token providers that call out
+	backendToken  atomic.Bool                    // The last token from getToken came from the backend or its cache, so rotation applies
 }
 
 // NewApp creates a new App application struct
@@ -19,10 +43,29 @@ func NewApp() *App {
 	return &App{}
 }
 
+// SetConfigOverrides sets the environment and command-line settings that take
+// precedence over config.json. Must be called before Startup.
+func (a *App) SetConfigOverrides(overrides []ConfigOverride) {
+	a.overrides = overrides
+}
+
+// applyConfigOverrides layers the env and flag settings over config and tells
+// the user about any that could not be used
+func (a *App) applyConfigOverrides(config *Config) {
+	for _, err := range config.applyOverrides(a.overrides) {
+		appLogger.Warn("Ignoring config override %v", err)
+		a.addNotice(fmt.Sprintf("Ignored setting override %v", err))
+	}
+	for name, o := range config.overrides {
+		appLogger.Info("Setting %s overridden by %s", name, o.Name)
+	}
+}
+
 // Startup is called when the app starts. The context is saved
 // so we can call the runtime methods
 func (a *App) Startup(ctx context.Context) {
 	a.ctx = ctx
+	a.startedAt = time.Now()
 
 	// Initialize file logging first (only in build mode)
 	// This must be called before any logging
@@ -34,20 +77,43 @@ func (a *App) Startup(ctx context.Context) {
 	appLogger.Info("Application starting up...")
 
 	// Initialize configuration
-	var err error
-	a.config, err = LoadConfig()
+	config, err := LoadConfig()
 	if err != nil {
 		appLogger.Warn("Could not load config, using defaults: %v", err)
-		a.config = DefaultConfig()
+		config = DefaultConfig()
+		// Never overwrite a file from a newer app version with our defaults
+		if errors.Is(err, ErrConfigTooNew) {
+			config.readOnly = true
+		}
+		a.addNotice(fmt.Sprintf("Settings could not be loaded and defaults are in use: %v", err))
+	} else if backup := config.RecoveredFrom(); backup != "" {
+		a.addNotice(fmt.Sprintf("config.json was damaged; settings were restored from %s", backup))
+	}
+	for _, fe := range config.LoadWarnings() {
+		a.addNotice(fmt.Sprintf("Setting %s was invalid (%s) and has been reset to its default", fe.Field, fe.Message))
+	}
+	a.applyConfigOverrides(config)
+	a.setConfig(config)
+	a.configSync.mu.Lock()
+	a.markConfigSynced()
+	a.configSync.mu.Unlock()
+
+	if err := a.initSecretStores(); err != nil {
+		appLogger.Error("Failed to set up secret storage: %v", err)
 	}
 
 	// Initialize backend client
-	a.backendClient = NewBackendClient(a.config.BackendURL)
-	go a.backendClient.Start(ctx)
+	a.backendClient = NewBackendClient(config.BackendURL)
+	a.backendClient.SetEndpoints(config.BackendURLs())
+	a.backendClient.SetRefreshInterval(time.Duration(config.RefreshInterval) * time.Second)
+	if err := a.applyNetworkConfig(); err != nil {
+		appLogger.Error("Invalid proxy/CA settings, using direct connections: %v", err)
+		a.addNotice(fmt.Sprintf("Proxy and CA settings could not be used, so connections go out directly without them: %v", err))
+	}
 
 	// Initialize tunnel manager
-	a.tunnel = NewTunnelManager(a.config.TunnelName)
-	a.tunnel.SetConfig(a.config)
+	a.tunnel = NewTunnelManager(config.TunnelName)
+	a.tunnel.SetConfig(config)
 
 	// Initialize web server manager
 	a.webServer = NewWebServerManager()
@@ -55,22 +121,77 @@ func (a *App) Startup(ctx context.Context) {
 	// Set callback to auto-start web server when tunnel starts successfully
 	a.tunnel.SetOnTunnelStart(a.autoStartWebServer)
 
+	// Apply rotated backend tokens to the running tunnel
+	a.backendClient.SetOnTokenChanged(func(oldToken, newToken string) {
+		go func() {
+			a.cacheLastToken(newToken)
+			a.handleTokenChanged(newToken)
+		}()
+	})
+
+	// Check for cloudflared updates in the background
+	a.updater = NewUpdateChecker(a.tunnel, time.Duration(config.UpdateCheckInterval)*time.Second)
+	a.updater.SetApplyImmediately(config.ApplyUpdatesImmediately)
+	a.updater.SetOnUpdate(func(status UpdateStatus) {
+		a.emitEvent("cloudflared:update", status)
+	})
+	a.tunnel.SetOnUpgradeResult(a.updater.handleUpgradeResult)
+	go a.updater.Start(ctx)
+
+	// Commands from the backend drive the tunnel, updater and config set up above
+	a.registerCommandHandlers()
+	if err := a.applyCommandPolicy(); err != nil {
+		appLogger.Error("Invalid backend command key, refusing all commands: %v", err)
+	}
+	if err := a.initCommandLog(); err != nil {
+		appLogger.Warn("Starting with an empty command history: %v", err)
+	}
+
+	// Saving a new device ID applies the config to everything set up above
+	a.initDevice()
+	config = a.currentConfig()
+	go a.backendClient.Start(ctx)
+	go a.reportStatusLoop(ctx)
+
+	// Pick up edits made to config.json while the app is running
+	go a.watchConfigFile(ctx)
+
 	// Auto-start tunnel if configured
-	if a.config.AutoStart {
+	if config.AutoStart {
 		go a.autoStartTunnel()
 	}
 }
 
+// applyNetworkConfig pushes the proxy and CA settings to every outbound client
+func (a *App) applyNetworkConfig() error {
+	opts := a.currentConfig().NetworkOptions()
+
+	transport, err := network.NewTransport(opts)
+	if err != nil {
+		return err
+	}
+	dialer, err := network.NewDialer(opts)
+	if err != nil {
+		return err
+	}
+
+	binaries.SetHTTPTransport(transport)
+	a.httpTransport.Store(transport)
+	a.backendClient.SetNetwork(transport, dialer)
+
+	if !opts.IsZero() {
+		appLogger.Info("Using configured proxy/CA settings for outbound connections")
+	}
+	return nil
+}
+
 // autoStartWebServer starts the web server when tunnel starts
 func (a *App) autoStartWebServer() error {
 	if a.webServer.IsRunning() {
 		return nil
 	}
 
-	port := a.config.WebServerPort
-	if port <= 0 {
-		port = 8080
-	}
+	port := a.getWebServerPort()
 
 	if err := a.webServer.StartWithPort(port); err != nil {
 		appLogger.Warn("Failed to auto-start web server on port %d: %v", port, err)
@@ -82,24 +203,71 @@ func (a *App) autoStartWebServer() error {
 	return nil
 }
 
+// autoStartAttempts bounds how often autoStartTunnel asks for a token,
+// backing off like the websocket does between attempts
+const autoStartAttempts = 6
+
 // autoStartTunnel automatically starts the tunnel if configured
 func (a *App) autoStartTunnel() {
-	token, err := a.backendClient.FetchToken()
-	if err != nil {
-		appLogger.Error("Failed to fetch token: %v", err)
+	if err := a.currentConfig().Validate(); err != nil {
+		appLogger.Error("Not auto-starting tunnel: %v", err)
 		return
 	}
 
+	// The backend may still be coming up, or failing over, at login
+	var token string
+	var err error
+	for attempt := 1; ; attempt++ {
+		if token, err = a.getToken(""); err == nil {
+			break
+		}
+		if attempt >= autoStartAttempts {
+			appLogger.Error("Failed to get token, giving up on auto-start: %v", err)
+			return
+		}
+		delay := reconnectDelay(attempt)
+		appLogger.Warn("Failed to get token (attempt %d/%d), retrying in %v: %v", attempt, autoStartAttempts, delay, err)
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+
 	if err := a.tunnel.Start(token); err != nil {
 		appLogger.Error("Failed to auto-start tunnel: %v", err)
 	}
 }
 
+// emitEvent sends an event to the frontend when running inside Wails
+func (a *App) emitEvent(name string, data ...interface{}) {
+	// Only a context from Wails carries its event bus; tests start the app without one
+	if a.ctx == nil || a.ctx.Value("events") == nil {
+		return
+	}
+	wailsruntime.EventsEmit(a.ctx, name, data...)
+}
+
+// addNotice records a message for the user and pushes it to the UI if it is listening
+func (a *App) addNotice(message string) {
+	a.noticesMu.Lock()
+	a.notices = append(a.notices, message)
+	a.noticesMu.Unlock()
+	a.emitEvent("app:notice", message)
+}
+
 // DomReady is called after the front-end dom has been loaded
 func (a *App) DomReady(ctx context.Context) {
 	appLogger.Info("DOM is ready")
 }
 
+// GetNotices returns messages for the user raised since startup, such as config recovery
+func (a *App) GetNotices() []string {
+	a.noticesMu.Lock()
+	defer a.noticesMu.Unlock()
+	return append([]string{}, a.notices...)
+}
+
 // Shutdown is called when the app is closing
 func (a *App) Shutdown(ctx context.Context) {
 	appLogger.Info("Application shutting down...")
@@ -113,12 +281,12 @@ func (a *App) Shutdown(ctx context.Context) {
 
 	// Stop tunnel if running
 	if a.tunnel != nil {
-		if a.tunnel.IsRunning() {
-			if err := a.tunnel.Stop(); err != nil {
-				appLogger.Error("Error stopping tunnel: %v", err)
-			}
+		if err := a.tunnel.Shutdown(); err != nil {
+			appLogger.Error("Error stopping tunnel: %v", err)
+		}
+		if err := a.tunnel.PruneBinaryCache(); err != nil {
+			appLogger.Warn("Error pruning binary cache: %v", err)
 		}
-		a.tunnel.Cleanup()
 	}
 
 	// Stop backend client
@@ -126,9 +294,9 @@ func (a *App) Shutdown(ctx context.Context) {
 		a.backendClient.Stop()
 	}
 
-	// Save configuration
-	if a.config != nil {
-		if err := a.config.Save(); err != nil {
+	// Save configuration, without clobbering external edits
+	if config := a.currentConfig(); config != nil {
+		if err := a.saveConfig(config); err != nil {
 			appLogger.Error("Error saving config: %v", err)
 		}
 	}
@@ -138,7 +306,8 @@ func (a *App) Shutdown(ctx context.Context) {
 }
 
 // StartTunnel starts the cloudflared tunnel
-// If manualToken is provided and not empty, it will be used instead of fetching from backend
+// If manualToken is provided and not empty, it will be used instead of the
+// configured token source.
 func (a *App) StartTunnel(manualToken string) error {
 	if a.tunnel.IsRunning() {
 		return fmt.Errorf("tunnel is already running")
@@ -152,18 +321,46 @@ func (a *App) StartTunnel(manualToken string) error {
 	return a.tunnel.Start(token)
 }
 
-// getToken retrieves token from manual input or backend
+// getToken returns manualToken if given, otherwise a token from the
+// provider selected by Config.TokenSource
 func (a *App) getToken(manualToken string) (string, error) {
 	if manualToken != "" {
 		appLogger.Info("Using manually provided token")
+		a.backendToken.Store(false)
 		return manualToken, nil
 	}
 
-	appLogger.Info("Fetching token from backend...")
-	token, err := a.backendClient.FetchToken()
+	provider, err := a.tokenProvider()
+	if err != nil {
+		return "", err
+	}
+	ctx := a.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	appLogger.Info("Getting token from %s...", provider.Name())
+	token, err := provider.Token(ctx)
+	_, backend := provider.(*BackendTokenProvider)
+	a.backendToken.Store(backend)
+	if !backend {
+		if err != nil {
+			return "", fmt.Errorf("failed to get token from %s: %w", provider.Name(), err)
+		}
+		return token, nil
+	}
+
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch token from backend: %w", err)
+		// A previously issued token keeps the tunnel up through a backend outage
+		cached, cacheErr := a.cachedToken()
+		if cacheErr != nil {
+			return "", fmt.Errorf("failed to fetch token from backend: %w", err)
+		}
+		// The refresh loop keeps retrying; its first token replaces this one like any rotation
+		appLogger.Warn("Backend unreachable (%v), using the cached token", err)
+		a.addNotice("The backend could not be reached. The tunnel was started with the last token it issued.")
+		return cached, nil
 	}
+	a.cacheLastToken(token)
 	return token, nil
 }
 
@@ -177,21 +374,209 @@ func (a *App) GetTunnelStatus() map[string]interface{} {
 	tunnelURL := a.tunnel.GetTunnelURL()
 	return map[string]interface{}{
 		"running":    a.tunnel.IsRunning(),
-		"tunnelName": a.config.TunnelName,
+		"profile":    activeProfileName(),
+		"tunnelName": a.currentConfig().TunnelName,
 		"tunnelURL":  tunnelURL,
 		"logs":       a.tunnel.GetLogs(),
+		"token":      a.backendClient.TokenStatus(),
+		"backend":    a.backendClient.ConnectionState(),
+		"endpoints":  a.backendClient.Endpoints(),
 	}
 }
 
-// GetConfig returns the current configuration
+// GetConfig returns the current configuration, with the source of each
+// effective value in Provenance
 func (a *App) GetConfig() *Config {
-	return a.config
+	current := a.currentConfig()
+	config := current.Clone()
+	config.Provenance = current.provenance()
+	return config
+}
+
+// UpdateConfig validates, saves and applies the configuration to the running
+// subsystems. Invalid input is rejected with a *ValidationError; use
+// ValidateConfig for per-field details. If the result reports a pending
+// tunnel restart, confirm with the user and call RestartTunnel.
+func (a *App) UpdateConfig(config *Config) (*ConfigApplyResult, error) {
+	old := a.currentConfig()
+	if err := config.validateEdit(old); err != nil {
+		return nil, err
+	}
+
+	// Overridden fields the user did not touch keep their override; the file
+	// keeps its own value for them
+	config.inheritFileState(old)
+
+	// Nothing is applied unless the new settings reached the disk
+	if err := a.saveConfig(config); err != nil {
+		return nil, err
+	}
+
+	return a.applyConfigChanges(old), nil
+}
+
+// RestartTunnel restarts the running tunnel so config changes take effect
+func (a *App) RestartTunnel() error {
+	return a.tunnel.Restart()
 }
 
-// UpdateConfig updates the configuration
-func (a *App) UpdateConfig(config *Config) error {
-	a.config = config
-	return a.config.Save()
+// ValidateConfig returns the per-field problems with config, or an empty list if it is valid
+func (a *App) ValidateConfig(config *Config) []FieldError {
+	var verr *ValidationError
+	if errors.As(config.validateEdit(a.currentConfig()), &verr) {
+		return verr.Errors
+	}
+	return []FieldError{}
+}
+
+// ExportConfig returns the settings as a portable JSON bundle, or with format
+// "cloudflared" the routes as a cloudflared config.yml. Secrets are left out.
+func (a *App) ExportConfig(format string) (string, error) {
+	data, err := exportConfig(a.currentConfig(), format)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// PreviewConfigImport describes what ImportConfig would change, without changing anything
+func (a *App) PreviewConfigImport(data, mode string) (*ImportPreview, error) {
+	preview, _, err := previewConfigImport(a.currentConfig(), []byte(data), mode)
+	return preview, err
+}
+
+// ImportConfig imports a bundle, a config.json or a cloudflared config.yml.
+// Mode "merge" adds its routes to ours; "replace" takes its routes and settings.
+// An import that changes the backend URL needs confirmBackend, see
+// ImportPreview.NewBackendURLs. The result is saved and applied like UpdateConfig.
+func (a *App) ImportConfig(data, mode string, confirmBackend bool) (*ConfigApplyResult, error) {
+	preview, next, err := previewConfigImport(a.currentConfig(), []byte(data), mode)
+	if err != nil {
+		return nil, err
+	}
+	if len(preview.NewBackendURLs) > 0 && !confirmBackend {
+		return nil, errBackendNotConfirmed
+	}
+	return a.UpdateConfig(next)
+}
+
+// ListProfiles returns all configuration profiles
+func (a *App) ListProfiles() ([]ProfileInfo, error) {
+	return ListProfiles()
+}
+
+// CreateProfile creates a new profile with default settings
+func (a *App) CreateProfile(name string) error {
+	return CreateProfile(name)
+}
+
+// CloneProfile creates a new profile as a copy of an existing one, without
+// its device identity or saved secrets
+func (a *App) CloneProfile(source, name string) error {
+	return CloneProfile(source, name)
+}
+
+// DeleteProfile deletes an inactive profile. Its device is unenrolled from
+// its backend and its saved secrets are deleted first.
+func (a *App) DeleteProfile(name string) error {
+	if err := checkDeletableProfile(name); err != nil {
+		return err
+	}
+	if err := a.releaseProfile(name); err != nil {
+		return err
+	}
+	return DeleteProfile(name)
+}
+
+// ActivateProfile switches to another profile. The current profile is saved,
+// the tunnel is stopped, the new settings are applied to every subsystem and
+// the tunnel is started again if it was running.
+func (a *App) ActivateProfile(name string) error {
+	if !profileExists(name) {
+		return fmt.Errorf("profile %q does not exist", name)
+	}
+	if name == activeProfileName() {
+		return nil
+	}
+
+	path, err := profileConfigPath(name)
+	if err != nil {
+		return err
+	}
+	next, err := loadConfigFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to load profile %q: %w", name, err)
+	}
+	a.applyConfigOverrides(next)
+	if err := next.Validate(); err != nil {
+		return fmt.Errorf("profile %q has invalid settings: %w", name, err)
+	}
+
+	// Persist the profile we are leaving
+	if err := a.saveConfig(a.currentConfig()); err != nil {
+		return fmt.Errorf("failed to save current profile: %w", err)
+	}
+
+	wasRunning := a.tunnel.IsRunning()
+	if wasRunning {
+		if err := a.tunnel.Stop(); err != nil {
+			return fmt.Errorf("failed to stop tunnel: %w", err)
+		}
+	}
+
+	if err := setActiveProfileName(name); err != nil {
+		return fmt.Errorf("failed to activate profile: %w", err)
+	}
+
+	a.configSync.mu.Lock()
+	a.adoptConfig(next)
+	a.markConfigSynced()
+	a.configSync.mu.Unlock()
+	// A new or cloned profile has no device ID yet
+	if a.currentConfig().DeviceID == "" {
+		if err := a.ensureDeviceID(); err != nil {
+			appLogger.Warn("%v", err)
+		}
+		a.loadDeviceCredential()
+	}
+	a.emitEvent("config:reloaded", a.GetConfig())
+	appLogger.Info("Activated profile %s", name)
+
+	if wasRunning {
+		token, err := a.getToken("")
+		if err != nil {
+			return fmt.Errorf("profile activated but tunnel could not be restarted: %w", err)
+		}
+		if err := a.tunnel.Start(token); err != nil {
+			return fmt.Errorf("profile activated but tunnel could not be restarted: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetUpdateStatus returns the result of the last cloudflared update check
+func (a *App) GetUpdateStatus() UpdateStatus {
+	return a.updater.Status()
+}
+
+// CheckForUpdates checks for a newer cloudflared release right away and stages it
+func (a *App) CheckForUpdates() (UpdateStatus, error) {
+	return a.updater.CheckNow()
+}
+
+// ApplyUpdateNow restarts the running tunnel on the staged cloudflared version
+func (a *App) ApplyUpdateNow() error {
+	return a.updater.ApplyNow()
+}
+
+// GetBinaryCacheInfo returns the cached cloudflared versions and their total size
+func (a *App) GetBinaryCacheInfo() (map[string]interface{}, error) {
+	return a.tunnel.GetBinaryCacheInfo()
+}
+
+// ClearBinaryCache deletes cached cloudflared binaries that are not in use
+func (a *App) ClearBinaryCache() error {
+	return a.tunnel.ClearBinaryCache()
 }
 
 // Greet returns a greeting for the given name (kept for API compatibility)
@@ -201,31 +586,36 @@ func (a *App) Greet(name string) string {
 
 // AddRoute adds a route to the configuration
 func (a *App) AddRoute(hostname, service string) error {
-	a.config.AddRoute(hostname, service)
-	if err := a.config.Save(); err != nil {
+	candidate := a.currentConfig().Clone()
+	candidate.AddRoute(hostname, service)
+	if err := candidate.Validate(); err != nil {
+		return err
+	}
+
+	if err := a.updateConfig(func(c *Config) { c.AddRoute(hostname, service) }); err != nil {
 		return fmt.Errorf("failed to save config: %w", err)
 	}
 	// Update tunnel config reference
-	a.tunnel.SetConfig(a.config)
+	a.tunnel.SetConfig(a.currentConfig())
 	return nil
 }
 
 // RemoveRoute removes a route from the configuration
 func (a *App) RemoveRoute(hostname string) error {
-	if !a.config.RemoveRoute(hostname) {
+	if !a.currentConfig().Clone().RemoveRoute(hostname) {
 		return fmt.Errorf("route not found: %s", hostname)
 	}
-	if err := a.config.Save(); err != nil {
+	if err := a.updateConfig(func(c *Config) { c.RemoveRoute(hostname) }); err != nil {
 		return fmt.Errorf("failed to save config: %w", err)
 	}
 	// Update tunnel config reference
-	a.tunnel.SetConfig(a.config)
+	a.tunnel.SetConfig(a.currentConfig())
 	return nil
 }
 
 // GetRoutes returns all configured routes
 func (a *App) GetRoutes() []Route {
-	return a.config.Routes
+	return a.currentConfig().Routes
 }
 
 // StartTunnelWithWebServer starts tunnel and automatically starts web server on success
@@ -258,8 +648,8 @@ func (a *App) StartTunnelWithWebServer(manualToken string) (map[string]interface
 
 // getWebServerPort returns the configured web server port or default
 func (a *App) getWebServerPort() int {
-	if a.config.WebServerPort > 0 {
-		return a.config.WebServerPort
+	if port := a.currentConfig().WebServerPort; port > 0 {
+		return port
 	}
 	return 8080
 }
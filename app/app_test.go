@@ -0,0 +1,187 @@
+package app
+
+import (
+	"context"
+	"crypto/ed25519"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/votanchat/cloudflared-desktop-tunnel/mockbackend"
+	"github.com/votanchat/cloudflared-desktop-tunnel/mockbackend/mocktest"
+	"github.com/votanchat/cloudflared-desktop-tunnel/secrets"
+)
+
+// startApp runs the whole app against a mock backend until the test ends,
+// with its settings, cache and secrets in a temporary directory. Secrets go
+// to the file store, unlocked, so no keyring is needed.
+func startApp(t *testing.T, backendURL string, edit func(c *Config)) *App {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path="+filepath.Join(dir, "no-bus"))
+
+	config := DefaultConfig()
+	config.BackendURL = backendURL
+	config.SecretStore = secrets.StoreFile
+	config.AutoStart = false
+	if edit != nil {
+		edit(config)
+	}
+	if err := config.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewApp()
+	ctx, cancel := context.WithCancel(context.Background())
+	a.Startup(ctx)
+	t.Cleanup(func() {
+		cancel()
+		a.Shutdown(context.Background())
+	})
+	if err := a.UnlockSecretStore("test passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAppAgainstMockBackend(t *testing.T) {
+	mock, server := mocktest.New(t)
+	_, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.SetSigningKey(signingKey)
+	mock.RequireEnrollment(true)
+	mock.AddEnrollmentCode("code-1")
+	a := startApp(t, server.URL, func(c *Config) {
+		c.CacheLastToken = true
+		c.CommandPublicKey = mock.PublicKey()
+		c.AllowedCommands = []string{"patch"}
+	})
+	ctx := context.Background()
+
+	// Until the device is enrolled the backend refuses it
+	if _, err := a.getToken(""); err == nil {
+		t.Fatal("got a token before enrolling")
+	}
+	if _, err := a.EnrollDevice("code-2"); err == nil {
+		t.Fatal("enrolled with an unknown code")
+	}
+	status, err := a.EnrollDevice("code-1")
+	if err != nil {
+		t.Fatalf("EnrollDevice: %v", err)
+	}
+	if !status.Enrolled || !status.Loaded || status.DeviceID == "" {
+		t.Fatalf("got device status %+v after enrolling", status)
+	}
+	if _, err := a.EnrollDevice("code-1"); err == nil {
+		t.Error("enrolled twice with a one-time code")
+	}
+	if err := mock.WaitConnected(5*time.Second, 1); err != nil {
+		t.Fatalf("commands websocket did not connect after enrolling: %v", err)
+	}
+
+	// Status reports refused before enrolling are delivered with the next one
+	a.sendStatus(ctx, a.statusReport(ReportReasonHeartbeat))
+	for _, reason := range []string{ReportReasonStartup, ReportReasonHeartbeat} {
+		if _, err := mock.WaitStatus(5*time.Second, func(s mockbackend.StatusReport) bool {
+			return s.DeviceID == status.DeviceID && s.Reason == reason
+		}); err != nil {
+			t.Errorf("%s status report not received: %v", reason, err)
+		}
+	}
+
+	// Tokens are fetched with the credential and cached; a rotated one replaces the cache
+	token, err := a.getToken("")
+	if err != nil {
+		t.Fatalf("getToken: %v", err)
+	}
+	if token != mock.Token() {
+		t.Errorf("got token %q, want %q", token, mock.Token())
+	}
+	if cached, err := a.cachedToken(); err != nil || cached != token {
+		t.Errorf("cached token is %q (%v), want the fetched one", cached, err)
+	}
+	rotated := mock.RotateToken()
+	if _, err := a.backendClient.FetchToken(ctx); err != nil {
+		t.Fatalf("FetchToken: %v", err)
+	}
+	eventually(t, "the rotated token to be cached", func() bool {
+		cached, err := a.cachedToken()
+		return err == nil && cached == rotated
+	})
+
+	// A signed patch command changes settings and is saved
+	cmd, err := mock.Push(mockbackend.Command{Type: "patch", Payload: map[string]interface{}{"refreshInterval": 600}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := mock.WaitReport(5*time.Second, cmd.ID, ReportResult)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != CommandSucceeded {
+		t.Fatalf("got patch result %q (%s), want %q", result.Status, result.Error, CommandSucceeded)
+	}
+	if got := a.currentConfig().RefreshInterval; got != 600 {
+		t.Errorf("refresh interval is %d after the patch, want 600", got)
+	}
+	if saved, err := LoadConfig(); err != nil || saved.RefreshInterval != 600 {
+		t.Errorf("patched setting was not saved: %v", err)
+	}
+
+	// Settings that point at local files or secrets cannot be patched
+	refused, _ := mock.Push(mockbackend.Command{Type: "patch", Payload: map[string]interface{}{"secretStore": "keyring"}})
+	if result, err = mock.WaitReport(5*time.Second, refused.ID, ReportResult); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != CommandFailed {
+		t.Errorf("got result %q for patching secretStore, want %q", result.Status, CommandFailed)
+	}
+	if got := a.currentConfig().SecretStore; got != secrets.StoreFile {
+		t.Errorf("secret store changed to %q", got)
+	}
+}
+
+func TestAppFailsOverAndUsesCachedToken(t *testing.T) {
+	primary, primaryServer := mocktest.New(t)
+	secondary, secondaryServer := mocktest.New(t)
+	a := startApp(t, primaryServer.URL, func(c *Config) {
+		c.FallbackBackendURLs = []string{secondaryServer.URL}
+		c.CacheLastToken = true
+	})
+
+	// With the primary down the token comes from the next endpoint, and is cached
+	primary.SetFaults(mockbackend.Faults{ErrorRate: 1})
+	token, err := a.getToken("")
+	if err != nil {
+		t.Fatalf("getToken did not fail over: %v", err)
+	}
+	if token != secondary.Token() {
+		t.Errorf("got token %q, want the secondary's %q", token, secondary.Token())
+	}
+
+	// With every endpoint down the cached token starts the tunnel, and the user is told
+	secondary.SetFaults(mockbackend.Faults{ErrorRate: 1})
+	cached, err := a.getToken("")
+	if err != nil {
+		t.Fatalf("getToken did not fall back to the cached token: %v", err)
+	}
+	if cached != token {
+		t.Errorf("got token %q, want the cached %q", cached, token)
+	}
+	if len(a.GetNotices()) == 0 {
+		t.Error("no notice that the cached token is in use")
+	}
+
+	// Without caching an outage is an error
+	if err := a.updateConfig(func(c *Config) { c.CacheLastToken = false }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.getToken(""); err == nil {
+		t.Error("got a token during an outage with caching off")
+	}
+}
@@ -3,10 +3,13 @@ package app
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,14 +17,44 @@ import (
 
 // BackendClient handles communication with the backend API
 type BackendClient struct {
-	baseURL    string
-	httpClient *http.Client
-	ws         *websocket.Conn
-	token      string
-	running    bool
-	commandsCh chan Command
+	mu              sync.RWMutex     // Guards endpoints, active, dialer, ws, conn, cancel, token, refreshInterval and tokenStatus
+	endpoints       []endpointHealth // In order of preference, see backend_endpoints.go
+	active          int              // Index of the endpoint requests go to
+	httpClient      *http.Client
+	dialer          *websocket.Dialer
+	ws              *websocket.Conn
+	conn            ConnectionState
+	cancel          context.CancelFunc // Stops the goroutines started by Start
+	loops           sync.WaitGroup     // The connection and token refresh loops
+	reconnectKick   chan struct{}      // Skips the backoff wait, see Reconnect
+	token           string
+	commandsCh      chan Command
+	clock           clock
+	refreshInterval time.Duration
+	tokenStatus     TokenStatus
+	refreshKick     chan struct{} // Wakes tokenRefreshLoop to reschedule
+	onTokenChanged  OnTokenChanged
+	handlers        map[string]CommandHandler // By command type, guarded by mu
+	writeMu         sync.Mutex                // Serializes websocket writes
+	results         commandLog
+	commandKey      ed25519.PublicKey    // Commands must be signed with this key; guarded by mu
+	allowedCommands []string             // Command types the user allows; guarded by mu
+	seenCommands    map[string]time.Time // Authorized command IDs until their deadline; guarded by mu
+
+	// Device enrollment, see device.go; guarded by mu
+	deviceID           string
+	deviceCredential   string
+	credentialRejected bool // The backend answered 401 to the current credential
+	onUnauthorized     func(error)
 }
 
+// ErrDeviceUnauthorized is returned when the backend rejects the device credential
+var ErrDeviceUnauthorized = errors.New("backend rejected this device's credential")
+
+// OnTokenChanged is called when a fetched token materially differs from the
+// previous one; oldToken is empty for the first token fetched
+type OnTokenChanged func(oldToken, newToken string)
+
 // convertHTTPToWS converts HTTP(S) URL to WS(S)
 func convertHTTPToWS(baseURL string) string {
 	if len(baseURL) > 4 && baseURL[:4] == "http" {
@@ -32,8 +65,18 @@ func convertHTTPToWS(baseURL string) string {
 
 // Command represents a command from the backend
 type Command struct {
-	Type    string                 `json:"type"`    // "update", "restart", "patch", etc.
-	Payload map[string]interface{} `json:"payload"` // Command-specific data
+	ID       string                 `json:"id"`       // Unique per command; reports refer to it
+	Type     string                 `json:"type"`     // "update", "restart", "patch", etc.
+	Payload  map[string]interface{} `json:"payload"`  // Command-specific data
+	DeviceID string                 `json:"deviceId"` // The device it is meant for
+	IssuedAt time.Time              `json:"issuedAt"` // When the backend sent it
+	Deadline time.Time              `json:"deadline"` // Not run after this time, see maxCommandLifetime
+
+	// Signature is the base64 Ed25519 signature of the canonical command,
+	// see canonicalCommand
+	Signature string `json:"signature"`
+
+	raw []byte // The message as received, for signature checks
 }
 
 // TokenResponse represents the response from token endpoint
@@ -45,134 +88,268 @@ type TokenResponse struct {
 // NewBackendClient creates a new backend client
 func NewBackendClient(baseURL string) *BackendClient {
 	return &BackendClient{
-		baseURL: baseURL,
+		endpoints: []endpointHealth{{url: baseURL, healthy: true}},
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
-		commandsCh: make(chan Command, 10),
+		dialer:          websocket.DefaultDialer,
+		conn:            ConnectionState{State: ConnDisconnected},
+		reconnectKick:   make(chan struct{}, 1),
+		commandsCh:      make(chan Command, 10),
+		clock:           realClock{},
+		refreshInterval: defaultTokenRefreshInterval,
+		refreshKick:     make(chan struct{}, 1),
+		handlers:        make(map[string]CommandHandler),
+		seenCommands:    make(map[string]time.Time),
+	}
+}
+
+// SetNetwork sets the HTTP transport and websocket dialer used to reach the
+// backend. Requests in flight finish on the previous transport.
+func (bc *BackendClient) SetNetwork(transport http.RoundTripper, dialer *websocket.Dialer) {
+	bc.mu.Lock()
+	old := bc.httpClient
+	bc.httpClient = &http.Client{Transport: transport, Timeout: old.Timeout}
+	bc.dialer = dialer
+	bc.mu.Unlock()
+
+	if old.Transport != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// client returns the HTTP client for backend requests
+func (bc *BackendClient) client() *http.Client {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.httpClient
+}
+
+// SetOnTokenChanged sets the callback invoked when the backend hands out a different token
+func (bc *BackendClient) SetOnTokenChanged(callback OnTokenChanged) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.onTokenChanged = callback
+}
+
+// SetCommandHandler sets the handler for backend commands of the given type
+func (bc *BackendClient) SetCommandHandler(commandType string, handler CommandHandler) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.handlers[commandType] = handler
+}
+
+// SetCommandPolicy sets the key commands must be signed with and the command
+// types that may run. With a nil key every command is refused.
+func (bc *BackendClient) SetCommandPolicy(publicKey ed25519.PublicKey, allowed []string) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.commandKey = publicKey
+	bc.allowedCommands = append([]string(nil), allowed...)
+}
+
+// SetCommandLogPath persists command results at path, loading earlier ones
+func (bc *BackendClient) SetCommandLogPath(path string) error {
+	return bc.results.load(path)
+}
+
+// Reconnect drops the current websocket and dials again without waiting
+// for the backoff delay
+func (bc *BackendClient) Reconnect() {
+	bc.mu.RLock()
+	ws := bc.ws
+	bc.mu.RUnlock()
+
+	backendLogger.Info("Reconnecting WebSocket to %s", bc.getBaseURL())
+	select {
+	case bc.reconnectKick <- struct{}{}:
+	default:
+	}
+	if ws != nil {
+		ws.Close()
 	}
 }
 
-// Start starts the backend client
+// Start starts the backend client; it runs until ctx is cancelled or Stop is called
 func (bc *BackendClient) Start(ctx context.Context) {
-	bc.running = true
+	ctx, cancel := context.WithCancel(ctx)
+	bc.mu.Lock()
+	bc.cancel = cancel
+	bc.mu.Unlock()
 	backendLogger.Info("Backend client started")
 
-	go bc.connectWebSocket(ctx)
-	go bc.tokenRefreshLoop(ctx)
+	bc.loops.Add(3)
+	go func() {
+		defer bc.loops.Done()
+		bc.connectWebSocket(ctx)
+	}()
+	go func() {
+		defer bc.loops.Done()
+		bc.tokenRefreshLoop(ctx)
+	}()
+	go func() {
+		defer bc.loops.Done()
+		bc.healthCheckLoop(ctx)
+	}()
 	go bc.processCommands(ctx)
 }
 
-// Stop stops the backend client
+// Stop stops the backend client and waits for its connection, refresh and
+// health check loops to exit. A command that is already running finishes on its own.
 func (bc *BackendClient) Stop() {
-	bc.running = false
-	if bc.ws != nil {
-		bc.ws.Close()
+	bc.mu.RLock()
+	cancel, ws := bc.cancel, bc.ws
+	bc.mu.RUnlock()
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	if ws != nil {
+		ws.Close()
 	}
-	close(bc.commandsCh)
+	bc.loops.Wait()
 	backendLogger.Info("Backend client stopped")
 }
 
-// FetchToken fetches a tunnel token from the backend
-func (bc *BackendClient) FetchToken() (string, error) {
-	resp, err := bc.httpClient.Get(bc.baseURL + "/api/token")
+// FetchToken fetches a tunnel token from the backend and reschedules the
+// next refresh around its expiry. The request is abandoned when ctx is cancelled.
+func (bc *BackendClient) FetchToken(ctx context.Context) (string, error) {
+	token, err := bc.fetchToken(ctx)
+	bc.rescheduleRefresh()
+	return token, err
+}
+
+// fetchToken fetches a token and records the outcome in the token status
+func (bc *BackendClient) fetchToken(ctx context.Context) (string, error) {
+	tokenResp, err := bc.requestToken(ctx)
+
+	bc.mu.Lock()
+	if err != nil {
+		bc.tokenStatus.LastError = err.Error()
+		bc.tokenStatus.Failures++
+		bc.mu.Unlock()
+		return "", err
+	}
+
+	oldToken := bc.token
+	bc.token = tokenResp.Token
+	bc.tokenStatus.LastRefresh = bc.clock.Now()
+	bc.tokenStatus.ExpiresAt = tokenResp.ExpiresAt
+	bc.tokenStatus.LastError = ""
+	bc.tokenStatus.Failures = 0
+	onTokenChanged := bc.onTokenChanged
+	bc.mu.Unlock()
+	backendLogger.Info("Token fetched successfully, expires at: %v", tokenResp.ExpiresAt)
+
+	if !sameTunnelToken(oldToken, tokenResp.Token) {
+		backendLogger.Info("Backend issued a new tunnel token")
+		if onTokenChanged != nil {
+			onTokenChanged(oldToken, tokenResp.Token)
+		}
+	}
+
+	return tokenResp.Token, nil
+}
+
+// requestToken calls the token endpoint
+func (bc *BackendClient) requestToken(ctx context.Context) (*TokenResponse, error) {
+	resp, err := bc.do(ctx, http.MethodGet, "/api/token", nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch token: %w", err)
+		return nil, fmt.Errorf("failed to fetch token: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(body))
+	if err := bc.checkResponse(resp); err != nil {
+		return nil, err
 	}
 
 	var tokenResp TokenResponse
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
-
-	bc.token = tokenResp.Token
-	backendLogger.Info("Token fetched successfully, expires at: %v", tokenResp.ExpiresAt)
-
-	return tokenResp.Token, nil
+	if tokenResp.Token == "" {
+		return nil, fmt.Errorf("server returned an empty token")
+	}
+	return &tokenResp, nil
 }
 
-// ReportStatus reports tunnel status to the backend
-func (bc *BackendClient) ReportStatus(status map[string]interface{}) error {
-	data, err := json.Marshal(status)
+// ReportStatus reports tunnel status to the backend, giving up when ctx is cancelled
+func (bc *BackendClient) ReportStatus(ctx context.Context, report StatusReport) error {
+	data, err := json.Marshal(report)
 	if err != nil {
 		return err
 	}
 
-	resp, err := bc.httpClient.Post(
-		bc.baseURL+"/api/status",
-		"application/json",
-		bytes.NewBuffer(data),
-	)
+	resp, err := bc.do(ctx, http.MethodPost, "/api/status", data)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(body))
-	}
-
-	return nil
+	return bc.checkResponse(resp)
 }
 
-// connectWebSocket connects to the backend WebSocket for real-time commands
-func (bc *BackendClient) connectWebSocket(ctx context.Context) {
-	const reconnectDelay = 10 * time.Second
-
-	for bc.running {
-		wsURL := convertHTTPToWS(bc.baseURL) + "/api/commands"
-		backendLogger.Info("Connecting to WebSocket: %s", wsURL)
-
-		ws, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
-		if err != nil {
-			backendLogger.Warn("Failed to connect to WebSocket: %v, retrying in %v", err, reconnectDelay)
-			time.Sleep(reconnectDelay)
-			continue
+// do sends a request to the active backend endpoint with the device
+// credential attached. If the endpoint is unreachable or answers with a
+// server error, the request is retried on the endpoint failed over to.
+func (bc *BackendClient) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	attempts := max(bc.endpointCount(), 1)
+	for attempt := 1; ; attempt++ {
+		baseURL := bc.getBaseURL()
+		resp, err := bc.send(ctx, method, baseURL+path, body)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			bc.endpointSucceeded(baseURL)
+			return resp, nil
 		}
 
-		bc.ws = ws
-		backendLogger.Info("WebSocket connected")
-
-		for bc.running {
-			var cmd Command
-			if err := ws.ReadJSON(&cmd); err != nil {
-				backendLogger.Error("WebSocket read error: %v", err)
-				break
-			}
-
-			backendLogger.Debug("Received command: %s", cmd.Type)
-			bc.commandsCh <- cmd
+		failure := err
+		if failure == nil {
+			failure = fmt.Errorf("server returned status %d", resp.StatusCode)
+		}
+		if ctx.Err() != nil || !bc.endpointFailed(baseURL, failure) {
+			return resp, err
+		}
+		// Move the websocket along with the requests
+		bc.Reconnect()
+		if attempt >= attempts {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
 		}
-
-		ws.Close()
-		backendLogger.Warn("WebSocket disconnected, reconnecting in %v...", reconnectDelay)
-		time.Sleep(reconnectDelay)
 	}
 }
 
-// tokenRefreshLoop periodically refreshes the token
-func (bc *BackendClient) tokenRefreshLoop(ctx context.Context) {
-	const refreshInterval = 5 * time.Minute
-	ticker := time.NewTicker(refreshInterval)
-	defer ticker.Stop()
+// send makes a single request with the device credential attached
+func (bc *BackendClient) send(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, values := range bc.authHeader() {
+		req.Header[name] = values
+	}
+	return bc.client().Do(req)
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			if _, err := bc.FetchToken(); err != nil {
-				backendLogger.Error("Failed to refresh token: %v", err)
-			}
-		}
+// checkResponse turns a non-200 response into an error, noting a rejected credential
+func (bc *BackendClient) checkResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
 	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized {
+		return bc.unauthorized(string(body))
+	}
+	return fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(body))
 }
 
 // processCommands processes commands received from the backend
@@ -190,16 +367,129 @@ func (bc *BackendClient) processCommands(ctx context.Context) {
 	}
 }
 
-// handleCommand handles a single command
+// authorizeCommand checks cmd against the pinned key, the allowed command
+// types and this device's ID
+func (bc *BackendClient) authorizeCommand(cmd Command) error {
+	bc.mu.RLock()
+	publicKey, allowed, deviceID := bc.commandKey, bc.allowedCommands, bc.deviceID
+	bc.mu.RUnlock()
+	return authorizeCommand(cmd, publicKey, allowed, deviceID, bc.clock.Now())
+}
+
+// markSeen remembers an authorized command until its deadline and reports
+// whether its ID is new. Once the deadline passes a replay is reported as
+// expired instead, so the set stays small.
+func (bc *BackendClient) markSeen(cmd Command) bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	now := bc.clock.Now()
+	for id, deadline := range bc.seenCommands {
+		if now.After(deadline) {
+			delete(bc.seenCommands, id)
+		}
+	}
+	if _, ok := bc.seenCommands[cmd.ID]; ok {
+		return false
+	}
+	bc.seenCommands[cmd.ID] = cmd.Deadline
+	return true
+}
+
+// handleCommand runs the handler registered for the command type and
+// reports the outcome. Commands reach it already authorized. A command whose
+// ID was already handled is not run again; the backend gets the original
+// result instead.
 func (bc *BackendClient) handleCommand(cmd Command) {
-	switch cmd.Type {
-	case "update":
-		backendLogger.Info("Received update command (not implemented)")
-	case "restart":
-		backendLogger.Info("Received restart command (not implemented)")
-	case "patch":
-		backendLogger.Info("Received patch command (not implemented)")
-	default:
+	if result, ok := bc.results.get(cmd.ID); ok {
+		backendLogger.Info("Command %s was already handled, resending its result", cmd.ID)
+		bc.sendReport(result)
+		return
+	}
+
+	if !cmd.Deadline.IsZero() && bc.clock.Now().After(cmd.Deadline) {
+		bc.report(cmd, ReportResult, CommandExpired, fmt.Errorf("deadline %v passed before the command could run", cmd.Deadline))
+		return
+	}
+
+	bc.mu.RLock()
+	handler, ok := bc.handlers[cmd.Type]
+	bc.mu.RUnlock()
+
+	if !ok {
 		backendLogger.Warn("Unknown command type: %s", cmd.Type)
+		bc.report(cmd, ReportResult, CommandRejected, fmt.Errorf("unknown command type %q", cmd.Type))
+		return
+	}
+
+	backendLogger.Info("Running %s command %s", cmd.Type, cmd.ID)
+	bc.report(cmd, ReportInProgress, "", nil)
+	if err := handler(cmd); err != nil {
+		backendLogger.Error("Command %s failed: %v", cmd.Type, err)
+		bc.report(cmd, ReportResult, CommandFailed, err)
+		return
+	}
+	backendLogger.Info("Command %s completed", cmd.Type)
+	bc.report(cmd, ReportResult, CommandSucceeded, nil)
+}
+
+// report sends a report about cmd; results are also recorded for duplicates and replay
+func (bc *BackendClient) report(cmd Command, reportType, status string, err error) {
+	if cmd.ID == "" {
+		return
+	}
+	report := bc.newReport(cmd, reportType, status, err)
+	if reportType == ReportResult {
+		if err := bc.results.record(report); err != nil {
+			backendLogger.Warn("Failed to save command result: %v", err)
+		}
+	}
+	bc.sendReport(report)
+}
+
+// newReport builds a report about cmd
+func (bc *BackendClient) newReport(cmd Command, reportType, status string, err error) CommandReport {
+	report := CommandReport{
+		Type:        reportType,
+		CommandID:   cmd.ID,
+		CommandType: cmd.Type,
+		Status:      status,
+		Time:        bc.clock.Now(),
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report
+}
+
+// sendReport writes a report to the websocket. Results that cannot be sent
+// now go out with the replay after the next connect.
+func (bc *BackendClient) sendReport(report CommandReport) {
+	bc.mu.RLock()
+	ws := bc.ws
+	bc.mu.RUnlock()
+	if ws == nil {
+		return
+	}
+
+	bc.writeMu.Lock()
+	ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	err := ws.WriteJSON(report)
+	bc.writeMu.Unlock()
+	if err != nil {
+		backendLogger.Warn("Failed to send %s for command %s: %v", report.Type, report.CommandID, err)
+	}
+}
+
+// replayResults resends the results the backend has not confirmed after a
+// (re)connect, so none are lost with a dropped connection
+func (bc *BackendClient) replayResults() {
+	results := bc.results.undelivered()
+	if len(results) == 0 {
+		return
+	}
+	backendLogger.Info("Replaying %d command results", len(results))
+	for _, result := range results {
+		bc.sendReport(result)
 	}
 }
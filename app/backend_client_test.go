@@ -0,0 +1,287 @@
+package app
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/votanchat/cloudflared-desktop-tunnel/mockbackend"
+	"github.com/votanchat/cloudflared-desktop-tunnel/mockbackend/mocktest"
+)
+
+// startClient runs a backend client against the given endpoints until the test ends
+func startClient(t *testing.T, urls ...string) *BackendClient {
+	t.Helper()
+	bc := NewBackendClient(urls[0])
+	bc.SetEndpoints(urls)
+	ctx, cancel := context.WithCancel(context.Background())
+	go bc.Start(ctx)
+	t.Cleanup(func() {
+		cancel()
+		bc.Stop()
+	})
+	return bc
+}
+
+func TestBackendClientAgainstMockBackend(t *testing.T) {
+	mock, server := mocktest.New(t)
+	bc := startClient(t, server.URL)
+
+	token, err := bc.FetchToken(context.Background())
+	if err != nil {
+		t.Fatalf("FetchToken: %v", err)
+	}
+	if token != mock.Token() {
+		t.Errorf("got token %q, want %q", token, mock.Token())
+	}
+
+	if err := bc.ReportStatus(context.Background(), StatusReport{DeviceID: "device-1", Reason: ReportReasonHeartbeat}); err != nil {
+		t.Fatalf("ReportStatus: %v", err)
+	}
+	if _, err := mock.WaitStatus(time.Second, func(s mockbackend.StatusReport) bool {
+		return s.DeviceID == "device-1" && s.Reason == ReportReasonHeartbeat
+	}); err != nil {
+		t.Errorf("status report not received: %v", err)
+	}
+}
+
+// commandClient runs a backend client for device-1 against a mock backend
+// that signs its commands, allowing the given command types
+func commandClient(t *testing.T, allowed ...string) (*mockbackend.Server, *BackendClient) {
+	t.Helper()
+	mock, server := mocktest.New(t)
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.SetSigningKey(privateKey)
+
+	bc := startClient(t, server.URL)
+	bc.SetDeviceCredential("device-1", "")
+	bc.SetCommandPolicy(publicKey, allowed)
+	if err := mock.WaitConnected(5*time.Second, 1); err != nil {
+		t.Fatalf("websocket did not connect: %v", err)
+	}
+	return mock, bc
+}
+
+// countReports returns how many reports of reportType the mock got about a command
+func countReports(mock *mockbackend.Server, commandID, reportType string) int {
+	n := 0
+	for _, report := range mock.Reports() {
+		if report.CommandID == commandID && report.Type == reportType {
+			n++
+		}
+	}
+	return n
+}
+
+// eventually fails the test if cond does not become true within a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCommandReportsAndReplay(t *testing.T) {
+	mock, bc := commandClient(t, "restart", "update")
+	runs := make(chan string, 4)
+	bc.SetCommandHandler("restart", func(cmd Command) error {
+		runs <- cmd.ID
+		return nil
+	})
+	bc.SetCommandHandler("update", func(cmd Command) error {
+		return errors.New("no such version")
+	})
+
+	// A command is acknowledged, reported in progress and then finished
+	cmd, err := mock.Push(mockbackend.Command{Type: "restart", DeviceID: "device-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reportType := range []string{ReportAck, ReportInProgress, ReportResult} {
+		if _, err := mock.WaitReport(5*time.Second, cmd.ID, reportType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, _ := mock.WaitReport(time.Second, cmd.ID, ReportResult)
+	if result.Status != CommandSucceeded {
+		t.Errorf("got result %q (%s), want %q", result.Status, result.Error, CommandSucceeded)
+	}
+	<-runs
+
+	// A failure is reported with its error
+	failed, _ := mock.Push(mockbackend.Command{Type: "update", DeviceID: "device-1"})
+	if result, err = mock.WaitReport(5*time.Second, failed.ID, ReportResult); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != CommandFailed || !strings.Contains(result.Error, "no such version") {
+		t.Errorf("got result %q (%s), want %q with the handler's error", result.Status, result.Error, CommandFailed)
+	}
+
+	// A duplicate is answered with its first result instead of running again
+	if _, err := mock.Push(mockbackend.Command{ID: cmd.ID, Type: "restart", DeviceID: "device-1"}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the first result to be resent", func() bool { return countReports(mock, cmd.ID, ReportResult) == 2 })
+	if len(runs) > 0 {
+		t.Error("restart handler ran again for a duplicate command")
+	}
+
+	// After a reconnect only results the backend has not confirmed are replayed
+	eventually(t, "results to be confirmed", func() bool { return len(bc.results.undelivered()) == 0 })
+	if err := bc.results.record(CommandReport{Type: ReportResult, CommandID: "offline-1", CommandType: "restart", Status: CommandSucceeded}); err != nil {
+		t.Fatal(err)
+	}
+	mock.DropSockets()
+	if err := mock.WaitDisconnected(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mock.WaitReport(10*time.Second, "offline-1", ReportResult); err != nil {
+		t.Fatalf("unconfirmed result was not replayed: %v", err)
+	}
+	if n := countReports(mock, cmd.ID, ReportResult); n != 2 {
+		t.Errorf("confirmed result was sent %d times, want 2", n)
+	}
+}
+
+func TestCommandAuthorization(t *testing.T) {
+	mock, bc := commandClient(t, "restart")
+	ran := make(chan string, 8)
+	for _, commandType := range commandTypes {
+		bc.SetCommandHandler(commandType, func(cmd Command) error {
+			ran <- cmd.ID
+			return nil
+		})
+	}
+
+	// refused pushes cmd and checks it is refused without an ack
+	refused := func(cmd mockbackend.Command, what string) {
+		t.Helper()
+		pushed, err := mock.Push(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := mock.WaitReport(5*time.Second, pushed.ID, ReportResult)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != CommandRefused {
+			t.Errorf("got result %q for %s, want %q", result.Status, what, CommandRefused)
+		}
+		if countReports(mock, pushed.ID, ReportAck) > 0 {
+			t.Errorf("%s was acknowledged", what)
+		}
+	}
+
+	now := time.Now()
+	refused(mockbackend.Command{Type: "restart", DeviceID: "device-2"}, "another device's command")
+	refused(mockbackend.Command{Type: "patch", DeviceID: "device-1"}, "a command type the user did not allow")
+	refused(mockbackend.Command{Type: "restart", DeviceID: "device-1", IssuedAt: now.Add(-2 * time.Hour), Deadline: now.Add(time.Minute)},
+		"a command valid for longer than maxCommandLifetime")
+	refused(mockbackend.Command{Type: "restart", DeviceID: "device-1", IssuedAt: now.Add(time.Hour), Deadline: now.Add(time.Hour + time.Minute)},
+		"a command issued in the future")
+
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.SetSigningKey(otherKey)
+	refused(mockbackend.Command{Type: "restart", DeviceID: "device-1"}, "a command signed with another key")
+	mock.SetSigningKey(nil)
+	refused(mockbackend.Command{Type: "restart", DeviceID: "device-1"}, "an unsigned command")
+
+	if len(ran) > 0 {
+		t.Errorf("%d refused commands were run", len(ran))
+	}
+}
+
+func TestBackendClientFailsOver(t *testing.T) {
+	primary, primaryServer := mocktest.New(t)
+	secondary, secondaryServer := mocktest.New(t)
+	bc := startClient(t, primaryServer.URL, secondaryServer.URL)
+
+	if err := primary.WaitConnected(5*time.Second, 1); err != nil {
+		t.Fatalf("websocket did not connect to the primary: %v", err)
+	}
+
+	// A primary answering with 500s sends requests and the websocket to the secondary
+	primary.SetFaults(mockbackend.Faults{ErrorRate: 1})
+	token, err := bc.FetchToken(context.Background())
+	if err != nil {
+		t.Fatalf("FetchToken did not fail over: %v", err)
+	}
+	if token != secondary.Token() {
+		t.Errorf("got token %q, want the secondary's %q", token, secondary.Token())
+	}
+	if err := secondary.WaitConnected(5*time.Second, 1); err != nil {
+		t.Fatalf("websocket did not follow the failover: %v", err)
+	}
+}
+
+func TestBackendClientReconnects(t *testing.T) {
+	mock, server := mocktest.New(t)
+	bc := startClient(t, server.URL)
+
+	if err := mock.WaitConnected(5*time.Second, 1); err != nil {
+		t.Fatalf("websocket did not connect: %v", err)
+	}
+	eventually(t, "the connected state", func() bool { return bc.ConnectionState().State == ConnConnected })
+
+	// A dropped socket is dialled again after a backoff
+	mock.DropSockets()
+	if err := mock.WaitDisconnected(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.WaitConnected(10*time.Second, 1); err != nil {
+		t.Fatalf("websocket did not reconnect after being dropped: %v", err)
+	}
+	eventually(t, "the connected state", func() bool { return bc.ConnectionState().State == ConnConnected })
+
+	// Stop closes the connection and returns without waiting out a read
+	start := time.Now()
+	bc.Stop()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Stop took %v", elapsed)
+	}
+	if state := bc.ConnectionState().State; state != ConnDisconnected {
+		t.Errorf("got state %q after Stop, want %q", state, ConnDisconnected)
+	}
+	if err := mock.WaitDisconnected(5 * time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBackendClientStopsDuringBackoff(t *testing.T) {
+	// Nothing listens on a port that was just closed, so every dial fails
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String()
+	listener.Close()
+
+	bc := startClient(t, url)
+	eventually(t, "the backoff state", func() bool {
+		state := bc.ConnectionState()
+		return state.State == ConnBackoff && state.RetryAt.After(state.Since) && state.LastError != ""
+	})
+
+	start := time.Now()
+	bc.Stop()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Stop took %v while backing off", elapsed)
+	}
+	if state := bc.ConnectionState().State; state != ConnDisconnected {
+		t.Errorf("got state %q after Stop, want %q", state, ConnDisconnected)
+	}
+}
@@ -0,0 +1,222 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	endpointCheckInterval = time.Minute
+	failbackSuccesses     = 3 // Healthy checks in a row before returning to a preferred endpoint
+)
+
+// endpointHealth tracks one backend endpoint
+type endpointHealth struct {
+	url         string
+	healthy     bool
+	lastError   string
+	lastChecked time.Time
+	successes   int // Consecutive healthy checks, for failback
+}
+
+// EndpointStatus describes a backend endpoint for the UI
+type EndpointStatus struct {
+	URL         string    `json:"url"`
+	Active      bool      `json:"active"`  // Requests currently go here
+	Healthy     bool      `json:"healthy"` // Answered the last request or check
+	LastError   string    `json:"lastError"`
+	LastChecked time.Time `json:"lastChecked"`
+}
+
+// SetEndpoints sets the backend endpoints in order of preference. The
+// current endpoint stays active if it is still listed; otherwise the first
+// one is used. Call Reconnect to move an open websocket over.
+func (bc *BackendClient) SetEndpoints(urls []string) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	current := ""
+	if len(bc.endpoints) > 0 {
+		current = bc.endpoints[bc.active].url
+	}
+
+	bc.endpoints = make([]endpointHealth, 0, len(urls))
+	bc.active = 0
+	for _, url := range urls {
+		if url == current {
+			bc.active = len(bc.endpoints)
+		}
+		bc.endpoints = append(bc.endpoints, endpointHealth{url: url, healthy: true})
+	}
+}
+
+// Endpoints returns the health of every backend endpoint
+func (bc *BackendClient) Endpoints() []EndpointStatus {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	statuses := make([]EndpointStatus, len(bc.endpoints))
+	for i, ep := range bc.endpoints {
+		statuses[i] = EndpointStatus{
+			URL:         ep.url,
+			Active:      i == bc.active,
+			Healthy:     ep.healthy,
+			LastError:   ep.lastError,
+			LastChecked: ep.lastChecked,
+		}
+	}
+	return statuses
+}
+
+// getBaseURL returns the active backend endpoint
+func (bc *BackendClient) getBaseURL() string {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if len(bc.endpoints) == 0 {
+		return ""
+	}
+	return bc.endpoints[bc.active].url
+}
+
+// endpointCount returns how many endpoints are configured
+func (bc *BackendClient) endpointCount() int {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return len(bc.endpoints)
+}
+
+// endpointSucceeded records that url answered
+func (bc *BackendClient) endpointSucceeded(url string) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	for i := range bc.endpoints {
+		if bc.endpoints[i].url == url {
+			bc.endpoints[i].healthy = true
+			bc.endpoints[i].lastError = ""
+			bc.endpoints[i].lastChecked = bc.clock.Now()
+		}
+	}
+}
+
+// endpointFailed records that url is unreachable and, if it is the active
+// endpoint, fails over to the most preferred endpoint not known to be down.
+// It reports whether the active endpoint changed; the caller decides whether
+// the websocket should follow right away.
+func (bc *BackendClient) endpointFailed(url string, err error) bool {
+	bc.mu.Lock()
+	failed := -1
+	for i := range bc.endpoints {
+		if bc.endpoints[i].url == url {
+			bc.endpoints[i].healthy = false
+			bc.endpoints[i].lastError = err.Error()
+			bc.endpoints[i].lastChecked = bc.clock.Now()
+			bc.endpoints[i].successes = 0
+			failed = i
+		}
+	}
+	if failed != bc.active || len(bc.endpoints) < 2 {
+		bc.mu.Unlock()
+		return false
+	}
+
+	// Prefer the first healthy endpoint; if all are down, try the next one in turn
+	next := (failed + 1) % len(bc.endpoints)
+	for i, ep := range bc.endpoints {
+		if i != failed && ep.healthy {
+			next = i
+			break
+		}
+	}
+	bc.active = next
+	nextURL := bc.endpoints[next].url
+	bc.mu.Unlock()
+
+	backendLogger.Warn("Backend %s failed (%v), failing over to %s", url, err, nextURL)
+	return true
+}
+
+// healthCheckLoop probes the endpoints preferred over the active one and
+// fails back once one of them has been healthy for failbackSuccesses checks
+// in a row, so a flapping primary does not bounce the client around
+func (bc *BackendClient) healthCheckLoop(ctx context.Context) {
+	for {
+		timer := bc.clock.NewTimer(endpointCheckInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		bc.mu.RLock()
+		preferred := make([]string, bc.active)
+		for i := 0; i < bc.active; i++ {
+			preferred[i] = bc.endpoints[i].url
+		}
+		bc.mu.RUnlock()
+
+		for _, url := range preferred {
+			err := bc.checkEndpoint(ctx, url)
+			if bc.recordCheck(url, err) {
+				break
+			}
+		}
+	}
+}
+
+// checkEndpoint asks url for /api/health. Any answer below 500 counts as
+// healthy, so backends without a health endpoint can still be checked.
+func (bc *BackendClient) checkEndpoint(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/health", nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range bc.authHeader() {
+		req.Header[name] = values
+	}
+	resp, err := bc.client().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordCheck records a health check of a preferred endpoint and fails back
+// to it when it has been healthy long enough. It reports whether it did.
+func (bc *BackendClient) recordCheck(url string, err error) bool {
+	bc.mu.Lock()
+	index := -1
+	for i := range bc.endpoints {
+		if bc.endpoints[i].url != url {
+			continue
+		}
+		index = i
+		ep := &bc.endpoints[i]
+		ep.lastChecked = bc.clock.Now()
+		if err != nil {
+			ep.healthy = false
+			ep.lastError = err.Error()
+			ep.successes = 0
+		} else {
+			ep.healthy = true
+			ep.lastError = ""
+			ep.successes++
+		}
+	}
+	if index < 0 || index >= bc.active || bc.endpoints[index].successes < failbackSuccesses {
+		bc.mu.Unlock()
+		return false
+	}
+	bc.active = index
+	bc.mu.Unlock()
+
+	backendLogger.Info("Backend %s is healthy again, switching back to it", url)
+	bc.Reconnect()
+	return true
+}
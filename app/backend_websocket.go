@@ -0,0 +1,234 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	reconnectBaseDelay   = time.Second
+	maxReconnectDelay    = 2 * time.Minute
+	stableConnectionTime = 30 * time.Second // A connection that lasted this long resets the backoff
+	wsPingInterval       = 30 * time.Second
+	wsPongWait           = 75 * time.Second // Read deadline; a half-open connection is dropped after this
+	wsWriteWait          = 10 * time.Second
+)
+
+// Websocket connection states, see ConnectionState
+const (
+	ConnDisconnected = "disconnected" // Not started, or stopped
+	ConnConnecting   = "connecting"
+	ConnConnected    = "connected"
+	ConnBackoff      = "backoff" // Waiting until RetryAt before dialing again
+)
+
+// ConnectionState describes the commands websocket
+type ConnectionState struct {
+	State     string    `json:"state"`   // ConnDisconnected, ConnConnecting, ConnConnected or ConnBackoff
+	Since     time.Time `json:"since"`   // When the state was entered
+	RetryAt   time.Time `json:"retryAt"` // Next dial attempt, in ConnBackoff
+	Attempt   int       `json:"attempt"` // Consecutive failed or short-lived connections
+	LastError string    `json:"lastError"`
+}
+
+// ConnectionState returns the state of the commands websocket
+func (bc *BackendClient) ConnectionState() ConnectionState {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.conn
+}
+
+// setConnState records a state change
+func (bc *BackendClient) setConnState(state string, retryAt time.Time, attempt int, err error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.conn = ConnectionState{State: state, Since: bc.clock.Now(), RetryAt: retryAt, Attempt: attempt}
+	if err != nil {
+		bc.conn.LastError = err.Error()
+	}
+}
+
+// reconnectDelay returns the wait before reconnect attempt n (1-based):
+// doubling from reconnectBaseDelay up to maxReconnectDelay, with the upper
+// half randomized so clients do not reconnect in lockstep
+func reconnectDelay(attempt int) time.Duration {
+	delay := maxReconnectDelay
+	if attempt < 20 {
+		delay = min(reconnectBaseDelay<<(attempt-1), maxReconnectDelay)
+	}
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+// connectWebSocket keeps a websocket to the backend open for real-time
+// commands, reconnecting with backoff until ctx is cancelled
+func (bc *BackendClient) connectWebSocket(ctx context.Context) {
+	defer bc.setConnState(ConnDisconnected, time.Time{}, 0, nil)
+
+	attempt := 0
+	for ctx.Err() == nil {
+		connectedAt, err := bc.runConnection(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if !connectedAt.IsZero() && bc.clock.Now().Sub(connectedAt) >= stableConnectionTime {
+			attempt = 0
+		}
+		attempt++
+		delay := reconnectDelay(attempt)
+		backendLogger.Warn("WebSocket unavailable: %v, retrying in %v", err, delay.Round(time.Second))
+		bc.setConnState(ConnBackoff, bc.clock.Now().Add(delay), attempt, err)
+
+		timer := bc.clock.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-bc.reconnectKick:
+			timer.Stop()
+			attempt = 0
+		case <-timer.C():
+		}
+	}
+}
+
+// runConnection dials the backend and reads commands until the connection
+// fails. It returns when the connection was established (zero if dialing
+// failed) and why it ended.
+func (bc *BackendClient) runConnection(ctx context.Context) (time.Time, error) {
+	// A Reconnect request made while we were not connected is satisfied by this dial
+	select {
+	case <-bc.reconnectKick:
+	default:
+	}
+
+	bc.mu.RLock()
+	dialer := bc.dialer
+	bc.mu.RUnlock()
+
+	baseURL := bc.getBaseURL()
+	wsURL := convertHTTPToWS(baseURL) + "/api/commands"
+	backendLogger.Info("Connecting to WebSocket: %s", wsURL)
+	bc.setConnState(ConnConnecting, time.Time{}, 0, nil)
+
+	ws, resp, err := dialer.DialContext(ctx, wsURL, bc.authHeader())
+	if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+		return time.Time{}, bc.unauthorized("websocket handshake")
+	}
+	if err != nil {
+		// The next attempt, after the usual backoff, goes to the endpoint failed over to
+		if ctx.Err() == nil {
+			bc.endpointFailed(baseURL, err)
+		}
+		return time.Time{}, err
+	}
+	bc.endpointSucceeded(baseURL)
+
+	connectedAt := bc.clock.Now()
+	bc.mu.Lock()
+	bc.ws = ws
+	bc.mu.Unlock()
+	bc.setConnState(ConnConnected, time.Time{}, 0, nil)
+	backendLogger.Info("WebSocket connected")
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		bc.mu.Lock()
+		bc.ws = nil
+		bc.mu.Unlock()
+		ws.Close()
+	}()
+
+	// Closing the socket unblocks the reader when ctx is cancelled
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	// Any message or pong proves the connection is alive
+	ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go bc.keepAlive(ws, done)
+
+	bc.replayResults()
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return connectedAt, err
+		}
+		ws.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var cmd Command
+		if err := json.Unmarshal(message, &cmd); err != nil {
+			backendLogger.Warn("Ignoring malformed command: %v", err)
+			continue
+		}
+		cmd.raw = message
+
+		if cmd.Type == ResultReceived {
+			if err := bc.results.markDelivered(cmd.ID); err != nil {
+				backendLogger.Warn("Failed to save command result receipt: %v", err)
+			}
+			continue
+		}
+
+		backendLogger.Debug("Received command: %s %s", cmd.Type, cmd.ID)
+		if cmd.ID == "" {
+			backendLogger.Warn("Ignoring %s command without an ID", cmd.Type)
+			continue
+		}
+		// Only authorized commands are acknowledged; the rest get a refusal as their result
+		if err := bc.authorizeCommand(cmd); err != nil {
+			backendLogger.Warn("Refused %s command %s: %v", cmd.Type, cmd.ID, err)
+			bc.sendReport(bc.newReport(cmd, ReportResult, CommandRefused, err))
+			continue
+		}
+		if !bc.markSeen(cmd) {
+			if result, ok := bc.results.get(cmd.ID); ok {
+				backendLogger.Info("Command %s was already handled, resending its result", cmd.ID)
+				bc.sendReport(result)
+			} else {
+				backendLogger.Warn("Ignoring repeated %s command %s", cmd.Type, cmd.ID)
+			}
+			continue
+		}
+		bc.report(cmd, ReportAck, "", nil)
+		select {
+		case bc.commandsCh <- cmd:
+		case <-ctx.Done():
+			return connectedAt, ctx.Err()
+		}
+	}
+}
+
+// keepAlive pings the backend until done is closed
+func (bc *BackendClient) keepAlive(ws *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// WriteControl may be used alongside the writes in sendReport
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				backendLogger.Debug("WebSocket ping failed: %v", err)
+				ws.Close()
+				return
+			}
+		}
+	}
+}
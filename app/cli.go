@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/votanchat/cloudflared-desktop-tunnel/mockbackend"
+)
+
+// RunCommand runs a command-line subcommand such as "export" or "import"
+// against the active profile's config.json, or "mock-backend". It reports
+// false if args do not start with a subcommand, in which case the GUI should
+// start instead.
+func RunCommand(args []string, stdout io.Writer) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	switch args[0] {
+	case "export":
+		return true, runExport(args[1:], stdout)
+	case "import":
+		return true, runImport(args[1:], stdout)
+	case "mock-backend":
+		return true, runMockBackend(args[1:], stdout)
+	default:
+		return false, nil
+	}
+}
+
+// runExport implements `export [-format bundle|cloudflared] [-o file]`
+func runExport(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	format := fs.String("format", ConfigFormatBundle, "bundle or cloudflared")
+	output := fs.String("o", "", "write to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	data, err := exportConfig(config, *format)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = stdout.Write(data)
+		return err
+	}
+	return writeFileAtomic(*output, data, 0644)
+}
+
+// runImport implements `import [-mode merge|replace] [-dry-run] [-confirm-backend] <file|->`
+func runImport(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	mode := fs.String("mode", ImportMerge, "merge or replace")
+	dryRun := fs.Bool("dry-run", false, "show the changes without saving them")
+	confirmBackend := fs.Bool("confirm-backend", false, "allow the import to change the backend URL")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import [-mode merge|replace] [-dry-run] [-confirm-backend] <file|->")
+	}
+
+	var data []byte
+	var err error
+	if fs.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read import file: %w", err)
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	preview, next, err := previewConfigImport(config, data, *mode)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(stdout, preview)
+
+	if len(preview.Errors) > 0 {
+		return fmt.Errorf("import would make the config invalid; nothing was saved")
+	}
+	if *dryRun {
+		return nil
+	}
+	if len(preview.NewBackendURLs) > 0 && !*confirmBackend {
+		return fmt.Errorf("%w (use -confirm-backend); nothing was saved", errBackendNotConfirmed)
+	}
+	// A running app picks the change up through its config watcher
+	if err := next.Save(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	fmt.Fprintln(stdout, "Saved.")
+	return nil
+}
+
+// runMockBackend implements `mock-backend [-addr host:port] [-token t]
+// [-expires d] [-key file] [-script file] [-require-enrollment]
+// [-delay d] [-error-rate f] [-drop-after d]`: a local backend to point
+// backendURL at during development
+func runMockBackend(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("mock-backend", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	addr := fs.String("addr", "127.0.0.1:8081", "address to listen on")
+	token := fs.String("token", "", "tunnel token to serve (default: a random one)")
+	expires := fs.Duration("expires", mockbackend.DefaultTokenLifetime, "token lifetime (0 = no expiry)")
+	keyPath := fs.String("key", "", "file with the base64 Ed25519 private key or seed commands are signed with (default: a new key)")
+	scriptPath := fs.String("script", "", "JSON file of commands to push, see mockbackend.LoadScript")
+	requireEnrollment := fs.Bool("require-enrollment", false, "answer 401 to devices without an enrollment credential")
+	delay := fs.Duration("delay", 0, "delay every HTTP response by this long")
+	errorRate := fs.Float64("error-rate", 0, "fraction of HTTP requests answered with a 500")
+	dropAfter := fs.Duration("drop-after", 0, "drop each websocket this long after it connects")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	server := mockbackend.New()
+	server.Logf = func(format string, args ...interface{}) {
+		fmt.Fprintf(stdout, time.Now().Format("15:04:05 ")+format+"\n", args...)
+	}
+	if *token != "" {
+		server.SetToken(*token, *expires)
+	} else {
+		server.SetToken(server.Token(), *expires)
+	}
+	server.RequireEnrollment(*requireEnrollment)
+	server.SetFaults(mockbackend.Faults{Delay: *delay, ErrorRate: *errorRate, DropSocketsAfter: *dropAfter})
+
+	key, err := loadSigningKey(*keyPath)
+	if err != nil {
+		return err
+	}
+	server.SetSigningKey(key)
+
+	var steps []mockbackend.ScriptStep
+	if *scriptPath != "" {
+		if steps, err = mockbackend.LoadScript(*scriptPath); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Fprintf(stdout, "Mock backend listening on http://%s\n", *addr)
+	fmt.Fprintf(stdout, "Command public key: %s\n", server.PublicKey())
+	fmt.Fprintf(stdout, "Tunnel token: %s\n", server.Token())
+	if len(steps) > 0 {
+		go func() {
+			if err := server.RunScript(ctx, steps); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(stdout, "Script stopped: %v\n", err)
+			}
+		}()
+	}
+	return server.ListenAndServe(ctx, *addr)
+}
+
+// loadSigningKey reads a base64 Ed25519 private key or seed, or makes a new key if path is ""
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		_, key, err := ed25519.GenerateKey(nil)
+		return key, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("signing key is not valid base64: %w", err)
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	default:
+		return nil, fmt.Errorf("signing key must be a %d-byte seed or %d-byte private key, got %d bytes",
+			ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+	}
+}
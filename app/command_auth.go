@@ -0,0 +1,115 @@
+package app
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	maxCommandLifetime  = time.Hour       // Longest a signed command may stay valid
+	maxCommandClockSkew = 5 * time.Minute // How far in the future issuedAt may be
+)
+
+// commandTypes are the backend commands the app implements; users consent to
+// each one in Config.AllowedCommands
+var commandTypes = []string{"restart", "update", "patch"}
+
+// parseCommandPublicKey decodes a base64 Ed25519 public key
+func parseCommandPublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("not valid base64: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("an Ed25519 public key is %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// canonicalCommand returns the bytes a command signature covers: the command
+// object as received minus its "signature" field, with object keys sorted,
+// no whitespace, numbers as sent and strings without HTML escaping
+func canonicalCommand(raw []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "signature")
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(fields); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// authorizeCommand checks that cmd is signed by the pinned backend key, is
+// addressed to this device, carries a bounded validity window and is of a
+// type the user allows. Commands past their deadline are left to the caller
+// to report as expired.
+func authorizeCommand(cmd Command, publicKey ed25519.PublicKey, allowed []string, deviceID string, now time.Time) error {
+	if publicKey == nil {
+		return fmt.Errorf("no backend command key is configured")
+	}
+	if cmd.Signature == "" {
+		return fmt.Errorf("command is not signed")
+	}
+	signature, err := base64.StdEncoding.DecodeString(cmd.Signature)
+	if err != nil {
+		return fmt.Errorf("signature is not valid base64: %w", err)
+	}
+	message, err := canonicalCommand(cmd.raw)
+	if err != nil {
+		return fmt.Errorf("failed to canonicalize command: %w", err)
+	}
+	if !ed25519.Verify(publicKey, message, signature) {
+		return fmt.Errorf("signature does not match the configured backend key")
+	}
+
+	// A signed command must not be replayable to other devices or indefinitely
+	if deviceID == "" {
+		return fmt.Errorf("this device has no ID yet")
+	}
+	if cmd.DeviceID != deviceID {
+		return fmt.Errorf("command is addressed to device %q, not this one", cmd.DeviceID)
+	}
+	if cmd.IssuedAt.IsZero() || cmd.Deadline.IsZero() {
+		return fmt.Errorf("command must carry issuedAt and deadline")
+	}
+	if cmd.IssuedAt.After(now.Add(maxCommandClockSkew)) {
+		return fmt.Errorf("command was issued in the future (%v)", cmd.IssuedAt)
+	}
+	if !cmd.Deadline.After(cmd.IssuedAt) || cmd.Deadline.Sub(cmd.IssuedAt) > maxCommandLifetime {
+		return fmt.Errorf("command deadline must be within %v of issuedAt", maxCommandLifetime)
+	}
+
+	if !slices.Contains(allowed, cmd.Type) {
+		return fmt.Errorf("%s commands are not allowed on this device", cmd.Type)
+	}
+	return nil
+}
+
+// applyCommandPolicy passes the pinned key and allowlist to the backend client
+func (a *App) applyCommandPolicy() error {
+	config := a.currentConfig()
+	var publicKey ed25519.PublicKey
+	if config.CommandPublicKey != "" {
+		var err error
+		if publicKey, err = parseCommandPublicKey(config.CommandPublicKey); err != nil {
+			a.backendClient.SetCommandPolicy(nil, nil)
+			return err
+		}
+	}
+	a.backendClient.SetCommandPolicy(publicKey, config.AllowedCommands)
+	return nil
+}
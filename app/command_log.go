@@ -0,0 +1,154 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	commandLogFileName = "command_results.json"
+	maxCommandResults  = 50 // Results kept for duplicate detection and replay
+)
+
+// Report types sent back to the backend on the commands websocket
+const (
+	ReportAck        = "ack"         // The command was received
+	ReportInProgress = "in_progress" // Its handler started
+	ReportResult     = "result"      // It finished, see CommandReport.Status
+)
+
+// ResultReceived is the type of the message the backend sends on the commands
+// websocket, with the command's ID, once it has stored a result. Results are
+// replayed after a reconnect until it arrives.
+const ResultReceived = "result_received"
+
+// Command outcomes in a result report
+const (
+	CommandSucceeded = "succeeded"
+	CommandFailed    = "failed"
+	CommandExpired   = "expired"  // Arrived after its deadline and was not run
+	CommandRejected  = "rejected" // Not runnable, e.g. an unknown type
+	CommandRefused   = "refused"  // Not signed by the pinned key or not allowed by the user
+)
+
+// CommandReport tells the backend how a command is getting on
+type CommandReport struct {
+	Type        string    `json:"type"` // ReportAck, ReportInProgress or ReportResult
+	CommandID   string    `json:"commandId"`
+	CommandType string    `json:"commandType"`
+	Status      string    `json:"status,omitempty"` // Result reports only
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// initCommandLog keeps command results in the app config directory
+func (a *App) initCommandLog() error {
+	appConfigDir, err := getAppConfigDir()
+	if err != nil {
+		return err
+	}
+	return a.backendClient.SetCommandLogPath(filepath.Join(appConfigDir, commandLogFileName))
+}
+
+// commandLog remembers the results of the last commands, so a duplicate is
+// answered with the original result instead of running again, and results
+// the backend has not confirmed can be replayed after a reconnect
+type commandLog struct {
+	mu      sync.Mutex
+	path    string // "" = memory only
+	results []loggedResult
+}
+
+// loggedResult is a result as kept in the log
+type loggedResult struct {
+	CommandReport
+	Delivered bool `json:"delivered"` // The backend sent ResultReceived for it
+}
+
+// load reads the results saved at path and saves to it from then on
+func (l *commandLog) load(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read command results: %w", err)
+	}
+	var results []loggedResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return fmt.Errorf("failed to parse command results: %w", err)
+	}
+	l.results = results
+	return nil
+}
+
+// get returns the result recorded for a command ID
+func (l *commandLog) get(id string) (CommandReport, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, result := range l.results {
+		if result.CommandID == id {
+			return result.CommandReport, true
+		}
+	}
+	return CommandReport{}, false
+}
+
+// record adds a result, dropping the oldest beyond maxCommandResults, and saves the log
+func (l *commandLog) record(result CommandReport) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.results = append(l.results, loggedResult{CommandReport: result})
+	if len(l.results) > maxCommandResults {
+		l.results = append([]loggedResult(nil), l.results[len(l.results)-maxCommandResults:]...)
+	}
+	return l.save()
+}
+
+// markDelivered records that the backend has the result for a command ID
+func (l *commandLog) markDelivered(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.results {
+		if l.results[i].CommandID == id && !l.results[i].Delivered {
+			l.results[i].Delivered = true
+			return l.save()
+		}
+	}
+	return nil
+}
+
+// undelivered returns the results the backend has not confirmed, oldest first
+func (l *commandLog) undelivered() []CommandReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var results []CommandReport
+	for _, result := range l.results {
+		if !result.Delivered {
+			results = append(results, result.CommandReport)
+		}
+	}
+	return results
+}
+
+// save writes the log to disk. Callers hold l.mu.
+func (l *commandLog) save() error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(l.results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.path, data, 0600)
+}
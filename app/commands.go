@@ -0,0 +1,136 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CommandHandler executes one type of backend command
+type CommandHandler func(cmd Command) error
+
+// Settings a "patch" command may not change: they point at files, secrets or
+// bookkeeping on this machine
+var unpatchableSettings = map[string]bool{
+	"schemaVersion":       true,
+	"provenance":          true,
+	"caBundlePath":        true,
+	"secretStore":         true,
+	"manualTokenRef":      true,
+	"deviceId":            true,
+	"deviceCredentialRef": true,
+	"lastTokenRef":        true,
+	"tokenSource":         true, // A command source would let the backend run shell commands
+
+	// The backend must not widen its own permissions
+	"commandPublicKey": true,
+	"allowedCommands":  true,
+}
+
+// registerCommandHandlers wires the backend commands to the app
+func (a *App) registerCommandHandlers() {
+	a.backendClient.SetCommandHandler("restart", a.handleRestartCommand)
+	a.backendClient.SetCommandHandler("update", a.handleUpdateCommand)
+	a.backendClient.SetCommandHandler("patch", a.handlePatchCommand)
+}
+
+// handleRestartCommand restarts a running tunnel. A tunnel the user stopped stays stopped.
+func (a *App) handleRestartCommand(cmd Command) error {
+	if !a.tunnel.IsRunning() {
+		return fmt.Errorf("tunnel is not running")
+	}
+	return a.tunnel.Restart()
+}
+
+// handleUpdateCommand installs the cloudflared version in the payload:
+//
+//	{"version": "2024.8.2", "apply": true}
+//
+// "version" may be "latest". With "apply" a running tunnel is restarted onto
+// it right away; otherwise it is used from the next tunnel start.
+func (a *App) handleUpdateCommand(cmd Command) error {
+	version, _ := cmd.Payload["version"].(string)
+	if version == "" {
+		return fmt.Errorf("payload.version is required")
+	}
+	apply, _ := cmd.Payload["apply"].(bool)
+
+	_, err := a.updater.InstallVersion(version, apply)
+	return err
+}
+
+// handlePatchCommand merges the payload into the settings, then validates,
+// saves and applies them like a change made in Settings:
+//
+//	{"refreshInterval": 600, "routes": [{"hostname": "app.example.com", "service": "http://localhost:3000"}]}
+//
+// Objects such as "proxy" are merged key by key; any other value, including
+// an array, replaces the current one.
+func (a *App) handlePatchCommand(cmd Command) error {
+	if len(cmd.Payload) == 0 {
+		return fmt.Errorf("payload is empty")
+	}
+	next, err := patchConfig(a.currentConfig(), cmd.Payload)
+	if err != nil {
+		return err
+	}
+
+	result, err := a.UpdateConfig(next)
+	if err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("settings saved but not fully applied: %s", strings.Join(result.Errors, "; "))
+	}
+	if result.TunnelRestartPending {
+		appLogger.Info("Patched settings take effect on the next tunnel restart")
+	}
+	return nil
+}
+
+// patchConfig returns a copy of current with patch merged into it
+func patchConfig(current *Config, patch map[string]interface{}) (*Config, error) {
+	var refused []string
+	for key := range patch {
+		if unpatchableSettings[key] {
+			refused = append(refused, key)
+		}
+	}
+	if len(refused) > 0 {
+		sort.Strings(refused)
+		return nil, fmt.Errorf("settings cannot be changed remotely: %s", strings.Join(refused, ", "))
+	}
+
+	merged, err := configToMap(current)
+	if err != nil {
+		return nil, err
+	}
+	mergePatch(merged, patch)
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	next := current.Clone()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(next); err != nil {
+		return nil, fmt.Errorf("invalid patch: %w", err)
+	}
+	return next, nil
+}
+
+// mergePatch merges patch into dst, recursing into objects present in both
+func mergePatch(dst, patch map[string]interface{}) {
+	for key, value := range patch {
+		patchObj, ok := value.(map[string]interface{})
+		dstObj, dstOK := dst[key].(map[string]interface{})
+		if ok && dstOK {
+			mergePatch(dstObj, patchObj)
+			continue
+		}
+		dst[key] = value
+	}
+}
@@ -1,9 +1,14 @@
 package app
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+
+	"github.com/votanchat/cloudflared-desktop-tunnel/network"
 )
 
 // Route represents a tunnel route configuration
@@ -12,20 +17,82 @@ type Route struct {
 	Service  string `json:"service"`  // e.g., "http://localhost:3000"
 }
 
+// ProxyConfig represents outbound proxy settings. When all fields are empty
+// the standard HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables apply.
+type ProxyConfig struct {
+	HTTPProxy   string   `json:"httpProxy"`   // e.g., "http://proxy.corp:3128"
+	HTTPSProxy  string   `json:"httpsProxy"`  // e.g., "http://proxy.corp:3128"
+	SOCKS5Proxy string   `json:"socks5Proxy"` // e.g., "socks5://127.0.0.1:1080", overrides the HTTP(S) proxies
+	NoProxy     []string `json:"noProxy"`     // e.g., ["localhost", ".corp.example.com", "10.0.0.0/8"]
+}
+
+// TokenSourceConfig selects where the tunnel token comes from, see token_providers.go
+type TokenSourceConfig struct {
+	Type        string `json:"type"`        // TokenSourceBackend, TokenSourceStatic, TokenSourceFile, TokenSourceCommand, TokenSourceEnv or TokenSourceCloudflare
+	Path        string `json:"path"`        // File holding the token (file)
+	Command     string `json:"command"`     // Shell command printing the token (command)
+	EnvVar      string `json:"envVar"`      // Variable holding the token (env)
+	AccountID   string `json:"accountId"`   // Cloudflare account of the tunnel (cloudflare)
+	TunnelID    string `json:"tunnelId"`    // Tunnel whose token is looked up (cloudflare)
+	APITokenRef string `json:"apiTokenRef"` // Saved Cloudflare API token, e.g. "keyring:default/cloudflare-api-token"
+}
+
 // Config represents the application configuration
 type Config struct {
+	SchemaVersion int `json:"schemaVersion"` // Bumped by config migrations, see config_migrations.go
+
 	BackendURL      string  `json:"backendURL"`
 	TunnelName      string  `json:"tunnelName"`
 	AutoStart       bool    `json:"autoStart"`
 	MinimizeToTray  bool    `json:"minimizeToTray"`
 	RefreshInterval int     `json:"refreshInterval"` // in seconds
-	WebServerPort   int     `json:"webServerPort"`   // Web server port (0 = random, >0 = fixed)
+	WebServerPort   int     `json:"webServerPort"`   // Web server port (0 = default 8080, >0 = fixed)
 	Routes          []Route `json:"routes"`          // Domain routes for tunnel
+
+	FallbackBackendURLs []string `json:"fallbackBackendURLs"` // Tried in order when BackendURL is down
+	CacheLastToken      bool     `json:"cacheLastToken"`      // Keep the last backend token to start the tunnel during an outage
+	LastTokenRef        string   `json:"lastTokenRef"`        // Cached token, e.g. "keyring:default/last-token"
+
+	UpdateCheckInterval     int  `json:"updateCheckInterval"`     // cloudflared update check interval in seconds (0 = default)
+	ApplyUpdatesImmediately bool `json:"applyUpdatesImmediately"` // Restart a running tunnel as soon as an update is staged
+	CacheKeepVersions       int  `json:"cacheKeepVersions"`       // Previous cloudflared versions kept for rollback
+	CacheMaxSizeMB          int  `json:"cacheMaxSizeMB"`          // Binary cache size limit in MB (0 = unlimited)
+
+	Proxy        ProxyConfig `json:"proxy"`        // Proxy for backend, GitHub and websocket traffic
+	CABundlePath string      `json:"caBundlePath"` // Extra PEM root CAs trusted for outbound TLS
+
+	TokenSource   TokenSourceConfig `json:"tokenSource"`   // Where the tunnel token comes from
+	TokenRotation string            `json:"tokenRotation"` // How a rotated backend token reaches a running tunnel: "seamless", "restart" or "manual"
+
+	// Secrets never live in this file; it only holds references into a secret store
+	SecretStore    string `json:"secretStore"`    // Where new secrets go: "keyring", "file" or "" for the keyring if available
+	ManualTokenRef string `json:"manualTokenRef"` // Saved manual tunnel token, e.g. "keyring:default/manual-token"
+
+	// Enrollment with the backend, see device.go
+	DeviceID            string `json:"deviceId"`            // Generated on first run
+	DeviceCredentialRef string `json:"deviceCredentialRef"` // Credential issued at enrollment, e.g. "keyring:default/device-credential"
+
+	// Backend commands run only if signed with this key and listed in AllowedCommands
+	CommandPublicKey string   `json:"commandPublicKey"` // Base64 Ed25519 public key of the backend
+	AllowedCommands  []string `json:"allowedCommands"`  // Command types the user consented to, e.g. ["restart"]
+
+	// Provenance maps each setting to the layer its value came from
+	// (SourceDefault, SourceFile, SourceEnv or SourceFlag). Only filled in on
+	// the copy returned by GetConfig; never saved.
+	Provenance map[string]string `json:"provenance,omitempty"`
+
+	readOnly      bool                      // Set when the file on disk must not be overwritten
+	path          string                    // File this config was loaded from ("" = default location)
+	recoveredFrom string                    // Backup used because the file was corrupt
+	loadWarnings  []FieldError              // Invalid fields reset to defaults while loading
+	fileKeys      map[string]bool           // Settings present in the file, see provenance
+	overrides     map[string]configOverride // Env and flag values layered over the file, see config_layers.go
 }
 
 // DefaultConfig returns a default configuration
 func DefaultConfig() *Config {
 	return &Config{
+		SchemaVersion:   CurrentConfigSchemaVersion,
 		BackendURL:      "https://api.example.com",
 		TunnelName:      "my-tunnel",
 		AutoStart:       false,
@@ -33,6 +100,35 @@ func DefaultConfig() *Config {
 		RefreshInterval: 300,       // 5 minutes
 		WebServerPort:   8080,      // Fixed port 8080 by default
 		Routes:          []Route{}, // Empty routes by default
+
+		FallbackBackendURLs: []string{},
+		CacheLastToken:      false,
+
+		UpdateCheckInterval:     6 * 60 * 60, // 6 hours
+		ApplyUpdatesImmediately: false,
+		CacheKeepVersions:       2,
+		CacheMaxSizeMB:          300,
+
+		TokenSource:   TokenSourceConfig{Type: TokenSourceBackend},
+		TokenRotation: TokenRotationSeamless,
+
+		AllowedCommands: []string{},
+	}
+}
+
+// BackendURLs returns the backend endpoints in order of preference
+func (c *Config) BackendURLs() []string {
+	return append([]string{c.BackendURL}, c.FallbackBackendURLs...)
+}
+
+// NetworkOptions returns the proxy and CA settings in the form used by the network package
+func (c *Config) NetworkOptions() network.Options {
+	return network.Options{
+		HTTPProxy:    c.Proxy.HTTPProxy,
+		HTTPSProxy:   c.Proxy.HTTPSProxy,
+		SOCKS5Proxy:  c.Proxy.SOCKS5Proxy,
+		NoProxy:      c.Proxy.NoProxy,
+		CABundlePath: c.CABundlePath,
 	}
 }
 
@@ -74,8 +170,8 @@ func (c *Config) GetRoute(hostname string) *Route {
 	return nil
 }
 
-// getConfigPath returns the path to the config file
-func getConfigPath() (string, error) {
+// getAppConfigDir returns the app's config directory, creating it if needed
+func getAppConfigDir() (string, error) {
 	// Get user config directory
 	configDir, err := os.UserConfigDir()
 	if err != nil {
@@ -88,19 +184,33 @@ func getConfigPath() (string, error) {
 		return "", err
 	}
 
-	return filepath.Join(appConfigDir, "config.json"), nil
+	return appConfigDir, nil
 }
 
+// getConfigPath returns the path to the config file of the active profile
+func getConfigPath() (string, error) {
+	return profileConfigPath(activeProfileName())
+}
+
+// configBackupCount is how many previous versions of config.json are kept as config.json.1..N
+const configBackupCount = 5
+
 // LoadConfig loads configuration from file
 func LoadConfig() (*Config, error) {
 	configPath, err := getConfigPath()
 	if err != nil {
 		return nil, err
 	}
+	return loadConfigFile(configPath)
+}
 
+// loadConfigFile loads, migrates and if necessary recovers the config at configPath
+func loadConfigFile(configPath string) (*Config, error) {
 	// If config doesn't exist, return default
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		return DefaultConfig(), nil
+		config := DefaultConfig()
+		config.path = configPath
+		return config, nil
 	}
 
 	// Read config file
@@ -109,28 +219,183 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 
-	// Parse JSON
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
+	// Parse JSON, upgrading older schemas
+	config, fromVersion, err := parseConfig(data)
+	if errors.Is(err, ErrConfigTooNew) {
 		return nil, err
 	}
+	if err != nil {
+		appLogger.Error("Config file is corrupt: %v", err)
+		return recoverConfig(configPath, data, err)
+	}
+	config.path = configPath
+	config.checkLoaded()
 
-	return &config, nil
+	if fromVersion < CurrentConfigSchemaVersion {
+		appLogger.Info("Migrating config from schema v%d to v%d", fromVersion, CurrentConfigSchemaVersion)
+		if err := backupConfigBeforeMigration(configPath, data, fromVersion); err != nil {
+			return nil, err
+		}
+		if err := config.Save(); err != nil {
+			return nil, fmt.Errorf("failed to save migrated config: %w", err)
+		}
+	}
+
+	return config, nil
+}
+
+// recoverConfig preserves a corrupt config file and loads the newest backup that parses
+func recoverConfig(configPath string, corrupt []byte, parseErr error) (*Config, error) {
+	corruptPath := configPath + ".corrupt"
+	if err := os.WriteFile(corruptPath, corrupt, 0600); err != nil {
+		appLogger.Warn("Failed to preserve corrupt config: %v", err)
+	}
+
+	for i := 1; i <= configBackupCount; i++ {
+		backupPath := fmt.Sprintf("%s.%d", configPath, i)
+		data, err := os.ReadFile(backupPath)
+		if err != nil {
+			continue
+		}
+
+		config, _, err := parseConfig(data)
+		if err != nil {
+			appLogger.Warn("Backup %s is not usable: %v", backupPath, err)
+			continue
+		}
+
+		appLogger.Warn("Recovered config from backup %s", backupPath)
+		config.path = configPath
+		config.recoveredFrom = backupPath
+		config.checkLoaded()
+		return config, nil
+	}
+
+	return nil, fmt.Errorf("config file is corrupt and no valid backup was found (kept as %s): %w", corruptPath, parseErr)
+}
+
+// checkLoaded validates a freshly loaded config and resets invalid fields to
+// their defaults so the app can still start
+func (c *Config) checkLoaded() {
+	var verr *ValidationError
+	if !errors.As(c.Validate(), &verr) {
+		return
+	}
+	appLogger.Warn("Loaded config has invalid settings, using defaults for them: %v", verr)
+	c.loadWarnings = verr.Errors
+	c.resetInvalidFields(verr)
+}
+
+// LoadWarnings returns the invalid fields that were reset to defaults while loading
+func (c *Config) LoadWarnings() []FieldError {
+	return c.loadWarnings
+}
+
+// Clone returns a deep copy of the config
+func (c *Config) Clone() *Config {
+	clone := *c
+	clone.Routes = append([]Route(nil), c.Routes...)
+	clone.Proxy.NoProxy = append([]string(nil), c.Proxy.NoProxy...)
+	clone.FallbackBackendURLs = append([]string(nil), c.FallbackBackendURLs...)
+	clone.AllowedCommands = append([]string(nil), c.AllowedCommands...)
+	clone.loadWarnings = nil
+	clone.Provenance = nil
+	if c.overrides != nil {
+		clone.overrides = make(map[string]configOverride, len(c.overrides))
+		for name, o := range c.overrides {
+			clone.overrides[name] = o
+		}
+	}
+	return &clone
+}
+
+// RecoveredFrom returns the backup file this config was loaded from because
+// config.json was corrupt, or "" if it loaded normally
+func (c *Config) RecoveredFrom() string {
+	return c.recoveredFrom
 }
 
 // Save saves the configuration to file
 func (c *Config) Save() error {
-	configPath, err := getConfigPath()
+	if c.readOnly {
+		return fmt.Errorf("config is read-only because it was written by a newer version of the app")
+	}
+
+	configPath, err := c.filePath()
 	if err != nil {
 		return err
 	}
 
-	// Marshal to JSON
-	data, err := json.MarshalIndent(c, "", "  ")
+	c.SchemaVersion = CurrentConfigSchemaVersion
+
+	// Marshal to JSON, leaving out env and flag overrides
+	data, err := json.MarshalIndent(c.fileView(), "", "  ")
 	if err != nil {
 		return err
 	}
+	c.fileKeys = jsonKeys(data)
+
+	if err := rotateConfigBackups(configPath, data); err != nil {
+		appLogger.Warn("Failed to rotate config backups: %v", err)
+	}
+
+	// Write to a temp file and rename so a crash never leaves a half-written config
+	return writeFileAtomic(configPath, data, 0600)
+}
+
+// inheritFileState copies what ties a config to its file, and the overrides
+// still in effect, from the config it replaces
+func (c *Config) inheritFileState(from *Config) {
+	c.readOnly = from.readOnly
+	c.path = from.path
+	c.fileKeys = from.fileKeys
+	c.Provenance = nil
+	c.overrides = from.Clone().overrides
+	c.dropChangedOverrides()
+}
+
+// jsonKeys returns the top-level keys of a JSON object
+func jsonKeys(data []byte) map[string]bool {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil
+	}
+	keys := make(map[string]bool, len(raw))
+	for key := range raw {
+		keys[key] = true
+	}
+	return keys
+}
+
+// filePath returns the file this config is loaded from and saved to
+func (c *Config) filePath() (string, error) {
+	if c.path != "" {
+		return c.path, nil
+	}
+	return getConfigPath()
+}
+
+// rotateConfigBackups shifts config.json.1..N-1 up by one and copies the
+// current file to config.json.1, unless it already matches data
+func rotateConfigBackups(configPath string, data []byte) error {
+	current, err := os.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if bytes.Equal(current, data) {
+		return nil
+	}
+
+	for i := configBackupCount - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", configPath, i)
+		to := fmt.Sprintf("%s.%d", configPath, i+1)
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 
-	// Write to file
-	return os.WriteFile(configPath, data, 0644)
+	return writeFileAtomic(configPath+".1", current, 0600)
 }
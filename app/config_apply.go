@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// ConfigDiff lists which groups of settings differ between two configs
+type ConfigDiff struct {
+	BackendURL    bool `json:"backendURL"` // Primary or fallback endpoints
+	TunnelName    bool `json:"tunnelName"`
+	Routes        bool `json:"routes"`
+	WebServerPort bool `json:"webServerPort"`
+	Network       bool `json:"network"`  // Proxy or CA bundle
+	Updates       bool `json:"updates"`  // Update checker settings
+	Refresh       bool `json:"refresh"`  // Token refresh interval
+	Commands      bool `json:"commands"` // Backend command key or allowlist
+	Device        bool `json:"device"`   // Device ID or enrollment credential
+}
+
+// diffConfig compares the settings that live subsystems depend on
+func diffConfig(old, new *Config) ConfigDiff {
+	return ConfigDiff{
+		BackendURL:    !reflect.DeepEqual(old.BackendURLs(), new.BackendURLs()),
+		TunnelName:    old.TunnelName != new.TunnelName,
+		Routes:        !reflect.DeepEqual(old.Routes, new.Routes),
+		WebServerPort: old.WebServerPort != new.WebServerPort,
+		Network:       !reflect.DeepEqual(old.NetworkOptions(), new.NetworkOptions()),
+		Updates: old.UpdateCheckInterval != new.UpdateCheckInterval ||
+			old.ApplyUpdatesImmediately != new.ApplyUpdatesImmediately,
+		Refresh: old.RefreshInterval != new.RefreshInterval,
+		Commands: old.CommandPublicKey != new.CommandPublicKey ||
+			!reflect.DeepEqual(old.AllowedCommands, new.AllowedCommands),
+		Device: old.DeviceID != new.DeviceID || old.DeviceCredentialRef != new.DeviceCredentialRef,
+	}
+}
+
+// ConfigApplyResult reports what UpdateConfig changed at runtime
+type ConfigApplyResult struct {
+	Diff                 ConfigDiff `json:"diff"`
+	TunnelRestartPending bool       `json:"tunnelRestartPending"` // Call RestartTunnel to apply tunnel changes
+	Errors               []string   `json:"errors"`               // Subsystems that failed to pick up the change
+}
+
+// applyConfigChanges pushes the differences between old and the current
+// config to the running subsystems. A running tunnel is never restarted here;
+// the result asks the caller to confirm that instead.
+func (a *App) applyConfigChanges(old *Config) *ConfigApplyResult {
+	config := a.currentConfig()
+	diff := diffConfig(old, config)
+	result := &ConfigApplyResult{Diff: diff, Errors: []string{}}
+
+	// Every subsystem follows the new config object from now on
+	a.tunnel.SetConfig(config)
+
+	if diff.Network {
+		if err := a.applyNetworkConfig(); err != nil {
+			appLogger.Error("Failed to apply proxy/CA settings: %v", err)
+			result.Errors = append(result.Errors, "network: "+err.Error())
+		}
+	}
+
+	if diff.BackendURL || diff.Network {
+		appLogger.Info("Backend settings changed, reconnecting to %s", config.BackendURL)
+		a.backendClient.SetEndpoints(config.BackendURLs())
+		a.backendClient.Reconnect()
+		go func() {
+			if _, err := a.backendClient.FetchToken(context.Background()); err != nil {
+				appLogger.Warn("Failed to fetch token from new backend: %v", err)
+			}
+		}()
+	}
+
+	if old.CacheLastToken && !config.CacheLastToken {
+		go a.forgetCachedToken()
+	}
+
+	if diff.WebServerPort && a.webServer.IsRunning() {
+		port := a.getWebServerPort()
+		appLogger.Info("Web server port changed, rebinding to %d", port)
+		if err := a.webServer.Restart(port); err != nil {
+			appLogger.Error("Failed to rebind web server: %v", err)
+			result.Errors = append(result.Errors, "web server: "+err.Error())
+		}
+	}
+
+	if diff.Refresh {
+		a.backendClient.SetRefreshInterval(time.Duration(config.RefreshInterval) * time.Second)
+	}
+
+	if diff.Device {
+		a.loadDeviceCredential()
+	}
+
+	if diff.Commands {
+		if err := a.applyCommandPolicy(); err != nil {
+			result.Errors = append(result.Errors, "commands: "+err.Error())
+		}
+	}
+
+	if diff.Updates {
+		a.updater.SetInterval(time.Duration(config.UpdateCheckInterval) * time.Second)
+		a.updater.SetApplyImmediately(config.ApplyUpdatesImmediately)
+	}
+
+	if diff.TunnelName || diff.Routes {
+		a.tunnel.SetTunnelName(config.TunnelName)
+		result.TunnelRestartPending = a.tunnel.IsRunning()
+	}
+
+	return result
+}
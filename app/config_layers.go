@@ -0,0 +1,260 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Sources a config value can come from, lowest precedence first
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// overridableField is a setting that can be overridden without editing config.json
+type overridableField struct {
+	Field string // JSON name of the Config field
+	Env   string // Environment variable
+	Flag  string // Command-line flag, without dashes
+}
+
+var overridableFields = []overridableField{
+	{Field: "backendURL", Env: "CFDT_BACKEND_URL", Flag: "backend-url"},
+	{Field: "tunnelName", Env: "CFDT_TUNNEL_NAME", Flag: "tunnel-name"},
+	{Field: "webServerPort", Env: "CFDT_WEB_SERVER_PORT", Flag: "web-server-port"},
+	{Field: "autoStart", Env: "CFDT_AUTO_START", Flag: "auto-start"},
+}
+
+// ConfigOverride is a setting taken from the environment or the command line
+type ConfigOverride struct {
+	Field  string // JSON name of the Config field
+	Source string // SourceEnv or SourceFlag
+	Name   string // Variable or flag the value came from, for messages
+	Value  string // Raw value
+}
+
+// configOverride is an override applied to a Config, together with the value
+// it replaced so Save can write that instead
+type configOverride struct {
+	ConfigOverride
+	value     interface{} // Parsed override value
+	fileValue interface{} // Value from the file or defaults
+}
+
+// CollectConfigOverrides returns the CFDT_* environment overrides followed by
+// the command-line overrides in args, so that flags take precedence.
+// Arguments that are not config flags are ignored.
+func CollectConfigOverrides(args []string) ([]ConfigOverride, error) {
+	var overrides []ConfigOverride
+	for _, f := range overridableFields {
+		if value, ok := os.LookupEnv(f.Env); ok {
+			overrides = append(overrides, ConfigOverride{Field: f.Field, Source: SourceEnv, Name: f.Env, Value: value})
+		}
+	}
+
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		f, ok := findOverridableFlag(name)
+		if !ok {
+			continue
+		}
+
+		if !hasValue {
+			switch {
+			case f.Field == "autoStart":
+				// A bare boolean flag means true
+				value = "true"
+			case i+1 < len(args):
+				i++
+				value = args[i]
+			default:
+				return nil, fmt.Errorf("flag --%s needs a value", f.Flag)
+			}
+		}
+		overrides = append(overrides, ConfigOverride{Field: f.Field, Source: SourceFlag, Name: "--" + f.Flag, Value: value})
+	}
+
+	return overrides, nil
+}
+
+// findOverridableFlag looks up a config flag by name
+func findOverridableFlag(name string) (overridableField, bool) {
+	for _, f := range overridableFields {
+		if f.Flag == name {
+			return f, true
+		}
+	}
+	return overridableField{}, false
+}
+
+// applyOverrides layers overrides on top of the loaded settings, later
+// entries winning. Overrides with unusable values are skipped and returned as
+// errors; the file value stays in effect for those fields.
+func (c *Config) applyOverrides(overrides []ConfigOverride) []error {
+	var errs []error
+	for _, o := range overrides {
+		field, ok := configField(c, o.Field)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", o.Name, o.Field))
+			continue
+		}
+		value, err := parseOverrideValue(o.Value, field.Type())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", o.Name, err))
+			continue
+		}
+
+		applied := configOverride{ConfigOverride: o, value: value, fileValue: field.Interface()}
+		if previous, ok := c.overrides[o.Field]; ok {
+			applied.fileValue = previous.fileValue
+		}
+		field.Set(reflect.ValueOf(value))
+		if c.overrides == nil {
+			c.overrides = make(map[string]configOverride)
+		}
+		c.overrides[o.Field] = applied
+	}
+
+	// Fall back to the file value for overrides that fail validation
+	var verr *ValidationError
+	if errors.As(c.Validate(), &verr) {
+		for _, fe := range verr.Errors {
+			o, ok := c.overrides[fe.Field]
+			if !ok {
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%s: %s", o.Name, fe.Message))
+			field, _ := configField(c, fe.Field)
+			field.Set(reflect.ValueOf(o.fileValue))
+			delete(c.overrides, fe.Field)
+		}
+	}
+
+	return errs
+}
+
+// inheritOverrides re-applies the overrides in effect on from to c, whose
+// fields hold file values. Used when external edits are merged in.
+func (c *Config) inheritOverrides(from *Config) {
+	c.overrides = nil
+	for name, o := range from.overrides {
+		field, ok := configField(c, name)
+		if !ok {
+			continue
+		}
+		o.fileValue = field.Interface()
+		field.Set(reflect.ValueOf(o.value))
+		if c.overrides == nil {
+			c.overrides = make(map[string]configOverride)
+		}
+		c.overrides[name] = o
+	}
+}
+
+// dropChangedOverrides forgets overrides whose field no longer holds the
+// override value, because the user has set it explicitly since
+func (c *Config) dropChangedOverrides() {
+	for name, o := range c.overrides {
+		if field, ok := configField(c, name); !ok || !reflect.DeepEqual(field.Interface(), o.value) {
+			delete(c.overrides, name)
+		}
+	}
+}
+
+// fileView returns a copy of c as it should be written to disk, with
+// overridden fields holding the values they had before the overrides
+func (c *Config) fileView() *Config {
+	clone := c.Clone()
+	clone.Provenance = nil
+	for name, o := range c.overrides {
+		field, ok := configField(clone, name)
+		if ok && reflect.DeepEqual(field.Interface(), o.value) {
+			field.Set(reflect.ValueOf(o.fileValue))
+		}
+	}
+	return clone
+}
+
+// provenance returns the source of every top-level setting, keyed by JSON name
+func (c *Config) provenance() map[string]string {
+	sources := make(map[string]string)
+	current := reflect.ValueOf(c).Elem()
+	configType := current.Type()
+
+	for i := 0; i < configType.NumField(); i++ {
+		name := jsonFieldName(configType.Field(i))
+		if name == "" || name == "provenance" {
+			continue
+		}
+		switch o, ok := c.overrides[name]; {
+		case ok && reflect.DeepEqual(current.Field(i).Interface(), o.value):
+			sources[name] = o.Source
+		case c.fileKeys[name]:
+			sources[name] = SourceFile
+		default:
+			sources[name] = SourceDefault
+		}
+	}
+	return sources
+}
+
+// parseOverrideValue converts a raw override to the type of the field it sets
+func parseOverrideValue(raw string, t reflect.Type) (interface{}, error) {
+	var value interface{}
+	switch t.Kind() {
+	case reflect.String:
+		value = raw
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", raw)
+		}
+		value = n
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not true or false", raw)
+		}
+		value = b
+	default:
+		return nil, fmt.Errorf("settings of type %s cannot be overridden", t)
+	}
+	return reflect.ValueOf(value).Convert(t).Interface(), nil
+}
+
+// configField returns the top-level field of c with the given JSON name
+func configField(c *Config, jsonName string) (reflect.Value, bool) {
+	return structField(reflect.ValueOf(c).Elem(), jsonName)
+}
+
+// structField returns the field of the struct value v with the given JSON name
+func structField(v reflect.Value, jsonName string) (reflect.Value, bool) {
+	structType := v.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		if jsonFieldName(structType.Field(i)) == jsonName {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// jsonFieldName returns the JSON name of an exported struct field, or "" if it is not serialized
+func jsonFieldName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
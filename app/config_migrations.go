@@ -0,0 +1,98 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrConfigTooNew is returned when config.json was written by a newer app version
+var ErrConfigTooNew = errors.New("config was written by a newer version of the app")
+
+// configMigration upgrades a raw config document by one schema version
+type configMigration func(raw map[string]interface{}) error
+
+// configMigrations[i] upgrades a document from schema version i to i+1.
+// Append new steps here; never edit a released one.
+var configMigrations = []configMigration{
+	migrateConfigV0ToV1,
+	migrateConfigV1ToV2,
+}
+
+// CurrentConfigSchemaVersion is the schema version written by this build
+var CurrentConfigSchemaVersion = len(configMigrations)
+
+// migrateConfigV0ToV1 handles files written before schemaVersion existed.
+// Zero intervals and ports were never valid settings, only missing fields, so
+// they are dropped and picked up from DefaultConfig.
+func migrateConfigV0ToV1(raw map[string]interface{}) error {
+	for _, key := range []string{"refreshInterval", "webServerPort"} {
+		if n, ok := raw[key].(float64); ok && n <= 0 {
+			delete(raw, key)
+		}
+	}
+	return nil
+}
+
+// migrateConfigV1ToV2 introduces tokenSource. A saved manual token used to
+// take precedence over the backend, so such profiles keep using it.
+func migrateConfigV1ToV2(raw map[string]interface{}) error {
+	if ref, ok := raw["manualTokenRef"].(string); ok && ref != "" {
+		raw["tokenSource"] = map[string]interface{}{"type": TokenSourceStatic}
+	}
+	return nil
+}
+
+// parseConfig decodes a config file, migrating it to the current schema and
+// filling missing fields from DefaultConfig. fromVersion is the schema the
+// file was written with.
+func parseConfig(data []byte) (config *Config, fromVersion int, err error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, err
+	}
+
+	fromVersion = 0
+	if v, ok := raw["schemaVersion"].(float64); ok {
+		fromVersion = int(v)
+	}
+
+	if fromVersion > CurrentConfigSchemaVersion {
+		return nil, fromVersion, fmt.Errorf("%w: schema version %d, this build supports up to %d",
+			ErrConfigTooNew, fromVersion, CurrentConfigSchemaVersion)
+	}
+
+	for v := fromVersion; v < CurrentConfigSchemaVersion; v++ {
+		if err := configMigrations[v](raw); err != nil {
+			return nil, fromVersion, fmt.Errorf("failed to migrate config from schema %d to %d: %w", v, v+1, err)
+		}
+		raw["schemaVersion"] = v + 1
+	}
+
+	migratedData, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fromVersion, err
+	}
+
+	// Decoding over the defaults fills any field the file does not mention
+	config = DefaultConfig()
+	if err := json.Unmarshal(migratedData, config); err != nil {
+		return nil, fromVersion, err
+	}
+	config.SchemaVersion = CurrentConfigSchemaVersion
+	config.Provenance = nil // Computed by GetConfig, never taken from the file
+	config.fileKeys = jsonKeys(migratedData)
+
+	return config, fromVersion, nil
+}
+
+// backupConfigBeforeMigration copies the original file next to it before it is upgraded
+func backupConfigBeforeMigration(configPath string, data []byte, fromVersion int) error {
+	backupPath := fmt.Sprintf("%s.v%d.bak", configPath, fromVersion)
+	if err := os.WriteFile(backupPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to back up config before migration: %w", err)
+	}
+	appLogger.Info("Backed up schema v%d config to %s", fromVersion, backupPath)
+	return nil
+}
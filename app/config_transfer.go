@@ -0,0 +1,380 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+// Export formats
+const (
+	ConfigFormatBundle      = "bundle"      // Portable JSON bundle of all settings
+	ConfigFormatCloudflared = "cloudflared" // cloudflared config.yml with routes as ingress rules
+)
+
+// Import modes
+const (
+	ImportMerge   = "merge"   // Add and update routes, keep every other setting
+	ImportReplace = "replace" // Take routes and settings from the import
+)
+
+const configBundleKind = "cloudflared-desktop-tunnel-config"
+
+// ConfigBundle is a portable export of the settings. Secrets such as proxy
+// credentials and machine-specific paths are left out.
+type ConfigBundle struct {
+	Kind       string          `json:"kind"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Config     json.RawMessage `json:"config"` // Settings in config.json form
+}
+
+// cloudflaredConfig is the subset of a cloudflared config.yml we read and write
+type cloudflaredConfig struct {
+	Tunnel  string        `yaml:"tunnel,omitempty"`
+	Ingress []ingressRule `yaml:"ingress"`
+}
+
+// ingressRule is one cloudflared ingress rule
+type ingressRule struct {
+	Hostname string `yaml:"hostname,omitempty"`
+	Path     string `yaml:"path,omitempty"`
+	Service  string `yaml:"service"`
+}
+
+var tunnelIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// catchAllService answers requests no route matches in exported ingress rules
+const catchAllService = "http_status:404"
+
+// SettingChange is one top-level setting an import would change
+type SettingChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// ImportPreview describes what importing a file would change, without changing anything
+type ImportPreview struct {
+	Format        string          `json:"format"`
+	Mode          string          `json:"mode"`
+	Changes       []SettingChange `json:"changes"`
+	RoutesAdded   []Route         `json:"routesAdded"`
+	RoutesChanged []Route         `json:"routesChanged"` // New service for an existing hostname
+	RoutesRemoved []Route         `json:"routesRemoved"`
+	Warnings      []string        `json:"warnings"` // Parts of the file that were not imported
+	Errors        []FieldError    `json:"errors"`   // The result would not pass validation
+
+	// NewBackendURLs lists the endpoints the import switches to, or is empty if
+	// they stay the same. The device ID and credential are sent there, so
+	// ImportConfig only applies such an import when the user confirms it.
+	NewBackendURLs []string `json:"newBackendURLs"`
+}
+
+// errBackendNotConfirmed is returned for an import that changes the backend without confirmation
+var errBackendNotConfirmed = errors.New("the import changes the backend URL; confirm that this device's credential may be sent there")
+
+// configImport is a parsed import file
+type configImport struct {
+	format     string
+	config     *Config // Bundle settings; nil for cloudflared files
+	routes     []Route
+	tunnelName string
+	warnings   []string
+}
+
+// exportConfig renders c in the given format, leaving out secrets
+func exportConfig(c *Config, format string) ([]byte, error) {
+	portable := c.portable()
+
+	switch format {
+	case ConfigFormatBundle, "":
+		settings, err := json.Marshal(portable)
+		if err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(ConfigBundle{
+			Kind:       configBundleKind,
+			ExportedAt: time.Now().UTC(),
+			Config:     settings,
+		}, "", "  ")
+
+	case ConfigFormatCloudflared:
+		out := cloudflaredConfig{Tunnel: portable.TunnelName}
+		for _, route := range portable.Routes {
+			out.Ingress = append(out.Ingress, ingressRule{Hostname: route.Hostname, Service: route.Service})
+		}
+		// cloudflared requires the last rule to match everything
+		out.Ingress = append(out.Ingress, ingressRule{Service: catchAllService})
+
+		data, err := yaml.Marshal(out)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte("# Exported by Cloudflared Desktop Tunnel\n"), data...), nil
+
+	default:
+		return nil, fmt.Errorf("unknown export format %q (use %q or %q)", format, ConfigFormatBundle, ConfigFormatCloudflared)
+	}
+}
+
+// portable returns a copy of c as it is saved, without proxy credentials,
+// secret references, local file paths, the device identity or the command
+// key and consent, which each device must set up itself
+func (c *Config) portable() *Config {
+	clone := c.fileView()
+	clone.CommandPublicKey = ""
+	clone.AllowedCommands = []string{}
+	clone.CABundlePath = ""
+	clone.ManualTokenRef = ""
+	clone.DeviceID = ""
+	clone.DeviceCredentialRef = ""
+	clone.LastTokenRef = ""
+	clone.TokenSource.Path = ""
+	clone.TokenSource.Command = ""
+	clone.TokenSource.APITokenRef = ""
+	clone.Proxy.HTTPProxy = stripURLCredentials(clone.Proxy.HTTPProxy)
+	clone.Proxy.HTTPSProxy = stripURLCredentials(clone.Proxy.HTTPSProxy)
+	clone.Proxy.SOCKS5Proxy = stripURLCredentials(clone.Proxy.SOCKS5Proxy)
+	return clone
+}
+
+// stripURLCredentials removes user:password@ from a URL
+func stripURLCredentials(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+// parseConfigImport reads a bundle, a plain config.json or a cloudflared config.yml
+func parseConfigImport(data []byte) (*configImport, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("import file is empty")
+	}
+
+	if trimmed[0] == '{' {
+		var bundle ConfigBundle
+		if err := json.Unmarshal(trimmed, &bundle); err != nil {
+			return nil, fmt.Errorf("failed to parse import file: %w", err)
+		}
+		settings := trimmed
+		if bundle.Kind == configBundleKind {
+			settings = bundle.Config
+		}
+		config, _, err := parseConfig(settings)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse imported settings: %w", err)
+		}
+		return &configImport{format: ConfigFormatBundle, config: config, routes: config.Routes}, nil
+	}
+
+	var cf cloudflaredConfig
+	if err := yaml.Unmarshal(trimmed, &cf); err != nil {
+		return nil, fmt.Errorf("failed to parse cloudflared config: %w", err)
+	}
+	if len(cf.Ingress) == 0 {
+		return nil, fmt.Errorf("cloudflared config has no ingress rules")
+	}
+
+	imp := &configImport{format: ConfigFormatCloudflared}
+	// `tunnel:` holds a name or a UUID; only a name maps to TunnelName
+	if tunnelIDPattern.MatchString(cf.Tunnel) {
+		imp.warnings = append(imp.warnings, fmt.Sprintf("tunnel ID %s was not imported as the tunnel name", cf.Tunnel))
+	} else {
+		imp.tunnelName = cf.Tunnel
+	}
+	seen := make(map[string]bool)
+	for i, rule := range cf.Ingress {
+		switch {
+		case rule.Hostname == "":
+			// The catch-all rule has no route equivalent
+			if i != len(cf.Ingress)-1 || rule.Service != catchAllService {
+				imp.warnings = append(imp.warnings, fmt.Sprintf("ingress rule %d has no hostname and was skipped", i+1))
+			}
+		case rule.Path != "":
+			imp.warnings = append(imp.warnings, fmt.Sprintf("ingress rule for %s%s was skipped: path rules are not supported", rule.Hostname, rule.Path))
+		case seen[rule.Hostname]:
+			imp.warnings = append(imp.warnings, fmt.Sprintf("duplicate ingress rule for %s was skipped", rule.Hostname))
+		default:
+			seen[rule.Hostname] = true
+			imp.routes = append(imp.routes, Route{Hostname: rule.Hostname, Service: rule.Service})
+		}
+	}
+	return imp, nil
+}
+
+// apply returns current with the import applied in the given mode
+func (imp *configImport) apply(current *Config, mode string) (*Config, error) {
+	next := current.Clone()
+
+	switch mode {
+	case ImportMerge, "":
+		next.Routes = mergeRoutes(current.Routes, imp.routes)
+
+	case ImportReplace:
+		if imp.config != nil {
+			next = imp.config.Clone()
+			// Local paths and secrets never travel with a bundle
+			next.CABundlePath = current.CABundlePath
+			next.ManualTokenRef = current.ManualTokenRef
+			next.DeviceID = current.DeviceID
+			next.DeviceCredentialRef = current.DeviceCredentialRef
+			next.LastTokenRef = current.LastTokenRef
+			next.TokenSource.Path = current.TokenSource.Path
+			next.TokenSource.Command = current.TokenSource.Command
+			next.TokenSource.APITokenRef = current.TokenSource.APITokenRef
+			// Remote command trust is never granted by an imported file
+			next.CommandPublicKey = current.CommandPublicKey
+			next.AllowedCommands = append([]string{}, current.AllowedCommands...)
+			next.inheritFileState(current)
+		} else if imp.tunnelName != "" {
+			next.TunnelName = imp.tunnelName
+		}
+		next.Routes = append([]Route{}, imp.routes...)
+
+	default:
+		return nil, fmt.Errorf("unknown import mode %q (use %q or %q)", mode, ImportMerge, ImportReplace)
+	}
+
+	return next, nil
+}
+
+// mergeRoutes adds imported routes to current, replacing the service of routes
+// with the same hostname
+func mergeRoutes(current, imported []Route) []Route {
+	merged := append([]Route{}, current...)
+	for _, route := range imported {
+		found := false
+		for i := range merged {
+			if merged[i].Hostname == route.Hostname {
+				merged[i].Service = route.Service
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, route)
+		}
+	}
+	return merged
+}
+
+// previewConfigImport parses data and describes what importing it into
+// current would change
+func previewConfigImport(current *Config, data []byte, mode string) (*ImportPreview, *Config, error) {
+	imp, err := parseConfigImport(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	next, err := imp.apply(current, mode)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mode == "" {
+		mode = ImportMerge
+	}
+
+	preview := &ImportPreview{
+		Format:        imp.format,
+		Mode:          mode,
+		Changes:       []SettingChange{},
+		RoutesAdded:   []Route{},
+		RoutesChanged: []Route{},
+		RoutesRemoved: []Route{},
+		Warnings:      append([]string{}, imp.warnings...),
+		Errors:        []FieldError{},
+
+		NewBackendURLs: []string{},
+	}
+	if !reflect.DeepEqual(current.BackendURLs(), next.BackendURLs()) {
+		preview.NewBackendURLs = next.BackendURLs()
+	}
+
+	before, err := configToMap(current.fileView())
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := configToMap(next.fileView())
+	if err != nil {
+		return nil, nil, err
+	}
+	for field, value := range after {
+		if field == "routes" || field == "schemaVersion" || reflect.DeepEqual(before[field], value) {
+			continue
+		}
+		preview.Changes = append(preview.Changes, SettingChange{Field: field, Old: before[field], New: value})
+	}
+	sort.Slice(preview.Changes, func(i, j int) bool { return preview.Changes[i].Field < preview.Changes[j].Field })
+
+	oldRoutes := make(map[string]Route, len(current.Routes))
+	for _, route := range current.Routes {
+		oldRoutes[route.Hostname] = route
+	}
+	newHosts := make(map[string]bool, len(next.Routes))
+	for _, route := range next.Routes {
+		newHosts[route.Hostname] = true
+		old, ok := oldRoutes[route.Hostname]
+		switch {
+		case !ok:
+			preview.RoutesAdded = append(preview.RoutesAdded, route)
+		case old.Service != route.Service:
+			preview.RoutesChanged = append(preview.RoutesChanged, route)
+		}
+	}
+	for _, route := range current.Routes {
+		if !newHosts[route.Hostname] {
+			preview.RoutesRemoved = append(preview.RoutesRemoved, route)
+		}
+	}
+
+	var verr *ValidationError
+	if errors.As(next.Validate(), &verr) {
+		preview.Errors = verr.Errors
+	}
+
+	return preview, next, nil
+}
+
+// String formats the preview for the command line
+func (p *ImportPreview) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Import (%s, %s):\n", p.Format, p.Mode)
+	for _, c := range p.Changes {
+		fmt.Fprintf(&b, "  ~ %s: %v -> %v\n", c.Field, c.Old, c.New)
+	}
+	for _, r := range p.RoutesAdded {
+		fmt.Fprintf(&b, "  + route %s -> %s\n", r.Hostname, r.Service)
+	}
+	for _, r := range p.RoutesChanged {
+		fmt.Fprintf(&b, "  ~ route %s -> %s\n", r.Hostname, r.Service)
+	}
+	for _, r := range p.RoutesRemoved {
+		fmt.Fprintf(&b, "  - route %s -> %s\n", r.Hostname, r.Service)
+	}
+	if len(p.Changes)+len(p.RoutesAdded)+len(p.RoutesChanged)+len(p.RoutesRemoved) == 0 {
+		b.WriteString("  no changes\n")
+	}
+	if len(p.NewBackendURLs) > 0 {
+		fmt.Fprintf(&b, "  ! backend changes to %s; this device's ID and credential will be sent there\n",
+			strings.Join(p.NewBackendURLs, ", "))
+	}
+	for _, w := range p.Warnings {
+		fmt.Fprintf(&b, "  warning: %s\n", w)
+	}
+	for _, fe := range p.Errors {
+		fmt.Fprintf(&b, "  error: %s: %s\n", fe.Field, fe.Message)
+	}
+	return b.String()
+}
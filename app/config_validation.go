@@ -0,0 +1,268 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/votanchat/cloudflared-desktop-tunnel/network"
+	"github.com/votanchat/cloudflared-desktop-tunnel/secrets"
+)
+
+// FieldError describes a single invalid config field
+type FieldError struct {
+	Field   string `json:"field"`   // JSON path, e.g. "webServerPort" or "routes[0].service"
+	Message string `json:"message"` // Human readable reason
+}
+
+// ValidationError collects every invalid field found in a Config
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+// Error implements error
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		parts[i] = fe.Field + ": " + fe.Message
+	}
+	return "invalid config: " + strings.Join(parts, "; ")
+}
+
+// add records an invalid field
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks every field and returns a *ValidationError listing all
+// problems, or nil if the config is valid
+func (c *Config) Validate() error {
+	verr := &ValidationError{}
+
+	if err := validateHTTPURL(c.BackendURL); err != nil {
+		verr.add("backendURL", "%v", err)
+	}
+	for i, raw := range c.FallbackBackendURLs {
+		if err := validateHTTPURL(raw); err != nil {
+			verr.add(fmt.Sprintf("fallbackBackendURLs[%d]", i), "%v", err)
+		} else if raw == c.BackendURL || slices.Contains(c.FallbackBackendURLs[:i], raw) {
+			verr.add(fmt.Sprintf("fallbackBackendURLs[%d]", i), "%s is already listed", raw)
+		}
+	}
+
+	if strings.TrimSpace(c.TunnelName) == "" {
+		verr.add("tunnelName", "must not be empty")
+	}
+
+	if c.RefreshInterval < 60 || c.RefreshInterval > 86400 {
+		verr.add("refreshInterval", "must be between 60 and 86400 seconds")
+	}
+
+	if c.WebServerPort < 0 || c.WebServerPort > 65535 {
+		verr.add("webServerPort", "must be between 0 and 65535 (0 uses the default port 8080)")
+	}
+
+	if c.UpdateCheckInterval != 0 && c.UpdateCheckInterval < 600 {
+		verr.add("updateCheckInterval", "must be at least 600 seconds, or 0 for the default")
+	}
+
+	if c.CacheKeepVersions < 0 {
+		verr.add("cacheKeepVersions", "must not be negative")
+	}
+
+	if c.CacheMaxSizeMB < 0 {
+		verr.add("cacheMaxSizeMB", "must not be negative")
+	}
+
+	seen := make(map[string]bool, len(c.Routes))
+	for i, route := range c.Routes {
+		hostname := strings.TrimSpace(route.Hostname)
+		switch {
+		case hostname == "":
+			verr.add(fmt.Sprintf("routes[%d].hostname", i), "must not be empty")
+		case strings.ContainsAny(hostname, " /:"):
+			verr.add(fmt.Sprintf("routes[%d].hostname", i), "must be a bare hostname such as app.example.com")
+		case seen[hostname]:
+			verr.add(fmt.Sprintf("routes[%d].hostname", i), "duplicate hostname %s", hostname)
+		}
+		seen[hostname] = true
+
+		if u, err := url.Parse(route.Service); err != nil || u.Scheme == "" {
+			verr.add(fmt.Sprintf("routes[%d].service", i), "must be a URL such as http://localhost:3000")
+		}
+	}
+
+	if c.Proxy.HTTPProxy != "" {
+		if err := network.ValidateProxyURL(c.Proxy.HTTPProxy); err != nil {
+			verr.add("proxy.httpProxy", "%v", err)
+		}
+	}
+	if c.Proxy.HTTPSProxy != "" {
+		if err := network.ValidateProxyURL(c.Proxy.HTTPSProxy); err != nil {
+			verr.add("proxy.httpsProxy", "%v", err)
+		}
+	}
+	if c.Proxy.SOCKS5Proxy != "" {
+		if err := network.ValidateProxyURL(c.Proxy.SOCKS5Proxy); err != nil {
+			verr.add("proxy.socks5Proxy", "%v", err)
+		} else if !strings.HasPrefix(c.Proxy.SOCKS5Proxy, "socks5") {
+			verr.add("proxy.socks5Proxy", "must use the socks5:// scheme")
+		}
+	}
+
+	c.TokenSource.validate(verr)
+
+	switch c.TokenRotation {
+	case TokenRotationSeamless, TokenRotationRestart, TokenRotationManual:
+	default:
+		verr.add("tokenRotation", "must be %q, %q or %q", TokenRotationSeamless, TokenRotationRestart, TokenRotationManual)
+	}
+
+	if c.CommandPublicKey != "" {
+		if _, err := parseCommandPublicKey(c.CommandPublicKey); err != nil {
+			verr.add("commandPublicKey", "%v", err)
+		}
+	}
+	for _, commandType := range c.AllowedCommands {
+		if !slices.Contains(commandTypes, commandType) {
+			verr.add("allowedCommands", "unknown command type %q", commandType)
+		}
+	}
+
+	switch c.SecretStore {
+	case "", secrets.StoreKeyring, secrets.StoreFile:
+	default:
+		verr.add("secretStore", "must be %q, %q or empty", secrets.StoreKeyring, secrets.StoreFile)
+	}
+	if c.ManualTokenRef != "" {
+		if _, _, err := secrets.ParseRef(c.ManualTokenRef); err != nil {
+			verr.add("manualTokenRef", "%v", err)
+		}
+	}
+	if c.DeviceCredentialRef != "" {
+		if _, _, err := secrets.ParseRef(c.DeviceCredentialRef); err != nil {
+			verr.add("deviceCredentialRef", "%v", err)
+		}
+	}
+	if c.LastTokenRef != "" {
+		if _, _, err := secrets.ParseRef(c.LastTokenRef); err != nil {
+			verr.add("lastTokenRef", "%v", err)
+		}
+	}
+
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// validateEdit is Validate plus the checks that only apply when the user
+// changes a field, such as whether a file exists. A file that is briefly
+// missing when settings are loaded must not get the setting reset.
+func (c *Config) validateEdit(old *Config) error {
+	verr := &ValidationError{}
+	errors.As(c.Validate(), &verr)
+
+	if c.CABundlePath != "" && c.CABundlePath != old.CABundlePath {
+		if info, err := os.Stat(c.CABundlePath); err != nil || info.IsDir() {
+			verr.add("caBundlePath", "file not found: %s", c.CABundlePath)
+		}
+	}
+
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// validate checks that the fields the selected token source needs are set
+func (s *TokenSourceConfig) validate(verr *ValidationError) {
+	switch s.Type {
+	case TokenSourceBackend, TokenSourceStatic:
+	case TokenSourceFile:
+		if strings.TrimSpace(s.Path) == "" {
+			verr.add("tokenSource.path", "must not be empty")
+		}
+	case TokenSourceCommand:
+		if strings.TrimSpace(s.Command) == "" {
+			verr.add("tokenSource.command", "must not be empty")
+		}
+	case TokenSourceEnv:
+		if strings.TrimSpace(s.EnvVar) == "" {
+			verr.add("tokenSource.envVar", "must not be empty")
+		}
+	case TokenSourceCloudflare:
+		if strings.TrimSpace(s.AccountID) == "" {
+			verr.add("tokenSource.accountId", "must not be empty")
+		}
+		if strings.TrimSpace(s.TunnelID) == "" {
+			verr.add("tokenSource.tunnelId", "must not be empty")
+		}
+	default:
+		verr.add("tokenSource.type", "must be one of %s", strings.Join(tokenSources, ", "))
+	}
+	if s.APITokenRef != "" {
+		if _, _, err := secrets.ParseRef(s.APITokenRef); err != nil {
+			verr.add("tokenSource.apiTokenRef", "%v", err)
+		}
+	}
+}
+
+// validateHTTPURL checks that raw is an absolute http(s) URL
+func validateHTTPURL(raw string) error {
+	if strings.TrimSpace(raw) == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("must be an http:// or https:// URL")
+	}
+	return nil
+}
+
+// resetInvalidFields replaces each invalid field with its default value. A
+// field inside a section such as tokenSource.path is reset on its own, and if
+// the section is still invalid only its type falls back to the default.
+// Invalid routes are left alone so no user data is dropped.
+func (c *Config) resetInvalidFields(verr *ValidationError) {
+	defaults := DefaultConfig()
+
+	for _, fe := range verr.Errors {
+		path := fe.Field
+		if i := strings.Index(path, "["); i >= 0 {
+			path = path[:i]
+		}
+		if path == "routes" {
+			continue
+		}
+
+		if field, ok := settingField(c, path); ok {
+			defaultValue, _ := settingField(defaults, path)
+			field.Set(defaultValue)
+		}
+	}
+
+	// An empty required field cannot be fixed by its default
+	tokenSourceErrors := &ValidationError{}
+	c.TokenSource.validate(tokenSourceErrors)
+	if len(tokenSourceErrors.Errors) > 0 {
+		c.TokenSource.Type = defaults.TokenSource.Type
+	}
+}
+
+// settingField returns the field at a dotted JSON path such as "tokenSource.path"
+func settingField(c *Config, path string) (reflect.Value, bool) {
+	names := strings.Split(path, ".")
+	field, ok := configField(c, names[0])
+	for _, name := range names[1:] {
+		if !ok || field.Kind() != reflect.Struct {
+			return reflect.Value{}, false
+		}
+		field, ok = structField(field, name)
+	}
+	return field, ok
+}
@@ -0,0 +1,342 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configPollInterval is how often config.json is checked for external edits
+const configPollInterval = 2 * time.Second
+
+// configSync remembers config.json as last read from or written to disk, so
+// external edits can be told apart from our own saves and merged three-way
+type configSync struct {
+	mu           sync.Mutex
+	base         *Config           // Config matching the file content below
+	hash         [sha256.Size]byte // Hash of the file content base came from
+	modTime      time.Time
+	size         int64
+	reportedHash [sha256.Size]byte // Disk content already reported as invalid or conflicting
+	conflicts    []string          // Fields changed both in memory and on disk
+}
+
+// currentConfig returns the settings in effect. The result is never modified;
+// changes are saved as a new Config with saveConfig or updateConfig.
+func (a *App) currentConfig() *Config {
+	a.configMu.RLock()
+	defer a.configMu.RUnlock()
+	return a.config
+}
+
+// setConfig publishes config as the settings in effect
+func (a *App) setConfig(config *Config) {
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+	a.config = config
+}
+
+// markConfigSynced records the current file as matching the current config. Callers hold a.configSync.mu.
+func (a *App) markConfigSynced() {
+	config := a.currentConfig()
+	a.configSync.base = config.fileView()
+	a.configSync.conflicts = nil
+
+	configPath, err := config.filePath()
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		// No file yet; the first external write will be treated as an edit
+		a.configSync.hash = [sha256.Size]byte{}
+		a.configSync.modTime = time.Time{}
+		a.configSync.size = 0
+		return
+	}
+	a.configSync.hash = sha256.Sum256(data)
+	if info, err := os.Stat(configPath); err == nil {
+		a.configSync.modTime = info.ModTime()
+		a.configSync.size = info.Size()
+	}
+}
+
+// watchConfigFile polls config.json for external edits until ctx is cancelled
+func (a *App) watchConfigFile(ctx context.Context) {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.configSync.mu.Lock()
+			a.checkConfigFile()
+			a.configSync.mu.Unlock()
+		}
+	}
+}
+
+// checkConfigFile merges an external edit of config.json into the current
+// config and applies it live. Callers hold a.configSync.mu.
+func (a *App) checkConfigFile() {
+	merged, disk := a.mergeConfigFile(a.currentConfig())
+	if merged == nil {
+		return
+	}
+
+	// Our own unsaved changes survived the merge, so the file needs them too
+	if !sameSettings(merged.fileView(), disk) {
+		if err := merged.Save(); err != nil {
+			appLogger.Error("Failed to save merged config: %v", err)
+		}
+	}
+
+	a.adoptConfig(merged)
+	a.markConfigSynced()
+	a.emitEvent("config:reloaded", a.GetConfig())
+}
+
+// mergeConfigFile merges an external edit of config.json into mine. It
+// returns the merged config along with the file's settings, or nil if the
+// file is unchanged or the edit cannot be used. Conflicts are recorded in
+// a.configSync. Callers hold a.configSync.mu.
+func (a *App) mergeConfigFile(mine *Config) (*Config, *Config) {
+	configPath, err := mine.filePath()
+	if err != nil {
+		return nil, nil
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return nil, nil
+	}
+	// mtime and size are a cheap pre-check; the hash decides
+	if info.ModTime().Equal(a.configSync.modTime) && info.Size() == a.configSync.size {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, nil
+	}
+	hash := sha256.Sum256(data)
+	a.configSync.modTime = info.ModTime()
+	a.configSync.size = info.Size()
+	if hash == a.configSync.hash || hash == a.configSync.reportedHash {
+		return nil, nil
+	}
+
+	appLogger.Info("config.json changed on disk, reloading")
+
+	disk, _, err := parseConfig(data)
+	if err != nil {
+		a.configSync.reportedHash = hash
+		a.addNotice(fmt.Sprintf("Ignored external edit to config.json: %v", err))
+		return nil, nil
+	}
+
+	// Merge the file layer only; env and flag overrides are re-applied on top
+	merged, conflicts, err := mergeConfigs(a.configSync.base, mine.fileView(), disk)
+	if err != nil {
+		appLogger.Error("Failed to merge external config edit: %v", err)
+		return nil, nil
+	}
+	if len(conflicts) > 0 {
+		a.configSync.reportedHash = hash
+		a.configSync.conflicts = conflicts
+		appLogger.Warn("config.json conflicts with unsaved changes in: %s", strings.Join(conflicts, ", "))
+		a.emitEvent("config:conflict", conflicts)
+		a.addNotice(fmt.Sprintf("config.json was edited externally while these settings had unsaved changes: %s. Neither version was overwritten; choose which to keep in Settings.",
+			strings.Join(conflicts, ", ")))
+		return nil, nil
+	}
+
+	merged.fileKeys = disk.fileKeys
+	merged.inheritOverrides(mine)
+	if err := merged.Validate(); err != nil {
+		a.configSync.reportedHash = hash
+		a.addNotice(fmt.Sprintf("Ignored external edit to config.json: %v", err))
+		return nil, nil
+	}
+	return merged, disk
+}
+
+// adoptConfig replaces the current config with config and applies the
+// difference live. A config without a path is taken to belong to the current
+// file. Callers hold a.configSync.mu.
+func (a *App) adoptConfig(config *Config) {
+	old := a.currentConfig()
+	if config.path == "" {
+		config.inheritFileState(old)
+	}
+
+	a.setConfig(config)
+	result := a.applyConfigChanges(old)
+	if result.TunnelRestartPending {
+		a.addNotice("Tunnel settings changed in config.json; restart the tunnel to apply them")
+	}
+}
+
+// saveConfig writes next, merged with any external edit the poller has not
+// picked up yet, and makes it the current config. Nothing changes if the
+// write fails or an external edit conflicts.
+func (a *App) saveConfig(next *Config) error {
+	a.configSync.mu.Lock()
+	defer a.configSync.mu.Unlock()
+	return a.saveConfigLocked(next)
+}
+
+// updateConfig saves a copy of the current config with change applied
+func (a *App) updateConfig(change func(c *Config)) error {
+	a.configSync.mu.Lock()
+	defer a.configSync.mu.Unlock()
+
+	// Apply external edits first so change sees them
+	a.checkConfigFile()
+	next := a.currentConfig().Clone()
+	change(next)
+	return a.saveConfigLocked(next)
+}
+
+// saveConfigLocked is saveConfig for callers holding a.configSync.mu
+func (a *App) saveConfigLocked(next *Config) error {
+	if merged, _ := a.mergeConfigFile(next); merged != nil {
+		next = merged
+	} else {
+		// Save records the file state on the config, which may already be published
+		next = next.Clone()
+	}
+	if len(a.configSync.conflicts) > 0 {
+		return fmt.Errorf("config.json was edited externally and conflicts with changes to %s; resolve the conflict first",
+			strings.Join(a.configSync.conflicts, ", "))
+	}
+
+	if err := next.Save(); err != nil {
+		// Look at the file again next time so an edit merged above is not lost
+		a.configSync.modTime = time.Time{}
+		return err
+	}
+	a.setConfig(next)
+	a.markConfigSynced()
+	return nil
+}
+
+// ResolveConfigConflict ends a conflict between in-memory settings and an
+// external edit, keeping the file on disk if useDisk is true and the
+// in-memory settings otherwise
+func (a *App) ResolveConfigConflict(useDisk bool) error {
+	a.configSync.mu.Lock()
+	defer a.configSync.mu.Unlock()
+
+	if len(a.configSync.conflicts) == 0 {
+		return errors.New("there is no config conflict to resolve")
+	}
+
+	current := a.currentConfig()
+	if !useDisk {
+		mine := current.Clone()
+		if err := mine.Save(); err != nil {
+			return err
+		}
+		a.setConfig(mine)
+		a.markConfigSynced()
+		return nil
+	}
+
+	configPath, err := current.filePath()
+	if err != nil {
+		return err
+	}
+	disk, err := loadConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	disk.inheritOverrides(current)
+	if err := disk.Validate(); err != nil {
+		return err
+	}
+
+	a.adoptConfig(disk)
+	a.markConfigSynced()
+	a.emitEvent("config:reloaded", a.GetConfig())
+	return nil
+}
+
+// GetConfigConflicts returns the fields in conflict with an external edit, if any
+func (a *App) GetConfigConflicts() []string {
+	a.configSync.mu.Lock()
+	defer a.configSync.mu.Unlock()
+	return append([]string{}, a.configSync.conflicts...)
+}
+
+// mergeConfigs does a field-level three-way merge of an external edit
+// (theirs) into the in-memory config (mine), relative to base. It returns
+// the names of fields both sides changed differently.
+func mergeConfigs(base, mine, theirs *Config) (*Config, []string, error) {
+	baseMap, err := configToMap(base)
+	if err != nil {
+		return nil, nil, err
+	}
+	mineMap, err := configToMap(mine)
+	if err != nil {
+		return nil, nil, err
+	}
+	theirsMap, err := configToMap(theirs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conflicts []string
+	for key, theirValue := range theirsMap {
+		baseValue, myValue := baseMap[key], mineMap[key]
+		if reflect.DeepEqual(theirValue, baseValue) || reflect.DeepEqual(theirValue, myValue) {
+			continue
+		}
+		if !reflect.DeepEqual(myValue, baseValue) {
+			conflicts = append(conflicts, key)
+			continue
+		}
+		mineMap[key] = theirValue
+	}
+	sort.Strings(conflicts)
+
+	data, err := json.Marshal(mineMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged := mine.Clone()
+	if err := json.Unmarshal(data, merged); err != nil {
+		return nil, nil, err
+	}
+	return merged, conflicts, nil
+}
+
+// configToMap converts a config to its generic JSON form for field comparison
+func configToMap(c *Config) (map[string]interface{}, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// sameSettings reports whether two configs serialize identically
+func sameSettings(a, b *Config) bool {
+	am, errA := configToMap(a)
+	bm, errB := configToMap(b)
+	return errA == nil && errB == nil && reflect.DeepEqual(am, bm)
+}
@@ -0,0 +1,294 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+)
+
+const deviceCredentialSecret = "device-credential"
+
+// Headers identifying the device on every backend request and the websocket handshake
+const (
+	deviceIDHeader      = "X-Device-ID"
+	authorizationHeader = "Authorization"
+)
+
+// DeviceStatus describes this device's enrollment with the backend
+type DeviceStatus struct {
+	DeviceID  string `json:"deviceId"`
+	Enrolled  bool   `json:"enrolled"` // A credential is saved
+	Loaded    bool   `json:"loaded"`   // The credential is attached to backend requests
+	Rejected  bool   `json:"rejected"` // The backend refused the credential; enroll again
+	LastError string `json:"lastError"`
+}
+
+// enrollRequest is sent to /api/devices/enroll
+type enrollRequest struct {
+	Code     string `json:"code"`
+	DeviceID string `json:"deviceId"`
+	Name     string `json:"name"`
+	Platform string `json:"platform"`
+}
+
+// enrollResponse carries the credential the backend issued for the device
+type enrollResponse struct {
+	Credential string `json:"credential"`
+}
+
+// SetDeviceCredential sets the credential attached to every backend request.
+// Call Reconnect for the websocket to present it.
+func (bc *BackendClient) SetDeviceCredential(deviceID, credential string) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.deviceID = deviceID
+	bc.deviceCredential = credential
+	bc.credentialRejected = false
+}
+
+// SetOnUnauthorized sets the callback invoked when the backend first rejects the device credential
+func (bc *BackendClient) SetOnUnauthorized(callback func(error)) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.onUnauthorized = callback
+}
+
+// DeviceRejected reports whether the backend rejected the current credential
+func (bc *BackendClient) DeviceRejected() bool {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.credentialRejected
+}
+
+// authHeader returns the headers identifying this device
+func (bc *BackendClient) authHeader() http.Header {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	header := http.Header{}
+	if bc.deviceID != "" {
+		header.Set(deviceIDHeader, bc.deviceID)
+	}
+	if bc.deviceCredential != "" {
+		header.Set(authorizationHeader, "Bearer "+bc.deviceCredential)
+	}
+	return header
+}
+
+// unauthorized records a 401 from the backend and returns the error for it
+func (bc *BackendClient) unauthorized(detail string) error {
+	err := fmt.Errorf("%w: %s", ErrDeviceUnauthorized, detail)
+
+	bc.mu.Lock()
+	first := !bc.credentialRejected
+	bc.credentialRejected = true
+	callback := bc.onUnauthorized
+	bc.mu.Unlock()
+
+	if first {
+		backendLogger.Warn("Backend rejected the device credential: %s", detail)
+		if callback != nil {
+			callback(err)
+		}
+	}
+	return err
+}
+
+// Enroll registers the device with a one-time enrollment code and returns
+// the credential the backend issued
+func (bc *BackendClient) Enroll(code, deviceID, name string) (string, error) {
+	data, err := json.Marshal(enrollRequest{
+		Code:     code,
+		DeviceID: deviceID,
+		Name:     name,
+		Platform: runtime.GOOS + "/" + runtime.GOARCH,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := bc.client().Post(bc.getBaseURL()+"/api/devices/enroll", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to reach backend: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// A 401 here means a bad code, not a rejected credential
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("enrollment refused (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var enrollResp enrollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&enrollResp); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if enrollResp.Credential == "" {
+		return "", fmt.Errorf("backend returned no credential")
+	}
+	return enrollResp.Credential, nil
+}
+
+// Unenroll asks the backend to revoke the device's credential. A credential
+// the backend already rejects counts as revoked.
+func (bc *BackendClient) Unenroll(deviceID string) error {
+	resp, err := bc.do(context.Background(), http.MethodDelete, "/api/devices/"+url.PathEscape(deviceID), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound, http.StatusUnauthorized:
+		return nil
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(body))
+	}
+}
+
+// newDeviceID returns a random device identifier
+func newDeviceID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// initDevice gives the profile a device ID on first run and attaches its
+// saved credential to backend requests
+func (a *App) initDevice() {
+	a.backendClient.SetOnUnauthorized(func(err error) {
+		if a.currentConfig().DeviceCredentialRef == "" {
+			a.addNotice("The backend only accepts enrolled devices. Enter an enrollment code in Settings.")
+		} else {
+			a.addNotice("The backend no longer accepts this device. Enroll it again in Settings.")
+		}
+		a.emitEvent("device:status", a.GetDeviceStatus())
+	})
+
+	if err := a.ensureDeviceID(); err != nil {
+		appLogger.Warn("%v", err)
+	}
+	a.loadDeviceCredential()
+}
+
+// ensureDeviceID generates and saves a device ID for the profile if it has none
+func (a *App) ensureDeviceID() error {
+	if a.currentConfig().DeviceID != "" {
+		return nil
+	}
+	id, err := newDeviceID()
+	if err != nil {
+		return fmt.Errorf("failed to generate device ID: %w", err)
+	}
+	appLogger.Info("Generated device ID %s", id)
+	if err := a.updateConfig(func(c *Config) { c.DeviceID = id }); err != nil {
+		return fmt.Errorf("failed to save device ID: %w", err)
+	}
+	return nil
+}
+
+// loadDeviceCredential reads the saved credential, if any, and hands it to
+// the backend client. A locked secret file is retried after UnlockSecretStore.
+func (a *App) loadDeviceCredential() {
+	config := a.currentConfig()
+	deviceError := ""
+	credential := ""
+	if ref := config.DeviceCredentialRef; ref != "" {
+		var err error
+		if credential, err = a.resolveSecret(ref); err != nil {
+			deviceError = fmt.Sprintf("failed to read device credential: %v", err)
+			appLogger.Warn("Backend requests are unauthenticated: %s", deviceError)
+		}
+	}
+	a.deviceMu.Lock()
+	a.deviceError = deviceError
+	a.deviceMu.Unlock()
+	a.backendClient.SetDeviceCredential(config.DeviceID, credential)
+	a.backendClient.Reconnect()
+}
+
+// GetDeviceStatus reports whether this device is enrolled with the backend
+func (a *App) GetDeviceStatus() DeviceStatus {
+	config := a.currentConfig()
+	a.deviceMu.Lock()
+	deviceError := a.deviceError
+	a.deviceMu.Unlock()
+	return DeviceStatus{
+		DeviceID:  config.DeviceID,
+		Enrolled:  config.DeviceCredentialRef != "",
+		Loaded:    config.DeviceCredentialRef != "" && deviceError == "",
+		Rejected:  a.backendClient.DeviceRejected(),
+		LastError: deviceError,
+	}
+}
+
+// EnrollDevice registers this device with the backend using a one-time
+// code. Enrolling again replaces the previous credential.
+func (a *App) EnrollDevice(code string) (DeviceStatus, error) {
+	if code == "" {
+		return a.GetDeviceStatus(), fmt.Errorf("enrollment code must not be empty")
+	}
+	if err := a.ensureDeviceID(); err != nil {
+		return a.GetDeviceStatus(), err
+	}
+
+	name, _ := os.Hostname()
+	config := a.currentConfig()
+	credential, err := a.backendClient.Enroll(code, config.DeviceID, name)
+	if err != nil {
+		return a.GetDeviceStatus(), err
+	}
+
+	ref, err := a.storeSecret(activeProfileName()+"/"+deviceCredentialSecret, credential)
+	if err != nil {
+		return a.GetDeviceStatus(), err
+	}
+	var old string
+	if err := a.updateConfig(func(c *Config) {
+		old = c.DeviceCredentialRef
+		c.DeviceCredentialRef = ref
+	}); err != nil {
+		return a.GetDeviceStatus(), err
+	}
+	if old != "" && old != ref {
+		if err := a.deleteSecret(old); err != nil {
+			appLogger.Warn("Failed to delete previous device credential: %v", err)
+		}
+	}
+
+	a.loadDeviceCredential()
+	appLogger.Info("Device %s enrolled with %s", config.DeviceID, config.BackendURL)
+	return a.GetDeviceStatus(), nil
+}
+
+// UnenrollDevice revokes the device credential with the backend, if it can
+// still be reached, and deletes it locally
+func (a *App) UnenrollDevice() error {
+	config := a.currentConfig()
+	ref := config.DeviceCredentialRef
+	if ref == "" {
+		return nil
+	}
+	if err := a.backendClient.Unenroll(config.DeviceID); err != nil {
+		appLogger.Warn("Backend did not confirm unenrollment: %v", err)
+	}
+	if err := a.deleteSecret(ref); err != nil {
+		return fmt.Errorf("failed to delete device credential: %w", err)
+	}
+	if err := a.updateConfig(func(c *Config) { c.DeviceCredentialRef = "" }); err != nil {
+		return err
+	}
+	a.loadDeviceCredential()
+	return nil
+}
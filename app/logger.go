@@ -38,6 +38,10 @@ var (
 		LevelError: "ERROR",
 	}
 
+	// Recent errors, included in status reports
+	recentErrors      []string
+	recentErrorsMutex sync.Mutex
+
 	// File logging
 	logFile            *os.File
 	logFileMutex       sync.Mutex
@@ -318,11 +322,34 @@ func (l *Logger) Warn(format string, args ...interface{}) {
 
 // Error logs an error message
 func (l *Logger) Error(format string, args ...interface{}) {
+	rememberError(l.prefix, fmt.Sprintf(format, args...))
 	if msg := l.formatMessage(LevelError, format, args...); msg != "" {
 		l.writeLog(msg)
 	}
 }
 
+// maxRecentErrors bounds the errors kept for RecentErrors
+const maxRecentErrors = 10
+
+// rememberError keeps an error message for RecentErrors
+func rememberError(prefix, message string) {
+	entry := fmt.Sprintf("%s [%s] %s", time.Now().UTC().Format(time.RFC3339), prefix, message)
+
+	recentErrorsMutex.Lock()
+	defer recentErrorsMutex.Unlock()
+	recentErrors = append(recentErrors, entry)
+	if len(recentErrors) > maxRecentErrors {
+		recentErrors = recentErrors[len(recentErrors)-maxRecentErrors:]
+	}
+}
+
+// RecentErrors returns the last errors logged by any logger, oldest first
+func RecentErrors() []string {
+	recentErrorsMutex.Lock()
+	defer recentErrorsMutex.Unlock()
+	return append([]string(nil), recentErrors...)
+}
+
 // isTerminal checks if stdout is a terminal
 func isTerminal() bool {
 	fileInfo, err := os.Stdout.Stat()
@@ -0,0 +1,296 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/votanchat/cloudflared-desktop-tunnel/network"
+)
+
+// Profiles are full configs stored side by side in the config directory:
+//
+//	config.json                  - the "default" profile
+//	profiles/<name>/config.json  - every other profile, with its own backups
+//	active-profile               - name of the profile in use
+const (
+	defaultProfileName    = "default"
+	profilesDirName       = "profiles"
+	activeProfileFileName = "active-profile"
+)
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 _.-]{0,63}$`)
+
+// ProfileInfo summarizes a configuration profile
+type ProfileInfo struct {
+	Name       string `json:"name"`
+	Active     bool   `json:"active"`
+	BackendURL string `json:"backendURL"`
+	TunnelName string `json:"tunnelName"`
+}
+
+// validateProfileName rejects names that are unsafe as a directory name
+func validateProfileName(name string) error {
+	if !profileNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q: use letters, digits, spaces, '.', '_' or '-' (max 64)", name)
+	}
+	return nil
+}
+
+// profileConfigPath returns the config file for the named profile
+func profileConfigPath(name string) (string, error) {
+	appConfigDir, err := getAppConfigDir()
+	if err != nil {
+		return "", err
+	}
+	if name == defaultProfileName {
+		return filepath.Join(appConfigDir, "config.json"), nil
+	}
+	if err := validateProfileName(name); err != nil {
+		return "", err
+	}
+
+	profileDir := filepath.Join(appConfigDir, profilesDirName, name)
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(profileDir, "config.json"), nil
+}
+
+// profileExists reports whether a profile has been created
+func profileExists(name string) bool {
+	if name == defaultProfileName {
+		return true
+	}
+	appConfigDir, err := getAppConfigDir()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(appConfigDir, profilesDirName, name, "config.json"))
+	return err == nil
+}
+
+// activeProfileName returns the profile in use, falling back to the default
+func activeProfileName() string {
+	appConfigDir, err := getAppConfigDir()
+	if err != nil {
+		return defaultProfileName
+	}
+	data, err := os.ReadFile(filepath.Join(appConfigDir, activeProfileFileName))
+	if err != nil {
+		return defaultProfileName
+	}
+	name := strings.TrimSpace(string(data))
+	if name == defaultProfileName || validateProfileName(name) != nil || !profileExists(name) {
+		return defaultProfileName
+	}
+	return name
+}
+
+// setActiveProfileName records the profile to load on the next start
+func setActiveProfileName(name string) error {
+	appConfigDir, err := getAppConfigDir()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(appConfigDir, activeProfileFileName), []byte(name+"\n"), 0644)
+}
+
+// ListProfiles returns every profile, the default one first
+func ListProfiles() ([]ProfileInfo, error) {
+	appConfigDir, err := getAppConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{defaultProfileName}
+	entries, err := os.ReadDir(filepath.Join(appConfigDir, profilesDirName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && validateProfileName(entry.Name()) == nil && profileExists(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	active := activeProfileName()
+	profiles := make([]ProfileInfo, 0, len(names))
+	for _, name := range names {
+		info := ProfileInfo{Name: name, Active: name == active}
+		if path, err := profileConfigPath(name); err == nil {
+			if config := readProfileConfig(path); config != nil {
+				info.BackendURL = config.BackendURL
+				info.TunnelName = config.TunnelName
+			}
+		}
+		profiles = append(profiles, info)
+	}
+	return profiles, nil
+}
+
+// readProfileConfig parses a profile's config for display without migrating,
+// recovering or saving it, or returns nil if it cannot be read
+func readProfileConfig(path string) *Config {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return DefaultConfig()
+	}
+	if err != nil {
+		return nil
+	}
+	config, _, err := parseConfig(data)
+	if err != nil {
+		return nil
+	}
+	return config
+}
+
+// CreateProfile creates a new profile with default settings
+func CreateProfile(name string) error {
+	if err := validateProfileName(name); err != nil {
+		return err
+	}
+	if profileExists(name) {
+		return fmt.Errorf("profile %q already exists", name)
+	}
+
+	path, err := profileConfigPath(name)
+	if err != nil {
+		return err
+	}
+	config := DefaultConfig()
+	config.path = path
+	return config.Save()
+}
+
+// CloneProfile creates a new profile as a copy of an existing one, without
+// its device identity or saved secrets
+func CloneProfile(source, name string) error {
+	if err := validateProfileName(name); err != nil {
+		return err
+	}
+	if !profileExists(source) {
+		return fmt.Errorf("profile %q does not exist", source)
+	}
+	if profileExists(name) {
+		return fmt.Errorf("profile %q already exists", name)
+	}
+
+	sourcePath, err := profileConfigPath(source)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfigFile(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to load profile %q: %w", source, err)
+	}
+
+	path, err := profileConfigPath(name)
+	if err != nil {
+		return err
+	}
+	clone := config.Clone()
+	clone.path = path
+	clone.recoveredFrom = ""
+
+	// The clone is a separate device, and secrets stay with the profile that
+	// saved them. A device ID is generated when the clone is activated.
+	clone.DeviceID = ""
+	clone.DeviceCredentialRef = ""
+	clone.LastTokenRef = ""
+	clone.ManualTokenRef = ""
+	clone.TokenSource.APITokenRef = ""
+	if clone.TokenSource.Type == TokenSourceStatic {
+		clone.TokenSource.Type = TokenSourceBackend
+	}
+	return clone.Save()
+}
+
+// DeleteProfile removes a profile and its backups. The default and active
+// profiles cannot be deleted.
+func DeleteProfile(name string) error {
+	if err := checkDeletableProfile(name); err != nil {
+		return err
+	}
+	appConfigDir, err := getAppConfigDir()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(appConfigDir, profilesDirName, name))
+}
+
+// checkDeletableProfile returns why a profile cannot be deleted, if it cannot
+func checkDeletableProfile(name string) error {
+	if name == defaultProfileName {
+		return fmt.Errorf("the default profile cannot be deleted")
+	}
+	if err := validateProfileName(name); err != nil {
+		return err
+	}
+	if name == activeProfileName() {
+		return fmt.Errorf("profile %q is active; activate another profile first", name)
+	}
+	if !profileExists(name) {
+		return fmt.Errorf("profile %q does not exist", name)
+	}
+	return nil
+}
+
+// releaseProfile unenrolls the device of an inactive profile from its
+// backend, warning if that fails, and deletes the secrets its config refers to
+func (a *App) releaseProfile(name string) error {
+	path, err := profileConfigPath(name)
+	if err != nil {
+		return err
+	}
+	config := readProfileConfig(path)
+	if config == nil {
+		appLogger.Warn("Profile %q could not be read; any secrets it saved are left in place", name)
+		return nil
+	}
+
+	if config.DeviceCredentialRef != "" {
+		if err := a.unenrollProfileDevice(config); err != nil {
+			appLogger.Warn("Failed to unenroll device %s of profile %q: %v", config.DeviceID, name, err)
+			a.addNotice(fmt.Sprintf("The device of profile %q could not be unenrolled from %s (%v); revoke device %s on the backend.",
+				name, config.BackendURL, err, config.DeviceID))
+		}
+	}
+
+	for _, ref := range []string{config.DeviceCredentialRef, config.ManualTokenRef, config.LastTokenRef, config.TokenSource.APITokenRef} {
+		if ref == "" {
+			continue
+		}
+		if err := a.deleteSecret(ref); err != nil {
+			return fmt.Errorf("failed to delete a secret saved by profile %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// unenrollProfileDevice revokes the device credential of an inactive profile
+// with that profile's backend and network settings
+func (a *App) unenrollProfileDevice(config *Config) error {
+	credential, err := a.resolveSecret(config.DeviceCredentialRef)
+	if err != nil {
+		return fmt.Errorf("failed to read device credential: %w", err)
+	}
+	opts := config.NetworkOptions()
+	transport, err := network.NewTransport(opts)
+	if err != nil {
+		return err
+	}
+	dialer, err := network.NewDialer(opts)
+	if err != nil {
+		return err
+	}
+
+	client := NewBackendClient(config.BackendURL)
+	client.SetEndpoints(config.BackendURLs())
+	client.SetNetwork(transport, dialer)
+	client.SetDeviceCredential(config.DeviceID, credential)
+	return client.Unenroll(config.DeviceID)
+}
@@ -0,0 +1,188 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/votanchat/cloudflared-desktop-tunnel/secrets"
+)
+
+const (
+	keyringService    = "cloudflared-desktop-tunnel"
+	secretsFileName   = "secrets.enc"
+	manualTokenSecret = "manual-token"
+)
+
+// SecretsStatus describes the secret stores and what is saved in them
+type SecretsStatus struct {
+	KeyringAvailable  bool   `json:"keyringAvailable"`
+	KeyringError      string `json:"keyringError"`
+	FileStoreExists   bool   `json:"fileStoreExists"`
+	FileStoreUnlocked bool   `json:"fileStoreUnlocked"`
+	Store             string `json:"store"` // Where new secrets are saved
+	ManualTokenSaved  bool   `json:"manualTokenSaved"`
+}
+
+// initSecretStores sets up the keyring and the encrypted file fallback
+func (a *App) initSecretStores() error {
+	a.keyring = secrets.NewKeyring(keyringService)
+
+	appConfigDir, err := getAppConfigDir()
+	if err != nil {
+		return err
+	}
+	a.secretFile = secrets.NewFileStore(filepath.Join(appConfigDir, secretsFileName))
+	return nil
+}
+
+// secretStore returns the store with the given name
+func (a *App) secretStore(name string) (secrets.Store, error) {
+	switch name {
+	case secrets.StoreKeyring:
+		if err := a.keyring.Available(); err != nil {
+			return nil, err
+		}
+		return a.keyring, nil
+	case secrets.StoreFile:
+		if !a.secretFile.Unlocked() {
+			return nil, fmt.Errorf("%w: enter the secret store passphrase in Settings first", secrets.ErrLocked)
+		}
+		return a.secretFile, nil
+	default:
+		return nil, fmt.Errorf("unknown secret store %q", name)
+	}
+}
+
+// preferredSecretStore returns the name of the store new secrets are saved
+// in: the configured one, else the keyring if it works, else the file
+func (a *App) preferredSecretStore() string {
+	if store := a.currentConfig().SecretStore; store != "" {
+		return store
+	}
+	if a.keyring.Available() == nil {
+		return secrets.StoreKeyring
+	}
+	return secrets.StoreFile
+}
+
+// resolveSecret returns the value a reference points at
+func (a *App) resolveSecret(ref string) (string, error) {
+	storeName, key, err := secrets.ParseRef(ref)
+	if err != nil {
+		return "", err
+	}
+	store, err := a.secretStore(storeName)
+	if err != nil {
+		return "", err
+	}
+	return store.Get(key)
+}
+
+// storeSecret saves value in the preferred store and returns its reference
+func (a *App) storeSecret(key, value string) (string, error) {
+	storeName := a.preferredSecretStore()
+	store, err := a.secretStore(storeName)
+	if err != nil {
+		return "", err
+	}
+	if err := store.Set(key, value); err != nil {
+		return "", fmt.Errorf("failed to save secret in %s: %w", storeName, err)
+	}
+	return secrets.FormatRef(storeName, key), nil
+}
+
+// deleteSecret removes the secret a reference points at. A secret that is
+// already gone is not an error.
+func (a *App) deleteSecret(ref string) error {
+	storeName, key, err := secrets.ParseRef(ref)
+	if err != nil {
+		return err
+	}
+	store, err := a.secretStore(storeName)
+	if err != nil {
+		return err
+	}
+	if err := store.Delete(key); err != nil && !errors.Is(err, secrets.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// GetSecretsStatus reports which secret stores are usable and whether a manual token is saved
+func (a *App) GetSecretsStatus() SecretsStatus {
+	status := SecretsStatus{
+		FileStoreExists:   a.secretFile.Exists(),
+		FileStoreUnlocked: a.secretFile.Unlocked(),
+		Store:             a.preferredSecretStore(),
+		ManualTokenSaved:  a.currentConfig().ManualTokenRef != "",
+	}
+	if err := a.keyring.Available(); err != nil {
+		status.KeyringError = err.Error()
+	} else {
+		status.KeyringAvailable = true
+	}
+	return status
+}
+
+// UnlockSecretStore opens the encrypted secret file with passphrase,
+// creating it on first use
+func (a *App) UnlockSecretStore(passphrase string) error {
+	if err := a.secretFile.Unlock(passphrase); err != nil {
+		return err
+	}
+	// The device credential may have been waiting for the passphrase
+	if a.currentConfig().DeviceCredentialRef != "" {
+		a.loadDeviceCredential()
+	}
+	return nil
+}
+
+// SaveManualToken stores a tunnel token so StartTunnel can use it without
+// pasting it again, and makes it the token source. config.json only records
+// where it is kept.
+func (a *App) SaveManualToken(token string) error {
+	if token == "" {
+		return fmt.Errorf("token must not be empty")
+	}
+
+	// One saved token per profile
+	ref, err := a.storeSecret(activeProfileName()+"/"+manualTokenSecret, token)
+	if err != nil {
+		return err
+	}
+
+	var old string
+	if err := a.updateConfig(func(c *Config) {
+		old = c.ManualTokenRef
+		c.ManualTokenRef = ref
+		c.TokenSource.Type = TokenSourceStatic
+	}); err != nil {
+		return err
+	}
+	if old != "" && old != ref {
+		if err := a.deleteSecret(old); err != nil {
+			appLogger.Warn("Failed to delete previous saved token: %v", err)
+		}
+	}
+	appLogger.Info("Saved manual token in %s", a.preferredSecretStore())
+	return nil
+}
+
+// ForgetManualToken deletes the saved manual token. If it was the token
+// source, the backend is used again.
+func (a *App) ForgetManualToken() error {
+	ref := a.currentConfig().ManualTokenRef
+	if ref == "" {
+		return nil
+	}
+	if err := a.deleteSecret(ref); err != nil {
+		return fmt.Errorf("failed to delete saved token: %w", err)
+	}
+	return a.updateConfig(func(c *Config) {
+		c.ManualTokenRef = ""
+		if c.TokenSource.Type == TokenSourceStatic {
+			c.TokenSource.Type = TokenSourceBackend
+		}
+	})
+}
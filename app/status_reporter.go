@@ -0,0 +1,247 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatInterval   = time.Minute
+	statusCheckInterval = 5 * time.Second // How often state changes are looked for
+	statusQueueFileName = "status_queue.json"
+	maxQueuedReports    = 200 // Oldest reports are dropped beyond this while offline
+)
+
+// Why a status report was sent
+const (
+	ReportReasonStartup     = "startup"
+	ReportReasonHeartbeat   = "heartbeat"
+	ReportReasonStateChange = "state_change"
+)
+
+// StatusReport is sent to the backend's /api/status endpoint
+type StatusReport struct {
+	DeviceID           string    `json:"deviceId"`
+	Time               time.Time `json:"time"`
+	Reason             string    `json:"reason"` // ReportReasonStartup, ReportReasonHeartbeat or ReportReasonStateChange
+	TunnelName         string    `json:"tunnelName"`
+	TunnelRunning      bool      `json:"tunnelRunning"`
+	Connections        int       `json:"connections"` // Edge connections registered by cloudflared
+	CloudflaredVersion string    `json:"cloudflaredVersion"`
+	AppVersion         string    `json:"appVersion"`
+	OS                 string    `json:"os"`
+	Arch               string    `json:"arch"`
+	UptimeSeconds      int64     `json:"uptimeSeconds"` // Since the app started
+	RoutesHash         string    `json:"routesHash"`    // Changes whenever the route list does
+	RecentErrors       []string  `json:"recentErrors"`
+}
+
+// statusState is the part of a report whose change triggers an immediate report
+type statusState struct {
+	tunnelName         string
+	tunnelRunning      bool
+	connections        int
+	cloudflaredVersion string
+	routesHash         string
+}
+
+func (r StatusReport) state() statusState {
+	return statusState{r.TunnelName, r.TunnelRunning, r.Connections, r.CloudflaredVersion, r.RoutesHash}
+}
+
+// statusQueue keeps reports that could not be sent, oldest first, in a file
+// so they survive a restart
+type statusQueue struct {
+	mu      sync.Mutex
+	path    string // "" = memory only
+	reports []StatusReport
+}
+
+// load reads the reports queued at path and saves to it from then on
+func (q *statusQueue) load(path string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read status queue: %w", err)
+	}
+	if err := json.Unmarshal(data, &q.reports); err != nil {
+		return fmt.Errorf("failed to parse status queue: %w", err)
+	}
+	return nil
+}
+
+// push queues a report, dropping the oldest beyond maxQueuedReports
+func (q *statusQueue) push(report StatusReport) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reports = append(q.reports, report)
+	if len(q.reports) > maxQueuedReports {
+		q.reports = append([]StatusReport(nil), q.reports[len(q.reports)-maxQueuedReports:]...)
+	}
+	return q.save()
+}
+
+// flush sends the queued reports in order, stopping at the first failure or
+// when ctx is cancelled. The queue is not locked while sending, so push does
+// not wait on the network.
+func (q *statusQueue) flush(ctx context.Context, send func(context.Context, StatusReport) error) error {
+	q.mu.Lock()
+	pending := append([]StatusReport(nil), q.reports...)
+	q.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	sent := 0
+	var err error
+	for _, report := range pending {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		if err = send(ctx, report); err != nil {
+			break
+		}
+		sent++
+	}
+	if sent == 0 {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// Only this loop removes reports, but push may have dropped the oldest
+	// ones meanwhile; remove those of ours that are still at the front
+	q.reports = q.reports[sentPrefix(q.reports, pending[:sent]):]
+	backendLogger.Info("Sent %d queued status reports, %d left", sent, len(q.reports))
+	if saveErr := q.save(); saveErr != nil {
+		backendLogger.Warn("Failed to save status queue: %v", saveErr)
+	}
+	return err
+}
+
+// sentPrefix returns how many leading reports of queue are among sent
+func sentPrefix(queue, sent []StatusReport) int {
+	n := 0
+	for n < len(queue) {
+		report := queue[n]
+		if !slices.ContainsFunc(sent, func(s StatusReport) bool {
+			return s.Time.Equal(report.Time) && s.Reason == report.Reason
+		}) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// save writes the queue to disk, removing the file when it is empty. Callers hold q.mu.
+func (q *statusQueue) save() error {
+	if q.path == "" {
+		return nil
+	}
+	if len(q.reports) == 0 {
+		if err := os.Remove(q.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(q.reports)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path, data, 0600)
+}
+
+// statusReport describes the current state of the app and tunnel
+func (a *App) statusReport(reason string) StatusReport {
+	config := a.currentConfig()
+	return StatusReport{
+		DeviceID:           config.DeviceID,
+		Time:               time.Now(),
+		Reason:             reason,
+		TunnelName:         config.TunnelName,
+		TunnelRunning:      a.tunnel.IsRunning(),
+		Connections:        a.tunnel.GetConnectionCount(),
+		CloudflaredVersion: a.updater.Status().CurrentVersion,
+		AppVersion:         Version,
+		OS:                 runtime.GOOS,
+		Arch:               runtime.GOARCH,
+		UptimeSeconds:      int64(time.Since(a.startedAt).Seconds()),
+		RoutesHash:         routesHash(config.Routes),
+		RecentErrors:       RecentErrors(),
+	}
+}
+
+// routesHash returns a short fingerprint of the route list
+func routesHash(routes []Route) string {
+	data, _ := json.Marshal(routes)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// reportStatusLoop sends a heartbeat every heartbeatInterval and a report as
+// soon as the tunnel state changes. Reports that cannot be sent are queued
+// on disk and go out in order once the backend is reachable again.
+func (a *App) reportStatusLoop(ctx context.Context) {
+	if appConfigDir, err := getAppConfigDir(); err == nil {
+		if err := a.statusQueue.load(filepath.Join(appConfigDir, statusQueueFileName)); err != nil {
+			backendLogger.Warn("Discarding queued status reports: %v", err)
+		}
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	check := time.NewTicker(statusCheckInterval)
+	defer check.Stop()
+
+	report := a.statusReport(ReportReasonStartup)
+	last := report.state()
+	a.sendStatus(ctx, report)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			report = a.statusReport(ReportReasonHeartbeat)
+		case <-check.C:
+			report = a.statusReport(ReportReasonStateChange)
+			if report.state() == last {
+				continue
+			}
+		}
+		last = report.state()
+		a.sendStatus(ctx, report)
+	}
+}
+
+// sendStatus sends report after any queued ones, or queues it if the backend is unreachable
+func (a *App) sendStatus(ctx context.Context, report StatusReport) {
+	err := a.statusQueue.flush(ctx, a.backendClient.ReportStatus)
+	if err == nil {
+		if err = a.backendClient.ReportStatus(ctx, report); err == nil {
+			return
+		}
+	}
+
+	backendLogger.Debug("Queueing %s status report: %v", report.Reason, err)
+	if err := a.statusQueue.push(report); err != nil {
+		backendLogger.Warn("Failed to save status queue: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+)
+
+const lastTokenSecret = "last-token"
+
+// cacheLastToken saves token as the last one the backend issued, if the
+// profile has Config.CacheLastToken set. It is used when the backend cannot
+// be reached to start the tunnel.
+func (a *App) cacheLastToken(token string) {
+	config := a.currentConfig()
+	if !config.CacheLastToken || config.TokenSource.Type != TokenSourceBackend || token == "" {
+		return
+	}
+	ref, err := a.storeSecret(activeProfileName()+"/"+lastTokenSecret, token)
+	if err != nil {
+		appLogger.Warn("Failed to cache the tunnel token: %v", err)
+		return
+	}
+	if ref == config.LastTokenRef {
+		return
+	}
+
+	var old string
+	if err := a.updateConfig(func(c *Config) {
+		old = c.LastTokenRef
+		c.LastTokenRef = ref
+	}); err != nil {
+		appLogger.Warn("Failed to save the cached token reference: %v", err)
+		return
+	}
+	if old != "" && old != ref {
+		if err := a.deleteSecret(old); err != nil {
+			appLogger.Warn("Failed to delete previous cached token: %v", err)
+		}
+	}
+}
+
+// cachedToken returns the last token the backend issued
+func (a *App) cachedToken() (string, error) {
+	config := a.currentConfig()
+	if !config.CacheLastToken {
+		return "", errors.New("token caching is disabled")
+	}
+	if config.LastTokenRef == "" {
+		return "", errors.New("no token has been cached yet")
+	}
+	token, err := a.resolveSecret(config.LastTokenRef)
+	if err != nil {
+		return "", fmt.Errorf("failed to read cached token: %w", err)
+	}
+	return token, nil
+}
+
+// forgetCachedToken deletes the cached token after caching was turned off
+func (a *App) forgetCachedToken() {
+	ref := a.currentConfig().LastTokenRef
+	if ref == "" {
+		return
+	}
+	if err := a.deleteSecret(ref); err != nil {
+		appLogger.Warn("Failed to delete cached token: %v", err)
+		return
+	}
+	if err := a.updateConfig(func(c *Config) { c.LastTokenRef = "" }); err != nil {
+		appLogger.Warn("Failed to save config after deleting the cached token: %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Token sources, see Config.TokenSource
+const (
+	TokenSourceBackend    = "backend"    // The backend's /api/token
+	TokenSourceStatic     = "static"     // The token saved with SaveManualToken
+	TokenSourceFile       = "file"       // A file holding the token
+	TokenSourceCommand    = "command"    // The output of a shell command, e.g. "vault read -field=token ..."
+	TokenSourceEnv        = "env"        // An environment variable
+	TokenSourceCloudflare = "cloudflare" // The Cloudflare API, by account and tunnel ID
+)
+
+var tokenSources = []string{
+	TokenSourceBackend, TokenSourceStatic, TokenSourceFile,
+	TokenSourceCommand, TokenSourceEnv, TokenSourceCloudflare,
+}
+
+const (
+	commandTokenTimeout      = 30 * time.Second
+	cloudflareAPIBaseURL     = "https://api.cloudflare.com/client/v4"
+	cloudflareAPITokenSecret = "cloudflare-api-token"
+)
+
+// TokenProvider supplies the token cloudflared runs the tunnel with
+type TokenProvider interface {
+	Token(ctx context.Context) (string, error)
+	Name() string // For logs, e.g. "file /etc/tunnel-token"
+}
+
+// StaticTokenProvider returns a token it was given
+type StaticTokenProvider struct {
+	Value string
+}
+
+func (p *StaticTokenProvider) Token(ctx context.Context) (string, error) {
+	if p.Value == "" {
+		return "", errors.New("no token was given")
+	}
+	return p.Value, nil
+}
+
+func (p *StaticTokenProvider) Name() string { return "saved token" }
+
+// BackendTokenProvider fetches the token from the backend's /api/token
+type BackendTokenProvider struct {
+	Client *BackendClient
+}
+
+func (p *BackendTokenProvider) Token(ctx context.Context) (string, error) {
+	return p.Client.FetchToken(ctx)
+}
+
+func (p *BackendTokenProvider) Name() string { return "backend" }
+
+// FileTokenProvider reads the token from a file, ignoring surrounding whitespace
+type FileTokenProvider struct {
+	Path string
+}
+
+func (p *FileTokenProvider) Token(ctx context.Context) (string, error) {
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", p.Path)
+	}
+	return token, nil
+}
+
+func (p *FileTokenProvider) Name() string { return "file " + p.Path }
+
+// CommandTokenProvider runs a shell command and uses what it prints
+type CommandTokenProvider struct {
+	Command string
+	Timeout time.Duration // 0 = commandTokenTimeout
+}
+
+func (p *CommandTokenProvider) Token(ctx context.Context) (string, error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = commandTokenTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", p.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", p.Command)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("token command timed out after %v", timeout)
+		}
+		return "", fmt.Errorf("token command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	token := strings.TrimSpace(stdout.String())
+	if token == "" {
+		return "", errors.New("token command printed nothing")
+	}
+	return token, nil
+}
+
+// Name leaves out the command line, which may carry credentials
+func (p *CommandTokenProvider) Name() string { return "command" }
+
+// EnvTokenProvider reads the token from an environment variable
+type EnvTokenProvider struct {
+	Var string
+}
+
+func (p *EnvTokenProvider) Token(ctx context.Context) (string, error) {
+	token := strings.TrimSpace(os.Getenv(p.Var))
+	if token == "" {
+		return "", fmt.Errorf("environment variable %s is not set", p.Var)
+	}
+	return token, nil
+}
+
+func (p *EnvTokenProvider) Name() string { return "environment variable " + p.Var }
+
+// CloudflareTokenProvider looks the tunnel token up with the Cloudflare API.
+// The API token needs the Cloudflare Tunnel Read permission.
+type CloudflareTokenProvider struct {
+	AccountID string
+	TunnelID  string
+	APIToken  string
+	Client    *http.Client
+	BaseURL   string // "" = cloudflareAPIBaseURL
+}
+
+// cloudflareResponse is the envelope of every Cloudflare API response
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (p *CloudflareTokenProvider) Token(ctx context.Context) (string, error) {
+	baseURL := p.BaseURL
+	if baseURL == "" {
+		baseURL = cloudflareAPIBaseURL
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	endpoint := fmt.Sprintf("%s/accounts/%s/cfd_tunnel/%s/token",
+		baseURL, url.PathEscape(p.AccountID), url.PathEscape(p.TunnelID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.APIToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach the Cloudflare API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Cloudflare API response: %w", err)
+	}
+	var cfResp cloudflareResponse
+	if err := json.Unmarshal(body, &cfResp); err != nil {
+		return "", fmt.Errorf("Cloudflare API returned status %d: %s", resp.StatusCode, string(body))
+	}
+	if !cfResp.Success {
+		messages := make([]string, 0, len(cfResp.Errors))
+		for _, e := range cfResp.Errors {
+			messages = append(messages, fmt.Sprintf("%s (code %d)", e.Message, e.Code))
+		}
+		return "", fmt.Errorf("Cloudflare API refused the request (status %d): %s", resp.StatusCode, strings.Join(messages, "; "))
+	}
+
+	var token string
+	if err := json.Unmarshal(cfResp.Result, &token); err != nil || token == "" {
+		return "", errors.New("Cloudflare API returned no tunnel token")
+	}
+	return token, nil
+}
+
+func (p *CloudflareTokenProvider) Name() string { return "Cloudflare API, tunnel " + p.TunnelID }
+
+// tokenProvider returns the provider selected by Config.TokenSource
+func (a *App) tokenProvider() (TokenProvider, error) {
+	config := a.currentConfig()
+	source := config.TokenSource
+	switch source.Type {
+	case TokenSourceBackend, "":
+		return &BackendTokenProvider{Client: a.backendClient}, nil
+
+	case TokenSourceStatic:
+		if config.ManualTokenRef == "" {
+			return nil, errors.New("no token is saved; start the tunnel with a token and remember it")
+		}
+		token, err := a.resolveSecret(config.ManualTokenRef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read saved token: %w", err)
+		}
+		return &StaticTokenProvider{Value: token}, nil
+
+	case TokenSourceFile:
+		return &FileTokenProvider{Path: source.Path}, nil
+
+	case TokenSourceCommand:
+		return &CommandTokenProvider{Command: source.Command}, nil
+
+	case TokenSourceEnv:
+		return &EnvTokenProvider{Var: source.EnvVar}, nil
+
+	case TokenSourceCloudflare:
+		if source.APITokenRef == "" {
+			return nil, errors.New("no Cloudflare API token is saved")
+		}
+		apiToken, err := a.resolveSecret(source.APITokenRef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Cloudflare API token: %w", err)
+		}
+		client := &http.Client{Timeout: 30 * time.Second}
+		if transport := a.httpTransport.Load(); transport != nil {
+			client.Transport = transport
+		}
+		return &CloudflareTokenProvider{
+			AccountID: source.AccountID,
+			TunnelID:  source.TunnelID,
+			APIToken:  apiToken,
+			Client:    client,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown token source %q", source.Type)
+	}
+}
+
+// SaveCloudflareAPIToken stores the API token the Cloudflare token source
+// uses. config.json only records where it is kept.
+func (a *App) SaveCloudflareAPIToken(token string) error {
+	if token == "" {
+		return fmt.Errorf("API token must not be empty")
+	}
+	ref, err := a.storeSecret(activeProfileName()+"/"+cloudflareAPITokenSecret, token)
+	if err != nil {
+		return err
+	}
+
+	var old string
+	if err := a.updateConfig(func(c *Config) {
+		old = c.TokenSource.APITokenRef
+		c.TokenSource.APITokenRef = ref
+	}); err != nil {
+		return err
+	}
+	if old != "" && old != ref {
+		if err := a.deleteSecret(old); err != nil {
+			appLogger.Warn("Failed to delete previous Cloudflare API token: %v", err)
+		}
+	}
+	appLogger.Info("Saved Cloudflare API token in %s", a.preferredSecretStore())
+	return nil
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultTokenRefreshInterval = 5 * time.Minute
+	tokenExpiryMargin           = 2 * time.Minute  // Refresh this long before a token expires
+	minTokenRefreshDelay        = 10 * time.Second // Never refresh more often than this
+	tokenRetryBaseDelay         = 15 * time.Second // First retry after a failed refresh, doubled per failure
+	maxTokenRetryDelay          = 5 * time.Minute
+)
+
+// TokenStatus describes the backend token and its refresh schedule
+type TokenStatus struct {
+	LastRefresh time.Time `json:"lastRefresh"`
+	ExpiresAt   time.Time `json:"expiresAt"` // Zero if the backend gave no expiry
+	NextRefresh time.Time `json:"nextRefresh"`
+	LastError   string    `json:"lastError"`
+	Failures    int       `json:"failures"` // Consecutive failed refreshes
+}
+
+// SetRefreshInterval sets how often the token is refreshed when the backend
+// gives no expiry. An interval <= 0 uses the default.
+func (bc *BackendClient) SetRefreshInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultTokenRefreshInterval
+	}
+	bc.mu.Lock()
+	bc.refreshInterval = interval
+	bc.mu.Unlock()
+	bc.rescheduleRefresh()
+}
+
+// TokenStatus returns the token refresh state
+func (bc *BackendClient) TokenStatus() TokenStatus {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.tokenStatus
+}
+
+// rescheduleRefresh wakes the refresh loop so it recomputes its schedule
+func (bc *BackendClient) rescheduleRefresh() {
+	select {
+	case bc.refreshKick <- struct{}{}:
+	default:
+	}
+}
+
+// tokenRefreshLoop refreshes the token ahead of its expiry, or every refresh
+// interval if it has none, retrying failures with exponential backoff
+func (bc *BackendClient) tokenRefreshLoop(ctx context.Context) {
+	for {
+		bc.mu.Lock()
+		delay := refreshDelay(bc.clock.Now(), bc.tokenStatus, bc.refreshInterval)
+		bc.tokenStatus.NextRefresh = bc.clock.Now().Add(delay)
+		bc.mu.Unlock()
+
+		timer := bc.clock.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-bc.refreshKick:
+			timer.Stop()
+			continue
+		case <-timer.C():
+		}
+
+		if _, err := bc.fetchToken(ctx); err != nil {
+			backendLogger.Error("Failed to refresh token: %v", err)
+		}
+	}
+}
+
+// refreshDelay returns how long to wait before the next refresh attempt
+func refreshDelay(now time.Time, status TokenStatus, interval time.Duration) time.Duration {
+	if interval <= 0 {
+		interval = defaultTokenRefreshInterval
+	}
+
+	var delay time.Duration
+	switch {
+	case status.Failures > 0:
+		delay = tokenRetryBaseDelay << (status.Failures - 1)
+		if delay > maxTokenRetryDelay || delay <= 0 {
+			delay = maxTokenRetryDelay
+		}
+	case !status.ExpiresAt.IsZero():
+		remaining := status.ExpiresAt.Sub(now)
+		delay = remaining - tokenExpiryMargin
+		// Short-lived tokens would leave no time at all; use half their lifetime
+		if remaining < 2*tokenExpiryMargin {
+			delay = remaining / 2
+		}
+	case status.LastRefresh.IsZero():
+		delay = interval
+	default:
+		delay = status.LastRefresh.Add(interval).Sub(now)
+	}
+
+	if delay < minTokenRefreshDelay {
+		delay = minTokenRefreshDelay
+	}
+	return delay
+}
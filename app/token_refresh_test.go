@@ -0,0 +1,211 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	created chan struct{} // Signalled whenever a timer is created
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	c     chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		created: make(chan struct{}, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.created <- struct{}{}
+	return t
+}
+
+// Advance moves the clock forward and fires the timers that are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+// waitForTimer blocks until the code under test has scheduled its next timer
+func (c *fakeClock) waitForTimer(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.created:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a timer to be scheduled")
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// tokenServer serves /api/token with the scripted status codes and expiries
+type tokenServer struct {
+	mu       sync.Mutex
+	clock    *fakeClock
+	lifetime time.Duration // 0 = no expiry in the response
+	fail     bool
+	requests int
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	resp := TokenResponse{Token: "token"}
+	if s.lifetime > 0 {
+		resp.ExpiresAt = s.clock.Now().Add(s.lifetime)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *tokenServer) set(lifetime time.Duration, fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lifetime, s.fail = lifetime, fail
+}
+
+func (s *tokenServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func TestTokenRefreshSchedule(t *testing.T) {
+	clock := newFakeClock()
+	server := &tokenServer{clock: clock, lifetime: 30 * time.Minute}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	bc := NewBackendClient(ts.URL)
+	bc.clock = clock
+	bc.refreshInterval = 10 * time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bc.tokenRefreshLoop(ctx)
+
+	// No token yet: the first refresh waits for the interval
+	clock.waitForTimer(t)
+	if got, want := bc.TokenStatus().NextRefresh, clock.Now().Add(10*time.Minute); !got.Equal(want) {
+		t.Fatalf("first NextRefresh = %v, want %v", got, want)
+	}
+
+	// A token with an expiry is refreshed the safety margin before it
+	clock.Advance(10 * time.Minute)
+	clock.waitForTimer(t)
+	status := bc.TokenStatus()
+	if server.count() != 1 || status.LastError != "" {
+		t.Fatalf("after first refresh: requests=%d status=%+v", server.count(), status)
+	}
+	if want := status.ExpiresAt.Add(-tokenExpiryMargin); !status.NextRefresh.Equal(want) {
+		t.Fatalf("NextRefresh = %v, want %v (expiry minus margin)", status.NextRefresh, want)
+	}
+
+	// Failures are retried with doubling delays and reported in the status
+	server.set(30*time.Minute, true)
+	clock.Advance(28 * time.Minute)
+	clock.waitForTimer(t)
+	status = bc.TokenStatus()
+	if status.LastError == "" || status.Failures != 1 {
+		t.Fatalf("after failure: status=%+v", status)
+	}
+	if want := clock.Now().Add(tokenRetryBaseDelay); !status.NextRefresh.Equal(want) {
+		t.Fatalf("first retry at %v, want %v", status.NextRefresh, want)
+	}
+
+	clock.Advance(tokenRetryBaseDelay)
+	clock.waitForTimer(t)
+	if want := clock.Now().Add(2 * tokenRetryBaseDelay); !bc.TokenStatus().NextRefresh.Equal(want) {
+		t.Fatalf("second retry at %v, want %v", bc.TokenStatus().NextRefresh, want)
+	}
+
+	// Recovery clears the error; without an expiry the interval applies again
+	server.set(0, false)
+	clock.Advance(2 * tokenRetryBaseDelay)
+	clock.waitForTimer(t)
+	status = bc.TokenStatus()
+	if status.LastError != "" || status.Failures != 0 {
+		t.Fatalf("after recovery: status=%+v", status)
+	}
+	if want := clock.Now().Add(10 * time.Minute); !status.NextRefresh.Equal(want) {
+		t.Fatalf("NextRefresh without expiry = %v, want %v", status.NextRefresh, want)
+	}
+	if server.count() != 4 {
+		t.Fatalf("requests = %d, want 4", server.count())
+	}
+}
+
+func TestRefreshDelay(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		status TokenStatus
+		want   time.Duration
+	}{
+		{"no token yet", TokenStatus{}, 10 * time.Minute},
+		{"interval since last refresh", TokenStatus{LastRefresh: now.Add(-4 * time.Minute)}, 6 * time.Minute},
+		{"expiry minus margin", TokenStatus{ExpiresAt: now.Add(time.Hour)}, time.Hour - tokenExpiryMargin},
+		{"short-lived token", TokenStatus{ExpiresAt: now.Add(3 * time.Minute)}, 90 * time.Second},
+		{"already expired", TokenStatus{ExpiresAt: now.Add(-time.Minute)}, minTokenRefreshDelay},
+		{"backoff capped", TokenStatus{Failures: 20}, maxTokenRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := refreshDelay(now, tt.status, 10*time.Minute); got != tt.want {
+			t.Errorf("%s: refreshDelay = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
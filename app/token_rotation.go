@@ -0,0 +1,82 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Token rotation policies, see Config.TokenRotation
+const (
+	TokenRotationSeamless = "seamless" // Hand over to a new cloudflared, then stop the old one
+	TokenRotationRestart  = "restart"  // Stop the tunnel and start it again with the new token
+	TokenRotationManual   = "manual"   // Only tell the user; the new token is used on the next start
+)
+
+// tunnelCredentials are the fields of a cloudflared tunnel token, which is
+// base64-encoded JSON
+type tunnelCredentials struct {
+	AccountTag   string `json:"a"`
+	TunnelID     string `json:"t"`
+	TunnelSecret string `json:"s"`
+}
+
+// decodeTunnelToken returns the credentials in token, or false if it is not
+// in the cloudflared format
+func decodeTunnelToken(token string) (tunnelCredentials, bool) {
+	token = strings.TrimSpace(token)
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		data, err := enc.DecodeString(token)
+		if err != nil {
+			continue
+		}
+		var creds tunnelCredentials
+		if json.Unmarshal(data, &creds) == nil && creds.TunnelID != "" {
+			return creds, true
+		}
+	}
+	return tunnelCredentials{}, false
+}
+
+// sameTunnelToken reports whether two tokens carry the same credentials, so
+// a re-encoded token does not restart the tunnel
+func sameTunnelToken(a, b string) bool {
+	if a == b {
+		return true
+	}
+	credsA, okA := decodeTunnelToken(a)
+	credsB, okB := decodeTunnelToken(b)
+	return okA && okB && credsA == credsB
+}
+
+// handleTokenChanged applies a rotated backend token to a tunnel running with
+// an earlier backend token, fresh or cached, according to Config.TokenRotation
+func (a *App) handleTokenChanged(newToken string) {
+	// Leave tunnels started with a manual token or another source, or already restarted, alone
+	if !a.tunnel.IsRunning() || !a.backendToken.Load() || sameTunnelToken(a.tunnel.GetToken(), newToken) {
+		return
+	}
+
+	switch a.currentConfig().TokenRotation {
+	case TokenRotationManual:
+		appLogger.Info("Tunnel token rotated; keeping the running tunnel (policy %q)", TokenRotationManual)
+		a.addNotice("The backend issued a new tunnel token. Restart the tunnel to start using it.")
+	case TokenRotationRestart:
+		appLogger.Info("Tunnel token rotated; restarting the tunnel")
+		if err := a.tunnel.Stop(); err != nil {
+			appLogger.Error("Failed to stop tunnel for token rotation: %v", err)
+			return
+		}
+		if err := a.tunnel.Start(newToken); err != nil {
+			appLogger.Error("Failed to restart tunnel with the new token: %v", err)
+			a.addNotice(fmt.Sprintf("The tunnel could not be restarted with the new token: %v", err))
+		}
+	default:
+		appLogger.Info("Tunnel token rotated; handing over to a new tunnel process")
+		if err := a.tunnel.Replace(newToken, upgradeReadyTimeout); err != nil {
+			appLogger.Error("Seamless token rotation failed: %v", err)
+			a.addNotice(fmt.Sprintf("The tunnel is still using the previous token: %v", err))
+		}
+	}
+}
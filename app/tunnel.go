@@ -2,6 +2,7 @@ package app
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -10,23 +11,40 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/votanchat/cloudflared-desktop-tunnel/binaries"
+	"github.com/votanchat/cloudflared-desktop-tunnel/network"
 )
 
 // OnTunnelStart is a callback function when tunnel starts successfully
 type OnTunnelStart func() error
 
+// OnUpgradeResult is called once a staged cloudflared version has either
+// become ready (err == nil) or been rolled back
+type OnUpgradeResult func(version string, err error)
+
+// upgradeReadyTimeout bounds how long a staged binary has to register a connection
+const upgradeReadyTimeout = 60 * time.Second
+
 // TunnelManager manages the cloudflared tunnel process
 type TunnelManager struct {
-	mu            sync.RWMutex
-	running       bool
-	cmd           *exec.Cmd
-	tunnelName    string
-	logs          []string
-	binaryPath    string        // Cached binary path
-	config        *Config       // Reference to config for routes
-	onTunnelStart OnTunnelStart // Callback when tunnel starts
+	mu                 sync.RWMutex
+	running            bool
+	cmd                *exec.Cmd
+	done               chan struct{} // Closed when the current process exits
+	tunnelName         string
+	logs               []string
+	connections        int             // Edge connections registered by the current process
+	pendingCmd         *exec.Cmd       // Replacement process during a Replace handover
+	pendingConnections int             // Edge connections registered by pendingCmd
+	token              string          // Token the current process was started with
+	stops              int             // Incremented by every Stop, so background work can tell it was stopped on purpose
+	closed             bool            // Set by Shutdown; no process is started afterwards
+	binaryPath         string          // Cached binary path
+	config             *Config         // Reference to config for routes
+	onTunnelStart      OnTunnelStart   // Callback when tunnel starts
+	onUpgradeResult    OnUpgradeResult // Callback when a staged upgrade succeeds or rolls back
 }
 
 // NewTunnelManager creates a new tunnel manager
@@ -44,6 +62,13 @@ func (tm *TunnelManager) SetConfig(config *Config) {
 	tm.config = config
 }
 
+// SetTunnelName updates the tunnel name; it takes effect on the next start
+func (tm *TunnelManager) SetTunnelName(name string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.tunnelName = name
+}
+
 // SetOnTunnelStart sets the callback function to be called when tunnel starts successfully
 func (tm *TunnelManager) SetOnTunnelStart(callback OnTunnelStart) {
 	tm.mu.Lock()
@@ -51,82 +76,287 @@ func (tm *TunnelManager) SetOnTunnelStart(callback OnTunnelStart) {
 	tm.onTunnelStart = callback
 }
 
-// Start starts the cloudflared tunnel with the given token
-func (tm *TunnelManager) Start(token string) error {
+// SetOnUpgradeResult sets the callback invoked when a staged cloudflared upgrade is verified or rolled back
+func (tm *TunnelManager) SetOnUpgradeResult(callback OnUpgradeResult) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
+	tm.onUpgradeResult = callback
+}
 
-	if tm.running {
+// Start starts the cloudflared tunnel with the given token
+func (tm *TunnelManager) Start(token string) error {
+	if tm.IsRunning() {
 		return fmt.Errorf("tunnel is already running")
 	}
 
-	binaryPath, err := tm.ensureBinary()
+	// Resolved without tm.mu: a first start may spend minutes downloading
+	binaryPath, stagedVersion, err := tm.ensureBinary(context.Background())
 	if err != nil {
 		return fmt.Errorf("failed to prepare binary: %w", err)
 	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tm.closed {
+		return fmt.Errorf("tunnel manager is shut down")
+	}
+	if tm.running {
+		return fmt.Errorf("tunnel is already running")
+	}
 	tm.binaryPath = binaryPath
 
 	tunnelLogger.Info("Using cloudflared binary: %s", binaryPath)
 	tunnelLogger.Debug("Runtime: GOOS=%s, GOARCH=%s", runtime.GOOS, runtime.GOARCH)
 	tunnelLogger.Info("Using token mode (routes managed via Cloudflare Dashboard)")
 
-	tm.cmd = exec.Command(binaryPath, "tunnel", "run", "--token", token)
+	cmd, done, err := tm.spawn(binaryPath, token)
+	if err != nil {
+		return err
+	}
+
+	tm.cmd = cmd
+	tm.done = done
+	tm.running = true
+	tm.token = token
+	tm.connections = 0
+	tunnelLogger.Info("Tunnel started with PID %d", cmd.Process.Pid)
+
+	if stagedVersion != "" {
+		go tm.verifyStagedBinary(cmd, tm.stops, stagedVersion, token)
+	}
+
+	if tm.onTunnelStart != nil {
+		go func() {
+			if err := tm.onTunnelStart(); err != nil {
+				tunnelLogger.Error("Error in onTunnelStart callback: %v", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// spawn starts a cloudflared process and begins collecting its logs. Callers
+// hold tm.mu and must record cmd as current or pending before unlocking.
+func (tm *TunnelManager) spawn(binaryPath, token string) (*exec.Cmd, chan struct{}, error) {
+	cmd := exec.Command(binaryPath, "tunnel", "run", "--token", token)
+
+	// cloudflared cannot proxy edge connections, but its HTTP clients honor the proxy env
+	if tm.config != nil {
+		if proxyEnv := network.ProxyEnv(tm.config.NetworkOptions()); len(proxyEnv) > 0 {
+			cmd.Env = append(os.Environ(), proxyEnv...)
+		}
+	}
 
 	// Capture stdout and stderr
-	stdout, err := tm.cmd.StdoutPipe()
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %w", err)
+		return nil, nil, fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
 
-	stderr, err := tm.cmd.StderrPipe()
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %w", err)
+		return nil, nil, fmt.Errorf("failed to create stderr pipe: %w", err)
 	}
 
 	// Start the process
-	if err := tm.cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start tunnel: %w", err)
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to start tunnel: %w", err)
 	}
 
-	tm.running = true
-	tunnelLogger.Info("Tunnel started with PID %d", tm.cmd.Process.Pid)
+	done := make(chan struct{})
+	go tm.readLogs(stdout, "stdout", cmd)
+	go tm.readLogs(stderr, "stderr", cmd)
+	go tm.monitorProcess(cmd, done)
 
-	go tm.readLogs(stdout, "stdout")
-	go tm.readLogs(stderr, "stderr")
-	go tm.monitorProcess()
+	return cmd, done, nil
+}
 
-	if tm.onTunnelStart != nil {
-		go func() {
-			if err := tm.onTunnelStart(); err != nil {
-				tunnelLogger.Error("Error in onTunnelStart callback: %v", err)
-			}
-		}()
+// Replace hands the running tunnel over to a new cloudflared process started
+// with token. The old process keeps serving until the new one has registered
+// an edge connection, so traffic is not interrupted. If the new process does
+// not become ready within timeout it is stopped and the old one is kept.
+func (tm *TunnelManager) Replace(token string, timeout time.Duration) error {
+	tm.mu.Lock()
+	if !tm.running {
+		tm.mu.Unlock()
+		return fmt.Errorf("tunnel is not running")
+	}
+	if tm.pendingCmd != nil {
+		tm.mu.Unlock()
+		return fmt.Errorf("a tunnel handover is already in progress")
+	}
+
+	cmd, done, err := tm.spawn(tm.binaryPath, token)
+	if err != nil {
+		tm.mu.Unlock()
+		return err
+	}
+	tm.pendingCmd = cmd
+	tm.pendingConnections = 0
+	tm.mu.Unlock()
+	tunnelLogger.Info("Started replacement tunnel process with PID %d", cmd.Process.Pid)
+
+	err = tm.waitPendingReady(cmd, done, timeout)
+
+	tm.mu.Lock()
+	tm.pendingCmd = nil
+	if err != nil {
+		tm.mu.Unlock()
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("replacement tunnel did not become ready, keeping the current one: %w", err)
 	}
 
+	oldCmd, oldDone := tm.cmd, tm.done
+	tm.cmd = cmd
+	tm.done = done
+	tm.running = true
+	tm.token = token
+	tm.connections = tm.pendingConnections
+	tm.mu.Unlock()
+
+	// monitorProcess ignores the old process now that it is no longer current
+	if oldCmd != nil && oldCmd.Process != nil {
+		oldCmd.Process.Kill()
+		<-oldDone
+	}
+	tunnelLogger.Info("Tunnel handed over to PID %d", cmd.Process.Pid)
 	return nil
 }
 
+// waitPendingReady blocks until the pending process registers an edge connection
+func (tm *TunnelManager) waitPendingReady(cmd *exec.Cmd, done chan struct{}, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		tm.mu.RLock()
+		ready := tm.pendingCmd == cmd && tm.pendingConnections > 0
+		tm.mu.RUnlock()
+		if ready {
+			return nil
+		}
+
+		select {
+		case <-done:
+			return fmt.Errorf("process exited before becoming ready")
+		case <-deadline:
+			return fmt.Errorf("not ready after %v", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
 // Stop stops the cloudflared tunnel
 func (tm *TunnelManager) Stop() error {
 	tm.mu.Lock()
-	defer tm.mu.Unlock()
+	tm.stops++
 
 	if !tm.running {
+		tm.mu.Unlock()
 		return fmt.Errorf("tunnel is not running")
 	}
 
+	done := tm.done
 	if tm.cmd != nil && tm.cmd.Process != nil {
 		if err := tm.cmd.Process.Kill(); err != nil {
+			tm.mu.Unlock()
 			return fmt.Errorf("failed to kill process: %w", err)
 		}
-		tm.cmd.Wait() // Wait for process to exit
+	}
+	// Abort a handover in progress; Replace sees its process exit
+	if tm.pendingCmd != nil && tm.pendingCmd.Process != nil {
+		tm.pendingCmd.Process.Kill()
+	}
+	tm.mu.Unlock()
+
+	// monitorProcess reaps the process and clears the running flag
+	if done != nil {
+		<-done
 	}
 
-	tm.running = false
 	tunnelLogger.Info("Tunnel stopped")
 	return nil
 }
 
+// Shutdown stops the tunnel if it is running and keeps it from being started
+// again, including by a rollback in progress
+func (tm *TunnelManager) Shutdown() error {
+	tm.mu.Lock()
+	tm.closed = true
+	tm.stops++
+	running := tm.running
+	tm.mu.Unlock()
+
+	if !running {
+		return nil
+	}
+	return tm.Stop()
+}
+
+// Restart stops the tunnel if it is running and starts it again with the last token
+func (tm *TunnelManager) Restart() error {
+	tm.mu.RLock()
+	token := tm.token
+	tm.mu.RUnlock()
+
+	if token == "" {
+		return fmt.Errorf("tunnel has not been started yet")
+	}
+
+	if tm.IsRunning() {
+		if err := tm.Stop(); err != nil {
+			return err
+		}
+	}
+	return tm.Start(token)
+}
+
+// WaitReady blocks until cloudflared has registered at least one edge connection
+func (tm *TunnelManager) WaitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		tm.mu.RLock()
+		running, connections := tm.running, tm.connections
+		tm.mu.RUnlock()
+
+		if connections > 0 {
+			return nil
+		}
+		if !running {
+			return fmt.Errorf("tunnel exited before becoming ready")
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tunnel not ready after %v", timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// GetConnectionCount returns the number of edge connections registered by the current process
+func (tm *TunnelManager) GetConnectionCount() int {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.connections
+}
+
+// GetToken returns the token the current process was started with
+func (tm *TunnelManager) GetToken() string {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.token
+}
+
+// GetBinaryPath returns the cloudflared binary used by the last start
+func (tm *TunnelManager) GetBinaryPath() string {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.binaryPath
+}
+
 // IsRunning returns true if the tunnel is currently running
 func (tm *TunnelManager) IsRunning() bool {
 	tm.mu.RLock()
@@ -177,39 +407,89 @@ func (tm *TunnelManager) GetTunnelURL() string {
 	return ""
 }
 
-// ensureBinary ensures the cloudflared binary is downloaded and ready to use
-func (tm *TunnelManager) ensureBinary() (string, error) {
-	if tm.binaryPath != "" {
-		if _, err := os.Stat(tm.binaryPath); err == nil {
-			if tm.isBinaryValid(tm.binaryPath) {
-				tunnelLogger.Debug("Using cached binary: %s", tm.binaryPath)
-				return tm.binaryPath, nil
-			}
-			tunnelLogger.Warn("Cached binary is invalid, will re-download")
-		} else {
-			tunnelLogger.Debug("Cached binary not found, will download")
-		}
-	}
-
+// ensureBinary ensures the cloudflared binary is downloaded and ready to use.
+// If an upgrade is staged its binary is returned along with its version so the
+// caller can verify it.
+func (tm *TunnelManager) ensureBinary(ctx context.Context) (string, string, error) {
 	cacheDir, err := getCacheDir()
 	if err != nil {
-		return "", fmt.Errorf("failed to get cache dir: %w", err)
+		return "", "", fmt.Errorf("failed to get cache dir: %w", err)
 	}
 
 	// Set logger for binaries package
 	binaries.SetLogger(binaryLogger)
 
-	binaryPath, err := binaries.DownloadCloudflared(cacheDir)
+	if staged := binaries.StagedVersion(cacheDir); staged != "" {
+		stagedPath := binaries.VersionPath(cacheDir, staged)
+		if tm.isBinaryValid(stagedPath) {
+			tunnelLogger.Info("Trying staged cloudflared %s", staged)
+			return stagedPath, staged, nil
+		}
+		tunnelLogger.Warn("Staged cloudflared %s is invalid, discarding", staged)
+		binaries.ClearStagedVersion(cacheDir)
+	}
+
+	binaryPath, err := binaries.DownloadCloudflared(ctx, cacheDir)
 	if err != nil {
-		return "", fmt.Errorf("failed to download binary: %w", err)
+		return "", "", fmt.Errorf("failed to download binary: %w", err)
 	}
 
 	if !tm.isBinaryValid(binaryPath) {
 		os.Remove(binaryPath)
-		return "", fmt.Errorf("downloaded binary is not valid or not executable")
+		return "", "", fmt.Errorf("downloaded binary is not valid or not executable")
 	}
 
-	return binaryPath, nil
+	return binaryPath, "", nil
+}
+
+// verifyStagedBinary promotes a staged cloudflared version once it becomes
+// ready, or rolls back to the active version and restarts if it does not.
+// stops is tm.stops when cmd was started.
+func (tm *TunnelManager) verifyStagedBinary(cmd *exec.Cmd, stops int, version, token string) {
+	err := tm.WaitReady(upgradeReadyTimeout)
+
+	tm.mu.RLock()
+	superseded := tm.cmd != cmd || tm.stops != stops
+	callback := tm.onUpgradeResult
+	tm.mu.RUnlock()
+
+	// The user stopped or restarted the tunnel meanwhile; try again next start
+	if superseded {
+		return
+	}
+
+	cacheDir, cacheErr := getCacheDir()
+	if cacheErr != nil {
+		tunnelLogger.Error("Failed to get cache dir: %v", cacheErr)
+		return
+	}
+	binaries.ClearStagedVersion(cacheDir)
+
+	if err == nil {
+		if err := binaries.SetActiveVersion(cacheDir, version); err != nil {
+			tunnelLogger.Error("Failed to activate cloudflared %s: %v", version, err)
+		} else {
+			tunnelLogger.Info("Upgraded cloudflared to %s", version)
+		}
+		if callback != nil {
+			callback(version, nil)
+		}
+		return
+	}
+
+	tunnelLogger.Error("Staged cloudflared %s failed readiness: %v, rolling back", version, err)
+	if callback != nil {
+		callback(version, err)
+	}
+
+	if tm.IsRunning() {
+		if err := tm.Stop(); err != nil {
+			tunnelLogger.Error("Failed to stop staged cloudflared: %v", err)
+		}
+	}
+	if err := tm.Start(token); err != nil {
+		tunnelLogger.Error("Failed to restart tunnel after rollback: %v", err)
+	}
 }
 
 // isBinaryValid checks if the binary file is valid and executable
@@ -270,8 +550,8 @@ func getCacheDir() (string, error) {
 	return cacheDir, nil
 }
 
-// readLogs reads logs from the given pipe and stores them
-func (tm *TunnelManager) readLogs(pipe io.ReadCloser, source string) {
+// readLogs reads logs from the given pipe of cmd and stores them
+func (tm *TunnelManager) readLogs(pipe io.ReadCloser, source string, cmd *exec.Cmd) {
 	defer pipe.Close()
 
 	scanner := bufio.NewScanner(pipe)
@@ -286,6 +566,14 @@ func (tm *TunnelManager) readLogs(pipe io.ReadCloser, source string) {
 		tunnelLogger.Debug("[%s] %s", source, line)
 
 		tm.mu.Lock()
+		if strings.Contains(line, "Registered tunnel connection") {
+			switch cmd {
+			case tm.cmd:
+				tm.connections++
+			case tm.pendingCmd:
+				tm.pendingConnections++
+			}
+		}
 		tm.logs = append(tm.logs, line)
 		if len(tm.logs) > maxLogLines {
 			tm.logs = tm.logs[len(tm.logs)-maxLogLines:]
@@ -299,12 +587,17 @@ func (tm *TunnelManager) readLogs(pipe io.ReadCloser, source string) {
 }
 
 // monitorProcess monitors the tunnel process and handles exit
-func (tm *TunnelManager) monitorProcess() {
-	err := tm.cmd.Wait()
+func (tm *TunnelManager) monitorProcess(cmd *exec.Cmd, done chan struct{}) {
+	err := cmd.Wait()
+	defer close(done)
 
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
+	// A newer process may already have replaced this one
+	if tm.cmd != cmd {
+		return
+	}
 	tm.running = false
 
 	if err != nil {
@@ -315,10 +608,60 @@ func (tm *TunnelManager) monitorProcess() {
 	}
 }
 
-// Cleanup should be called when the app is shutting down to clean up cached binary
-func (tm *TunnelManager) Cleanup() {
-	if tm.binaryPath != "" {
-		tunnelLogger.Debug("Cleaning up cached binary: %s", tm.binaryPath)
-		os.Remove(tm.binaryPath)
+// cachePolicy builds the binary cache policy from the current config
+func (tm *TunnelManager) cachePolicy() binaries.CachePolicy {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	if tm.config == nil {
+		return binaries.CachePolicy{}
+	}
+	return binaries.CachePolicy{
+		KeepPrevious: tm.config.CacheKeepVersions,
+		MaxSizeBytes: int64(tm.config.CacheMaxSizeMB) * 1024 * 1024,
+	}
+}
+
+// PruneBinaryCache removes cached cloudflared versions outside the configured policy
+func (tm *TunnelManager) PruneBinaryCache() error {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return fmt.Errorf("failed to get cache dir: %w", err)
+	}
+	binaries.SetLogger(binaryLogger)
+	return binaries.PruneCache(cacheDir, tm.cachePolicy())
+}
+
+// ClearBinaryCache removes all cached cloudflared versions, except the one in
+// use if the tunnel is running
+func (tm *TunnelManager) ClearBinaryCache() error {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return fmt.Errorf("failed to get cache dir: %w", err)
+	}
+	binaries.SetLogger(binaryLogger)
+
+	var keep []string
+	if tm.IsRunning() {
+		keep = append(keep, filepath.Base(filepath.Dir(tm.GetBinaryPath())))
+	}
+	return binaries.ClearCache(cacheDir, keep...)
+}
+
+// GetBinaryCacheInfo returns the installed cloudflared versions and total cache size
+func (tm *TunnelManager) GetBinaryCacheInfo() (map[string]interface{}, error) {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cache dir: %w", err)
+	}
+
+	versions, err := binaries.ListVersions(cacheDir)
+	if err != nil {
+		return nil, err
 	}
+	return map[string]interface{}{
+		"cacheDir":  cacheDir,
+		"versions":  versions,
+		"sizeBytes": binaries.CacheSize(cacheDir),
+	}, nil
 }
@@ -0,0 +1,275 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/votanchat/cloudflared-desktop-tunnel/binaries"
+)
+
+const (
+	defaultUpdateCheckInterval = 6 * time.Hour
+	initialUpdateCheckDelay    = 30 * time.Second
+)
+
+// UpdateStatus describes what the update checker knows about cloudflared versions
+type UpdateStatus struct {
+	CurrentVersion  string    `json:"currentVersion"`  // Reported by `cloudflared --version`
+	LatestVersion   string    `json:"latestVersion"`   // Latest GitHub release
+	StagedVersion   string    `json:"stagedVersion"`   // Downloaded, applied on next restart
+	UpdateAvailable bool      `json:"updateAvailable"` // LatestVersion is newer than CurrentVersion
+	LastCheck       time.Time `json:"lastCheck"`
+	LastError       string    `json:"lastError"`
+}
+
+// UpdateChecker periodically looks for newer cloudflared releases and stages them
+type UpdateChecker struct {
+	mu               sync.RWMutex
+	tunnel           *TunnelManager
+	interval         time.Duration
+	applyImmediately bool
+	status           UpdateStatus
+	rejected         map[string]bool // Versions that failed readiness and were rolled back
+	onUpdate         func(UpdateStatus)
+}
+
+// NewUpdateChecker creates a new update checker. An interval <= 0 uses the default.
+func NewUpdateChecker(tunnel *TunnelManager, interval time.Duration) *UpdateChecker {
+	if interval <= 0 {
+		interval = defaultUpdateCheckInterval
+	}
+	return &UpdateChecker{
+		tunnel:   tunnel,
+		interval: interval,
+		rejected: make(map[string]bool),
+	}
+}
+
+// SetApplyImmediately controls whether a running tunnel is restarted as soon as an update is staged
+func (uc *UpdateChecker) SetApplyImmediately(apply bool) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.applyImmediately = apply
+}
+
+// SetInterval changes the check interval from the next scheduled check on. An interval <= 0 uses the default.
+func (uc *UpdateChecker) SetInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultUpdateCheckInterval
+	}
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.interval = interval
+}
+
+// SetOnUpdate sets the callback invoked whenever the update status changes
+func (uc *UpdateChecker) SetOnUpdate(callback func(UpdateStatus)) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.onUpdate = callback
+}
+
+// Start runs the check loop until ctx is cancelled
+func (uc *UpdateChecker) Start(ctx context.Context) {
+	timer := time.NewTimer(initialUpdateCheckDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if _, err := uc.checkNow(ctx); err != nil {
+				appLogger.Warn("cloudflared update check failed: %v", err)
+			}
+			uc.mu.RLock()
+			interval := uc.interval
+			uc.mu.RUnlock()
+			timer.Reset(interval)
+		}
+	}
+}
+
+// Status returns the result of the last check
+func (uc *UpdateChecker) Status() UpdateStatus {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	return uc.status
+}
+
+// CheckNow compares the active cloudflared with the latest release and stages
+// the release if it is newer
+func (uc *UpdateChecker) CheckNow() (UpdateStatus, error) {
+	return uc.checkNow(context.Background())
+}
+
+// checkNow is CheckNow with a context that aborts the download
+func (uc *UpdateChecker) checkNow(ctx context.Context) (UpdateStatus, error) {
+	status, staged, err := uc.check(ctx)
+
+	uc.mu.Lock()
+	status.LastCheck = time.Now()
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	uc.status = status
+	callback := uc.onUpdate
+	applyImmediately := uc.applyImmediately
+	uc.mu.Unlock()
+
+	if callback != nil {
+		callback(status)
+	}
+
+	// Only a version this check staged; one staged earlier waits for ApplyNow or a restart
+	if err == nil && applyImmediately && staged && uc.tunnel.IsRunning() {
+		appLogger.Info("Applying cloudflared %s immediately", status.StagedVersion)
+		if err := uc.tunnel.Restart(); err != nil {
+			appLogger.Error("Failed to restart tunnel for update: %v", err)
+		}
+	}
+
+	return status, err
+}
+
+// check does the version comparison and download without touching uc.status.
+// staged reports whether this call staged a new version.
+func (uc *UpdateChecker) check(ctx context.Context) (status UpdateStatus, staged bool, err error) {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return status, false, fmt.Errorf("failed to get cache dir: %w", err)
+	}
+	binaries.SetLogger(binaryLogger)
+
+	status.StagedVersion = binaries.StagedVersion(cacheDir)
+
+	// Nothing is installed yet; the first tunnel start fetches the latest release
+	active := binaries.ActiveVersion(cacheDir)
+	if active == "" {
+		return status, false, nil
+	}
+
+	current, err := binaries.BinaryVersion(binaries.VersionPath(cacheDir, active))
+	if err != nil {
+		return status, false, err
+	}
+	status.CurrentVersion = current
+
+	latest, err := binaries.LatestVersion(ctx)
+	if err != nil {
+		return status, false, fmt.Errorf("failed to get latest version: %w", err)
+	}
+	status.LatestVersion = latest
+	status.UpdateAvailable = binaries.CompareVersions(latest, current) > 0
+
+	uc.mu.RLock()
+	rejected := uc.rejected[latest]
+	uc.mu.RUnlock()
+
+	if !status.UpdateAvailable || rejected || status.StagedVersion == latest {
+		return status, false, nil
+	}
+
+	appLogger.Info("cloudflared %s is available (current %s), downloading...", latest, current)
+	if _, err := binaries.InstallVersion(ctx, cacheDir, latest); err != nil {
+		return status, false, fmt.Errorf("failed to download cloudflared %s: %w", latest, err)
+	}
+	if err := binaries.StageVersion(cacheDir, latest); err != nil {
+		return status, false, fmt.Errorf("failed to stage cloudflared %s: %w", latest, err)
+	}
+	status.StagedVersion = latest
+	appLogger.Info("cloudflared %s staged for next tunnel restart", latest)
+
+	return status, true, nil
+}
+
+// InstallVersion downloads and stages a specific cloudflared version, or the
+// latest release for "latest", even if it is older than the current one or
+// was rolled back before. With apply a running tunnel is restarted onto it.
+func (uc *UpdateChecker) InstallVersion(version string, apply bool) (UpdateStatus, error) {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return uc.Status(), fmt.Errorf("failed to get cache dir: %w", err)
+	}
+	binaries.SetLogger(binaryLogger)
+
+	ctx := context.Background()
+	if version == "latest" {
+		if version, err = binaries.LatestVersion(ctx); err != nil {
+			return uc.Status(), fmt.Errorf("failed to get latest version: %w", err)
+		}
+	}
+
+	appLogger.Info("Installing cloudflared %s on request", version)
+	if _, err := binaries.InstallVersion(ctx, cacheDir, version); err != nil {
+		return uc.Status(), fmt.Errorf("failed to download cloudflared %s: %w", version, err)
+	}
+	if err := binaries.StageVersion(cacheDir, version); err != nil {
+		return uc.Status(), fmt.Errorf("failed to stage cloudflared %s: %w", version, err)
+	}
+
+	uc.mu.Lock()
+	delete(uc.rejected, version)
+	uc.status.StagedVersion = version
+	uc.status.LastError = ""
+	status := uc.status
+	callback := uc.onUpdate
+	uc.mu.Unlock()
+
+	if callback != nil {
+		callback(status)
+	}
+
+	if apply && uc.tunnel.IsRunning() {
+		appLogger.Info("Applying cloudflared %s now", version)
+		if err := uc.tunnel.Restart(); err != nil {
+			return status, fmt.Errorf("failed to restart tunnel onto cloudflared %s: %w", version, err)
+		}
+	}
+	return status, nil
+}
+
+// ApplyNow restarts the running tunnel so a staged update takes effect
+func (uc *UpdateChecker) ApplyNow() error {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return fmt.Errorf("failed to get cache dir: %w", err)
+	}
+	if binaries.StagedVersion(cacheDir) == "" {
+		return fmt.Errorf("no cloudflared update is staged")
+	}
+	if !uc.tunnel.IsRunning() {
+		return fmt.Errorf("tunnel is not running; the update applies on next start")
+	}
+	return uc.tunnel.Restart()
+}
+
+// handleUpgradeResult records the outcome of a staged upgrade reported by the tunnel manager
+func (uc *UpdateChecker) handleUpgradeResult(version string, err error) {
+	uc.mu.Lock()
+	uc.status.StagedVersion = ""
+	if err != nil {
+		uc.rejected[version] = true
+		uc.status.LastError = fmt.Sprintf("cloudflared %s failed to start and was rolled back: %v", version, err)
+	} else {
+		uc.status.CurrentVersion = version
+		uc.status.UpdateAvailable = binaries.CompareVersions(uc.status.LatestVersion, version) > 0
+		uc.status.LastError = ""
+	}
+	status := uc.status
+	callback := uc.onUpdate
+	uc.mu.Unlock()
+
+	// The previous version is now a rollback candidate subject to the cache policy
+	if err == nil {
+		if err := uc.tunnel.PruneBinaryCache(); err != nil {
+			appLogger.Warn("Failed to prune binary cache: %v", err)
+		}
+	}
+
+	if callback != nil {
+		callback(status)
+	}
+}
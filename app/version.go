@@ -0,0 +1,5 @@
+package app
+
+// Version is the app version reported to the backend. Release builds set it with
+// -ldflags "-X github.com/votanchat/cloudflared-desktop-tunnel/app.Version=1.2.3"
+var Version = "1.0.0"
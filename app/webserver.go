@@ -1,6 +1,7 @@
 package app
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -22,9 +23,13 @@ func NewWebServerManager() *WebServerManager {
 	// Disable Gin debug logging in production
 	gin.SetMode(gin.ReleaseMode)
 
-	return &WebServerManager{
+	ws := &WebServerManager{
 		engine: gin.Default(),
 	}
+	// Gin panics if a route is registered twice, so routes are set up once
+	// here rather than on every start
+	ws.setupRoutes()
+	return ws
 }
 
 // StartWithPort starts the web server on a specific port
@@ -51,11 +56,10 @@ func (ws *WebServerManager) StartWithPort(port int) error {
 	ws.listener = listener
 
 	serverLogger.Info("Web server will use port: %d", port)
-	ws.setupRoutes()
 
 	go func() {
 		serverLogger.Info("Starting Gin web server on port %d", port)
-		if err := ws.engine.RunListener(listener); err != nil && err.Error() != "http: Server closed" {
+		if err := ws.engine.RunListener(listener); err != nil && err.Error() != "http: Server closed" && !errors.Is(err, net.ErrClosed) {
 			serverLogger.Error("Web server error: %v", err)
 		}
 	}()
@@ -84,11 +88,10 @@ func (ws *WebServerManager) Start() (int, error) {
 	ws.listener = listener
 
 	serverLogger.Info("Web server will use port: %d", port)
-	ws.setupRoutes()
 
 	go func() {
 		serverLogger.Info("Starting Gin web server on port %d", port)
-		if err := ws.engine.RunListener(listener); err != nil && err.Error() != "http: Server closed" {
+		if err := ws.engine.RunListener(listener); err != nil && err.Error() != "http: Server closed" && !errors.Is(err, net.ErrClosed) {
 			serverLogger.Error("Web server error: %v", err)
 		}
 	}()
@@ -107,10 +110,27 @@ func (ws *WebServerManager) Stop() error {
 	}
 
 	serverLogger.Info("Stopping web server on port %d", ws.port)
+	if ws.listener != nil {
+		// Closing the listener makes RunListener return and frees the port
+		if err := ws.listener.Close(); err != nil {
+			serverLogger.Warn("Error closing listener: %v", err)
+		}
+		ws.listener = nil
+	}
 	ws.running = false
 	return nil
 }
 
+// Restart rebinds the web server to a new port
+func (ws *WebServerManager) Restart(port int) error {
+	if ws.IsRunning() {
+		if err := ws.Stop(); err != nil {
+			return err
+		}
+	}
+	return ws.StartWithPort(port)
+}
+
 // IsRunning returns true if the web server is running
 func (ws *WebServerManager) IsRunning() bool {
 	ws.mu.RLock()
@@ -0,0 +1,110 @@
+package binaries
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// GitHubAsset represents a downloadable file attached to a GitHub release
+type GitHubAsset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+	Size               int64  `json:"size"`
+}
+
+// assetCandidates maps GOOS/GOARCH to the release assets that can run there,
+// in order of preference. Only raw binaries and the macOS .tgz archives are
+// listed; .deb/.rpm/.msi/.pkg packages are never selected.
+var assetCandidates = map[string][]string{
+	"linux/amd64": {"cloudflared-linux-amd64"},
+	"linux/arm64": {"cloudflared-linux-arm64"},
+	"linux/arm":   {"cloudflared-linux-armhf", "cloudflared-linux-arm"},
+	"linux/386":   {"cloudflared-linux-386"},
+
+	"darwin/amd64": {"cloudflared-darwin-amd64.tgz"},
+	// Apple Silicon can run the amd64 build under Rosetta if a release lacks arm64
+	"darwin/arm64": {"cloudflared-darwin-arm64.tgz", "cloudflared-darwin-amd64.tgz"},
+
+	"windows/amd64": {"cloudflared-windows-amd64.exe"},
+	"windows/386":   {"cloudflared-windows-386.exe"},
+	"windows/arm64": {"cloudflared-windows-arm64.exe"},
+}
+
+// platformCandidates returns the asset names usable on goos/goarch, or an
+// error if the platform is not supported at all
+func platformCandidates(goos, goarch string) ([]string, error) {
+	key := goos + "/" + goarch
+	candidates, ok := assetCandidates[key]
+	if !ok {
+		return nil, fmt.Errorf("cloudflared is not available for %s (supported: %s)", key, strings.Join(supportedPlatforms(), ", "))
+	}
+
+	// armhf builds need ARMv7 hard-float; older boards only get the generic arm build
+	if key == "linux/arm" && goarmLevel() < 7 {
+		candidates = []string{"cloudflared-linux-arm"}
+	}
+
+	return candidates, nil
+}
+
+// CheckPlatformSupported returns an error if no cloudflared build exists for
+// the current platform
+func CheckPlatformSupported() error {
+	_, err := platformCandidates(runtime.GOOS, runtime.GOARCH)
+	return err
+}
+
+// resolveAsset picks the release asset to download for goos/goarch
+func resolveAsset(release *GitHubRelease, goos, goarch string) (*GitHubAsset, error) {
+	candidates, err := platformCandidates(goos, goarch)
+	if err != nil {
+		return nil, err
+	}
+
+	available := make(map[string]*GitHubAsset, len(release.Assets))
+	for i := range release.Assets {
+		available[release.Assets[i].Name] = &release.Assets[i]
+	}
+
+	for _, name := range candidates {
+		if asset, ok := available[name]; ok {
+			return asset, nil
+		}
+	}
+
+	return nil, fmt.Errorf("release %s has no cloudflared build for %s/%s (looked for %s)",
+		release.TagName, goos, goarch, strings.Join(candidates, ", "))
+}
+
+// supportedPlatforms returns the sorted list of GOOS/GOARCH keys in the table
+func supportedPlatforms() []string {
+	keys := make([]string, 0, len(assetCandidates))
+	for key := range assetCandidates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// goarmLevel returns the GOARM version this binary was built with, defaulting
+// to 7 when unknown
+func goarmLevel() int {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return 7
+	}
+	for _, setting := range info.Settings {
+		if setting.Key != "GOARM" || setting.Value == "" {
+			continue
+		}
+		// Values look like "6" or "7,softfloat"
+		if strings.Contains(setting.Value, "softfloat") {
+			return 6
+		}
+		return int(setting.Value[0] - '0')
+	}
+	return 7
+}
@@ -0,0 +1,182 @@
+package binaries
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// CachePolicy controls which cloudflared versions are kept in the cache
+type CachePolicy struct {
+	KeepPrevious int   // Versions kept besides the active and staged ones
+	MaxSizeBytes int64 // Upper bound for the versions directory (0 = unlimited)
+}
+
+// CachedVersion describes one installed cloudflared version
+type CachedVersion struct {
+	Version string `json:"version"`
+	Size    int64  `json:"size"`
+	Active  bool   `json:"active"`
+	Staged  bool   `json:"staged"`
+}
+
+// ListVersions returns the installed versions, newest first
+func ListVersions(cacheDir string) ([]CachedVersion, error) {
+	entries, err := os.ReadDir(filepath.Join(cacheDir, versionsDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	active := ActiveVersion(cacheDir)
+	staged := StagedVersion(cacheDir)
+
+	var versions []CachedVersion
+	for _, entry := range entries {
+		if !entry.IsDir() || validateVersion(entry.Name()) != nil {
+			continue
+		}
+		versions = append(versions, CachedVersion{
+			Version: entry.Name(),
+			Size:    dirSize(filepath.Join(cacheDir, versionsDirName, entry.Name())),
+			Active:  entry.Name() == active,
+			Staged:  entry.Name() == staged,
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return CompareVersions(versions[i].Version, versions[j].Version) > 0
+	})
+	return versions, nil
+}
+
+// PruneCache removes versions outside the policy. The active and staged
+// versions are always kept, even if they alone exceed MaxSizeBytes.
+func PruneCache(cacheDir string, policy CachePolicy) error {
+	unlock, err := lockCacheDir(cacheDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	removeLegacyBinaries(cacheDir)
+
+	versions, err := ListVersions(cacheDir)
+	if err != nil {
+		return fmt.Errorf("failed to list cached versions: %w", err)
+	}
+
+	var kept []CachedVersion
+	var total int64
+	previous := 0
+	for _, v := range versions {
+		if v.Active || v.Staged {
+			kept = append(kept, v)
+			total += v.Size
+			continue
+		}
+		if previous < policy.KeepPrevious {
+			previous++
+			kept = append(kept, v)
+			total += v.Size
+			continue
+		}
+		removeVersion(cacheDir, v.Version)
+	}
+
+	// Drop the oldest previous versions until the cache fits
+	for i := len(kept) - 1; i >= 0 && policy.MaxSizeBytes > 0 && total > policy.MaxSizeBytes; i-- {
+		if kept[i].Active || kept[i].Staged {
+			continue
+		}
+		removeVersion(cacheDir, kept[i].Version)
+		total -= kept[i].Size
+	}
+
+	return nil
+}
+
+// ClearCache removes every cached version except those listed in keep,
+// along with leftover partial downloads
+func ClearCache(cacheDir string, keep ...string) error {
+	unlock, err := lockCacheDir(cacheDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	removeLegacyBinaries(cacheDir)
+
+	keepSet := make(map[string]bool, len(keep))
+	for _, version := range keep {
+		keepSet[version] = true
+	}
+
+	versions, err := ListVersions(cacheDir)
+	if err != nil {
+		return fmt.Errorf("failed to list cached versions: %w", err)
+	}
+
+	for _, v := range versions {
+		if keepSet[v.Version] {
+			continue
+		}
+		removeVersion(cacheDir, v.Version)
+		if v.Active {
+			os.Remove(filepath.Join(cacheDir, activeFileName))
+		}
+		if v.Staged {
+			os.Remove(filepath.Join(cacheDir, stagedFileName))
+		}
+	}
+
+	return nil
+}
+
+// CacheSize returns the total size in bytes of the installed versions
+func CacheSize(cacheDir string) int64 {
+	return dirSize(filepath.Join(cacheDir, versionsDirName))
+}
+
+// removeVersion deletes a version directory including any partial downloads in it
+func removeVersion(cacheDir, version string) {
+	binaryLogger.Info("Removing cached cloudflared %s", version)
+	if err := os.RemoveAll(filepath.Join(cacheDir, versionsDirName, version)); err != nil {
+		binaryLogger.Warn("Failed to remove cached cloudflared %s: %v", version, err)
+	}
+}
+
+// removeLegacyBinaries deletes binaries left by the pre-versioned cache layout
+func removeLegacyBinaries(cacheDir string) {
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return
+	}
+	legacyPrefix := fmt.Sprintf("cloudflared-%s-%s", runtime.GOOS, runtime.GOARCH)
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), legacyPrefix) {
+			binaryLogger.Debug("Removing legacy cached binary: %s", entry.Name())
+			os.Remove(filepath.Join(cacheDir, entry.Name()))
+		}
+	}
+}
+
+// dirSize sums the sizes of the regular files under dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -3,6 +3,7 @@ package binaries
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +12,8 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -49,157 +52,413 @@ func SetLogger(logger Logger) {
 
 // GitHubRelease represents a GitHub release
 type GitHubRelease struct {
-	TagName string `json:"tag_name"`
+	TagName string        `json:"tag_name"`
+	Assets  []GitHubAsset `json:"assets"`
 }
 
-// DownloadCloudflared downloads the cloudflared binary for the current platform
-// and saves it to the cache directory
-func DownloadCloudflared(cacheDir string) (string, error) {
+const (
+	minBinarySize       = 10 * 1024 * 1024 // 10MB
+	installLockName     = ".install.lock"
+	maxDownloadAttempts = 3
+	validatorSuffix     = ".validator" // Next to a partial download: the ETag or Last-Modified it came from
+)
+
+// DownloadCloudflared returns the active cloudflared binary for the current
+// platform, downloading and activating the latest release if none is cached.
+// Cancelling ctx aborts the release lookup and the download.
+func DownloadCloudflared(ctx context.Context, cacheDir string) (string, error) {
+	// Fail before touching the network if there is no build for this platform
+	if err := CheckPlatformSupported(); err != nil {
+		return "", err
+	}
+
 	// Ensure cache directory exists
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
 		return "", fmt.Errorf("failed to create cache directory: %w", err)
 	}
 
-	// Determine binary name based on OS and architecture
-	binaryName := fmt.Sprintf("cloudflared-%s-%s", runtime.GOOS, runtime.GOARCH)
-	if runtime.GOOS == "windows" {
-		binaryName += ".exe"
-	}
-
-	binaryPath := filepath.Join(cacheDir, binaryName)
-
-	const minSize = 10 * 1024 * 1024 // 10MB
-
-	if info, err := os.Stat(binaryPath); err == nil {
-		if info.Size() >= minSize {
+	if version := ActiveVersion(cacheDir); version != "" {
+		binaryPath := VersionPath(cacheDir, version)
+		if isCachedBinaryValid(binaryPath) {
 			binaryLogger.Info("Valid binary found in cache: %s", binaryPath)
 			return binaryPath, nil
 		}
-		binaryLogger.Warn("Cached binary is too small, will re-download")
-		os.Remove(binaryPath)
 	}
 
 	binaryLogger.Info("Fetching latest cloudflared version from GitHub...")
-	version, err := getLatestVersion()
+	release, err := getLatestRelease(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to get latest version: %w", err)
 	}
-	binaryLogger.Info("Latest version: %s", version)
+	binaryLogger.Info("Latest version: %s", release.TagName)
 
-	binaryLogger.Info("Downloading cloudflared binary for %s/%s...", runtime.GOOS, runtime.GOARCH)
-	if err := downloadBinary(version, binaryPath); err != nil {
-		return "", fmt.Errorf("failed to download binary: %w", err)
+	binaryPath, err := installRelease(ctx, cacheDir, release)
+	if err != nil {
+		return "", err
 	}
 
-	if runtime.GOOS != "windows" {
-		if err := os.Chmod(binaryPath, 0755); err != nil {
-			return "", fmt.Errorf("failed to set executable permissions: %w", err)
-		}
+	if err := SetActiveVersion(cacheDir, release.TagName); err != nil {
+		return "", err
 	}
 
-	binaryLogger.Info("Binary downloaded successfully: %s", binaryPath)
 	return binaryPath, nil
 }
 
-var githubClient = &http.Client{
-	Timeout: 30 * time.Second,
+// InstallVersion downloads a specific cloudflared release into the versioned
+// cache without activating it. Cancelling ctx aborts the lookup and download.
+func InstallVersion(ctx context.Context, cacheDir, version string) (string, error) {
+	if err := CheckPlatformSupported(); err != nil {
+		return "", err
+	}
+	if err := validateVersion(version); err != nil {
+		return "", err
+	}
+
+	binaryPath := VersionPath(cacheDir, version)
+	if isCachedBinaryValid(binaryPath) {
+		return binaryPath, nil
+	}
+
+	release, err := getRelease(ctx, version)
+	if err != nil {
+		return "", fmt.Errorf("failed to get release %s: %w", version, err)
+	}
+
+	return installRelease(ctx, cacheDir, release)
+}
+
+// LatestVersion returns the tag of the latest cloudflared release
+func LatestVersion(ctx context.Context) (string, error) {
+	release, err := getLatestRelease(ctx)
+	if err != nil {
+		return "", err
+	}
+	return release.TagName, nil
 }
 
-// getLatestVersion fetches the latest cloudflared version from GitHub
-func getLatestVersion() (string, error) {
-	resp, err := githubClient.Get("https://api.github.com/repos/cloudflare/cloudflared/releases/latest")
+// installRelease downloads the asset for the current platform from release
+// into its versioned cache directory
+func installRelease(ctx context.Context, cacheDir string, release *GitHubRelease) (string, error) {
+	if err := validateVersion(release.TagName); err != nil {
+		return "", err
+	}
+
+	// Resolve the asset before taking the lock so unsupported releases fail fast
+	asset, err := resolveAsset(release, runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		return "", err
+	}
+
+	binaryPath := VersionPath(cacheDir, release.TagName)
+	if err := os.MkdirAll(filepath.Dir(binaryPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create version directory: %w", err)
+	}
+
+	// Serialize installs across goroutines and processes sharing this cache
+	unlock, err := lockCacheDir(cacheDir)
 	if err != nil {
 		return "", err
 	}
+	defer unlock()
+
+	// Another process may have finished the install while we waited for the lock
+	if isCachedBinaryValid(binaryPath) {
+		binaryLogger.Info("Binary installed by another process: %s", binaryPath)
+		return binaryPath, nil
+	}
+	removeStaleExtractions(filepath.Dir(binaryPath))
+
+	binaryLogger.Info("Downloading %s %s for %s/%s...", asset.Name, release.TagName, runtime.GOOS, runtime.GOARCH)
+	if err := downloadBinary(ctx, asset, binaryPath); err != nil {
+		return "", fmt.Errorf("failed to download binary: %w", err)
+	}
+
+	binaryLogger.Info("Binary downloaded successfully: %s", binaryPath)
+	return binaryPath, nil
+}
+
+// isCachedBinaryValid reports whether a complete binary is already installed at path
+func isCachedBinaryValid(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if info.Size() < minBinarySize {
+		binaryLogger.Warn("Cached binary is too small, will re-download")
+		return false
+	}
+	return true
+}
+
+// lockCacheDir takes a cross-process lock on the cache directory and returns
+// a function that releases it
+func lockCacheDir(cacheDir string) (func(), error) {
+	lockPath := filepath.Join(cacheDir, installLockName)
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open install lock: %w", err)
+	}
+
+	binaryLogger.Debug("Acquiring install lock: %s", lockPath)
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to acquire install lock: %w", err)
+	}
+
+	return func() {
+		if err := unlockFile(f); err != nil {
+			binaryLogger.Warn("Failed to release install lock: %v", err)
+		}
+		f.Close()
+	}, nil
+}
+
+const (
+	githubTimeout   = 30 * time.Second
+	downloadTimeout = 5 * time.Minute // Binary downloads can take time
+)
+
+// Replaced as a whole by SetHTTPTransport while requests may be in flight
+var githubClient, downloadClient atomic.Pointer[http.Client]
+
+func init() {
+	SetHTTPTransport(nil)
+}
+
+// SetHTTPTransport sets the transport used for GitHub API calls and binary
+// downloads. Requests in flight finish on the previous one.
+func SetHTTPTransport(transport http.RoundTripper) {
+	oldGitHub := githubClient.Swap(&http.Client{Transport: transport, Timeout: githubTimeout})
+	oldDownload := downloadClient.Swap(&http.Client{Transport: transport, Timeout: downloadTimeout})
+	for _, old := range []*http.Client{oldGitHub, oldDownload} {
+		if old != nil && old.Transport != nil {
+			old.CloseIdleConnections()
+		}
+	}
+}
+
+const releasesAPI = "https://api.github.com/repos/cloudflare/cloudflared/releases"
+
+// getLatestRelease fetches the latest cloudflared release, including its asset list, from GitHub
+func getLatestRelease(ctx context.Context) (*GitHubRelease, error) {
+	return fetchRelease(ctx, releasesAPI+"/latest")
+}
+
+// getRelease fetches the cloudflared release with the given tag from GitHub
+func getRelease(ctx context.Context, tag string) (*GitHubRelease, error) {
+	return fetchRelease(ctx, releasesAPI+"/tags/"+tag)
+}
+
+// fetchRelease decodes a single release from the GitHub API
+func fetchRelease(ctx context.Context, url string) (*GitHubRelease, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := githubClient.Load().Do(req)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("GitHub API returned status %d", resp.StatusCode)
+		return nil, fmt.Errorf("GitHub API returned status %d", resp.StatusCode)
 	}
 
 	var release GitHubRelease
 	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return release.TagName, nil
+	return &release, nil
+}
+
+// downloadBinary downloads the given release asset and atomically installs
+// the cloudflared binary it contains at outputPath
+func downloadBinary(ctx context.Context, asset *GitHubAsset, outputPath string) error {
+	binaryLogger.Debug("Downloading from: %s", asset.BrowserDownloadURL)
+
+	if strings.HasSuffix(asset.Name, ".tgz") {
+		// Extract from .tgz (macOS)
+		archivePath := outputPath + ".tgz.partial"
+		if err := downloadResumable(ctx, asset.BrowserDownloadURL, archivePath); err != nil {
+			return err
+		}
+		defer os.Remove(archivePath)
+		return extractTgz(archivePath, outputPath)
+	}
+
+	// Direct download (Windows, Linux)
+	partialPath := outputPath + ".partial"
+	if err := downloadResumable(ctx, asset.BrowserDownloadURL, partialPath); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(partialPath, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open downloaded file: %w", err)
+	}
+
+	if info, err := f.Stat(); err == nil && asset.Size > 0 && info.Size() != asset.Size {
+		f.Close()
+		os.Remove(partialPath)
+		os.Remove(partialPath + validatorSuffix)
+		return fmt.Errorf("downloaded %d bytes, expected %d", info.Size(), asset.Size)
+	}
+
+	return commitFile(f, outputPath)
 }
 
-// downloadBinary downloads the cloudflared binary for the current platform
-func downloadBinary(version, outputPath string) error {
-	baseURL := fmt.Sprintf("https://github.com/cloudflare/cloudflared/releases/download/%s", version)
-
-	var downloadURL string
-	var needsExtraction bool
-
-	switch runtime.GOOS {
-	case "windows":
-		downloadURL = fmt.Sprintf("%s/cloudflared-windows-amd64.exe", baseURL)
-		needsExtraction = false
-	case "darwin":
-		// macOS uses .tgz files
-		if runtime.GOARCH == "arm64" {
-			downloadURL = fmt.Sprintf("%s/cloudflared-darwin-arm64.tgz", baseURL)
-		} else {
-			downloadURL = fmt.Sprintf("%s/cloudflared-darwin-amd64.tgz", baseURL)
+// downloadResumable downloads url into partialPath, resuming from whatever a
+// previous interrupted attempt left behind. It gives up after
+// maxDownloadAttempts interrupted attempts or when ctx is cancelled.
+func downloadResumable(ctx context.Context, url, partialPath string) error {
+	for attempt := 1; ; attempt++ {
+		err := downloadToPartial(ctx, url, partialPath)
+		if err == nil {
+			os.Remove(partialPath + validatorSuffix)
+			return nil
 		}
-		needsExtraction = true
-	case "linux":
-		if runtime.GOARCH == "arm64" {
-			downloadURL = fmt.Sprintf("%s/cloudflared-linux-arm64", baseURL)
-		} else {
-			downloadURL = fmt.Sprintf("%s/cloudflared-linux-amd64", baseURL)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= maxDownloadAttempts {
+			return err
+		}
+
+		delay := time.Duration(attempt) * 2 * time.Second
+		binaryLogger.Warn("Download interrupted (attempt %d/%d): %v, resuming in %v", attempt, maxDownloadAttempts, err, delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// downloadToPartial appends the remaining bytes of url to partialPath using an
+// HTTP Range request. The range is conditional on the validator saved with the
+// partial file, so a changed asset is downloaded afresh instead of being
+// appended to the old bytes.
+func downloadToPartial(ctx context.Context, url, partialPath string) error {
+	f, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open partial file: %w", err)
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to seek partial file: %w", err)
+	}
+
+	validatorPath := partialPath + validatorSuffix
+	validator := ""
+	if offset > 0 {
+		if data, err := os.ReadFile(validatorPath); err == nil {
+			validator = strings.TrimSpace(string(data))
+		}
+		// Without a validator the partial bytes cannot be matched to the remote file
+		if validator == "" {
+			binaryLogger.Debug("Partial download has no validator, restarting download")
+			if err := restartPartial(f); err != nil {
+				return err
+			}
+			offset = 0
 		}
-		needsExtraction = false
-	default:
-		return fmt.Errorf("unsupported OS: %s", runtime.GOOS)
 	}
 
-	// Download the file
-	downloadClient := &http.Client{
-		Timeout: 5 * time.Minute, // Binary downloads can take time
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
 	}
 
-	binaryLogger.Debug("Downloading from: %s", downloadURL)
-	resp, err := downloadClient.Get(downloadURL)
+	resp, err := downloadClient.Load().Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			if err := restartPartial(f); err != nil {
+				return err
+			}
+			return fmt.Errorf("server returned unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+		binaryLogger.Info("Resuming download at byte %d", offset)
+	case http.StatusOK:
+		// A full body: the first attempt, a server without range support, or
+		// an asset that changed since the partial download
+		if offset > 0 {
+			binaryLogger.Debug("Server sent the whole file, restarting download")
+			if err := restartPartial(f); err != nil {
+				return err
+			}
+		}
+		if err := saveValidator(validatorPath, resp.Header); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file already holds the whole body if its size matches
+		if resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset) {
+			return nil
+		}
+		if err := restartPartial(f); err != nil {
+			return err
+		}
+		return fmt.Errorf("partial download does not match remote file, restarting")
+	default:
 		return fmt.Errorf("download failed with status %d", resp.StatusCode)
 	}
 
-	if needsExtraction {
-		// Extract from .tgz (macOS)
-		return extractTgz(resp.Body, outputPath)
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
 	}
 
-	// Direct download (Windows, Linux)
-	return writeFile(resp.Body, outputPath)
+	return f.Sync()
 }
 
-// extractTgz extracts the cloudflared binary from a .tgz archive
-func extractTgz(r io.Reader, outputPath string) error {
-	// Create temporary file for the archive
-	tmpFile, err := os.CreateTemp("", "cloudflared-*.tgz")
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+// restartPartial empties a partial download so it starts over from byte 0
+func restartPartial(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate partial file: %w", err)
 	}
-	defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
-
-	// Write archive to temp file
-	if _, err := io.Copy(tmpFile, r); err != nil {
-		return fmt.Errorf("failed to write archive: %w", err)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek partial file: %w", err)
 	}
+	return nil
+}
 
-	// Close and reopen for reading
-	tmpFile.Close()
+// saveValidator records what identifies the file being downloaded: a strong
+// ETag, else Last-Modified. With neither the next attempt starts over.
+func saveValidator(path string, header http.Header) error {
+	validator := header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+	if validator == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove download validator: %w", err)
+		}
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(validator), 0644); err != nil {
+		return fmt.Errorf("failed to save download validator: %w", err)
+	}
+	return nil
+}
 
+// extractTgz extracts the cloudflared binary from a .tgz archive and
+// atomically installs it at outputPath
+func extractTgz(archivePath, outputPath string) error {
 	// Open the archive
-	file, err := os.Open(tmpFile.Name())
+	file, err := os.Open(archivePath)
 	if err != nil {
 		return fmt.Errorf("failed to open archive: %w", err)
 	}
@@ -227,36 +486,63 @@ func extractTgz(r io.Reader, outputPath string) error {
 
 		// Look for the cloudflared binary (usually just "cloudflared" in the archive)
 		if header.Typeflag == tar.TypeReg && (header.Name == "cloudflared" || filepath.Base(header.Name) == "cloudflared") {
-			// Write to output path
-			outFile, err := os.Create(outputPath)
+			// Extract next to the output so the final rename stays on one filesystem
+			tmpFile, err := os.CreateTemp(filepath.Dir(outputPath), ".cloudflared-*.tmp")
 			if err != nil {
-				return fmt.Errorf("failed to create output file: %w", err)
+				return fmt.Errorf("failed to create temp file: %w", err)
 			}
-			defer outFile.Close()
 
-			if _, err := io.Copy(outFile, tr); err != nil {
+			if _, err := io.Copy(tmpFile, tr); err != nil {
+				tmpFile.Close()
+				os.Remove(tmpFile.Name())
 				return fmt.Errorf("failed to extract binary: %w", err)
 			}
 
-			return nil
+			return commitFile(tmpFile, outputPath)
 		}
 	}
 
 	return fmt.Errorf("cloudflared binary not found in archive")
 }
 
-// writeFile writes the content from reader to the output path
-func writeFile(r io.Reader, outputPath string) error {
-	outFile, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+// removeStaleExtractions deletes temp files an install killed mid-extraction
+// left in versionDir. Callers hold the install lock, so none are in use.
+func removeStaleExtractions(versionDir string) {
+	matches, _ := filepath.Glob(filepath.Join(versionDir, ".cloudflared-*.tmp"))
+	for _, path := range matches {
+		binaryLogger.Debug("Removing stale temp file: %s", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			binaryLogger.Warn("Failed to remove %s: %v", path, err)
+		}
 	}
-	defer outFile.Close()
+}
 
-	if _, err := io.Copy(outFile, r); err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+// commitFile flushes f to disk, marks it executable and renames it over
+// outputPath. f is closed, and removed if the commit fails.
+func commitFile(f *os.File, outputPath string) error {
+	tmpPath := f.Name()
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close file: %w", err)
 	}
 
-	return nil
-}
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(tmpPath, 0755); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to set executable permissions: %w", err)
+		}
+	}
 
+	if err := os.Rename(tmpPath, outputPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to install binary: %w", err)
+	}
+
+	return syncDir(filepath.Dir(outputPath))
+}
@@ -0,0 +1,163 @@
+package binaries
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Versioned cache layout:
+//
+//	<cacheDir>/versions/<version>/cloudflared[.exe]
+//	<cacheDir>/active  - version used to start tunnels
+//	<cacheDir>/staged  - downloaded upgrade waiting for the next tunnel restart
+const (
+	versionsDirName = "versions"
+	activeFileName  = "active"
+	stagedFileName  = "staged"
+)
+
+// VersionPath returns where the binary for version lives in the cache
+func VersionPath(cacheDir, version string) string {
+	name := "cloudflared"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return filepath.Join(cacheDir, versionsDirName, version, name)
+}
+
+// ActiveVersion returns the version currently used to start tunnels, or "" if none
+func ActiveVersion(cacheDir string) string {
+	return readPointer(filepath.Join(cacheDir, activeFileName))
+}
+
+// SetActiveVersion makes version the one used to start tunnels
+func SetActiveVersion(cacheDir, version string) error {
+	if err := validateVersion(version); err != nil {
+		return err
+	}
+	return writePointer(filepath.Join(cacheDir, activeFileName), version)
+}
+
+// StagedVersion returns the upgrade waiting to be tried on the next restart, or "" if none
+func StagedVersion(cacheDir string) string {
+	return readPointer(filepath.Join(cacheDir, stagedFileName))
+}
+
+// StageVersion marks an installed version to be tried on the next tunnel restart
+func StageVersion(cacheDir, version string) error {
+	if err := validateVersion(version); err != nil {
+		return err
+	}
+	if !isCachedBinaryValid(VersionPath(cacheDir, version)) {
+		return fmt.Errorf("version %s is not installed", version)
+	}
+	return writePointer(filepath.Join(cacheDir, stagedFileName), version)
+}
+
+// ClearStagedVersion drops any pending upgrade
+func ClearStagedVersion(cacheDir string) error {
+	err := os.Remove(filepath.Join(cacheDir, stagedFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+var versionOutputPattern = regexp.MustCompile(`version\s+(\d+\.\d+\.\d+)`)
+
+// BinaryVersion runs `cloudflared --version` and returns the reported version
+func BinaryVersion(binaryPath string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, binaryPath, "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s --version: %w", binaryPath, err)
+	}
+
+	match := versionOutputPattern.FindSubmatch(out)
+	if match == nil {
+		return "", fmt.Errorf("unrecognized version output: %q", strings.TrimSpace(string(out)))
+	}
+	return string(match[1]), nil
+}
+
+// CompareVersions compares two cloudflared versions (YYYY.M.P), returning
+// -1, 0 or 1. Missing or non-numeric components compare as zero.
+func CompareVersions(a, b string) int {
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var na, nb int
+		if i < len(pa) {
+			na, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			nb, _ = strconv.Atoi(pb[i])
+		}
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// validateVersion rejects version strings that are unsafe to use as a path component
+func validateVersion(version string) error {
+	if version == "" || version == "." || version == ".." || strings.ContainsAny(version, `/\:`) {
+		return fmt.Errorf("invalid cloudflared version %q", version)
+	}
+	return nil
+}
+
+// readPointer returns the trimmed contents of a pointer file, or "" if missing
+func readPointer(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	version := strings.TrimSpace(string(data))
+	if validateVersion(version) != nil {
+		return ""
+	}
+	return version
+}
+
+// writePointer atomically replaces a pointer file
+func writePointer(path, version string) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".pointer-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+
+	if _, err := tmpFile.WriteString(version + "\n"); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync %s: %w", filepath.Base(path), err)
+	}
+	tmpFile.Close()
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to update %s: %w", filepath.Base(path), err)
+	}
+	return syncDir(filepath.Dir(path))
+}
@@ -8,6 +8,7 @@ function App() {
   const [activeTab, setActiveTab] = useState('tunnel');
   const [tunnelStatus, setTunnelStatus] = useState<any>(null);
   const [wailsReady, setWailsReady] = useState(false);
+  const [notices, setNotices] = useState<string[]>([]);
 
   // Check if Wails runtime is ready
   useEffect(() => {
@@ -34,6 +35,21 @@ function App() {
     return () => clearInterval(interval);
   }, []);
 
+  // Show messages the backend raised before the UI loaded, then listen for new ones
+  useEffect(() => {
+    if (!wailsReady) return;
+
+    window.go.app.App.GetNotices()
+      .then((existing) => setNotices(existing || []))
+      .catch((error) => console.error('Failed to fetch notices:', error));
+
+    if (window.runtime && window.runtime.EventsOn) {
+      return window.runtime.EventsOn('app:notice', (message: string) =>
+        setNotices((current) => [...current, message])
+      );
+    }
+  }, [wailsReady]);
+
   // Fetch tunnel status periodically
   useEffect(() => {
     if (!wailsReady) return;
@@ -71,6 +87,19 @@ function App() {
         <p className="subtitle">Manage your Cloudflare Tunnels with ease</p>
       </header>
 
+      {notices.map((notice, index) => (
+        <div key={index} className="info-card" style={{ margin: '0 20px 10px', borderLeft: '4px solid #f0ad4e' }}>
+          ⚠️ {notice}
+          <button
+            className="btn"
+            style={{ float: 'right', padding: '2px 8px' }}
+            onClick={() => setNotices(notices.filter((_, i) => i !== index))}
+          >
+            ✕
+          </button>
+        </div>
+      ))}
+
       <nav className="tabs">
         <button
           className={`tab ${activeTab === 'tunnel' ? 'active' : ''}`}
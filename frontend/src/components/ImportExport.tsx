@@ -0,0 +1,162 @@
+import { useState } from 'react';
+
+interface ImportExportProps {
+  onImported: () => void;
+}
+
+function ImportExport({ onImported }: ImportExportProps) {
+  const [importData, setImportData] = useState('');
+  const [mode, setMode] = useState('merge');
+  const [preview, setPreview] = useState<any>(null);
+  const [isBusy, setIsBusy] = useState(false);
+
+  const handleExport = async (format: string) => {
+    try {
+      const data = await window.go.app.App.ExportConfig(format);
+      const isYaml = format === 'cloudflared';
+      const blob = new Blob([data], { type: isYaml ? 'text/yaml' : 'application/json' });
+      const link = document.createElement('a');
+      link.href = URL.createObjectURL(blob);
+      link.download = isYaml ? 'config.yml' : 'cloudflared-desktop-tunnel.json';
+      link.click();
+      URL.revokeObjectURL(link.href);
+    } catch (error: any) {
+      console.error('Export error:', error);
+      alert(`Failed to export: ${error.message || error}`);
+    }
+  };
+
+  const loadPreview = async (data: string, importMode: string) => {
+    if (!data) {
+      setPreview(null);
+      return;
+    }
+    try {
+      setPreview(await window.go.app.App.PreviewConfigImport(data, importMode));
+    } catch (error: any) {
+      setPreview(null);
+      alert(`Failed to read import file: ${error.message || error}`);
+    }
+  };
+
+  const handleFile = async (file: File | undefined) => {
+    if (!file) {
+      return;
+    }
+    const data = await file.text();
+    setImportData(data);
+    await loadPreview(data, mode);
+  };
+
+  const handleModeChange = async (newMode: string) => {
+    setMode(newMode);
+    await loadPreview(importData, newMode);
+  };
+
+  const handleImport = async () => {
+    // The device ID and credential go to whichever backend the settings name
+    const confirmBackend = preview.newBackendURLs.length > 0;
+    if (confirmBackend && !confirm(`This import switches the backend to ${preview.newBackendURLs.join(', ')}. ` +
+        'This device\'s ID and credential will be sent there. Continue?')) {
+      return;
+    }
+    setIsBusy(true);
+    try {
+      const result = await window.go.app.App.ImportConfig(importData, mode, confirmBackend);
+      setImportData('');
+      setPreview(null);
+      onImported();
+      if (result?.tunnelRestartPending &&
+          confirm('Imported settings affect the running tunnel. Restart it now?')) {
+        await window.go.app.App.RestartTunnel();
+      }
+    } catch (error: any) {
+      console.error('Import error:', error);
+      alert(`Failed to import: ${error.message || error}`);
+    } finally {
+      setIsBusy(false);
+    }
+  };
+
+  const hasChanges = preview && (preview.changes.length + preview.routesAdded.length +
+    preview.routesChanged.length + preview.routesRemoved.length) > 0;
+
+  return (
+    <div className="info-card">
+      <h3>📦 Import / Export</h3>
+      <div style={{ display: 'flex', gap: '10px', marginBottom: '15px' }}>
+        <button className="btn" onClick={() => handleExport('bundle')}>⬇️ Export Settings</button>
+        <button className="btn" onClick={() => handleExport('cloudflared')}>⬇️ Export Routes (config.yml)</button>
+      </div>
+
+      <div className="form-group">
+        <label className="form-label">Import settings bundle, config.json or cloudflared config.yml</label>
+        <input
+          type="file"
+          className="form-input"
+          accept=".json,.yml,.yaml"
+          onChange={(e) => handleFile(e.target.files?.[0])}
+        />
+      </div>
+
+      {preview && (
+        <>
+          <div className="form-group">
+            <select className="form-input" value={mode} onChange={(e) => handleModeChange(e.target.value)}>
+              <option value="merge">Merge: add routes, keep other settings</option>
+              <option value="replace">Replace: use routes and settings from the file</option>
+            </select>
+          </div>
+
+          {preview.changes.map((c: any) => (
+            <div className="info-row" key={c.field}>
+              <span className="info-label">~ {c.field}</span>
+              <span className="info-value">{JSON.stringify(c.old)} → {JSON.stringify(c.new)}</span>
+            </div>
+          ))}
+          {preview.routesAdded.map((r: any) => (
+            <div className="info-row" key={`+${r.hostname}`}>
+              <span className="info-label">+ {r.hostname}</span>
+              <span className="info-value">{r.service}</span>
+            </div>
+          ))}
+          {preview.routesChanged.map((r: any) => (
+            <div className="info-row" key={`~${r.hostname}`}>
+              <span className="info-label">~ {r.hostname}</span>
+              <span className="info-value">{r.service}</span>
+            </div>
+          ))}
+          {preview.routesRemoved.map((r: any) => (
+            <div className="info-row" key={`-${r.hostname}`}>
+              <span className="info-label">- {r.hostname}</span>
+              <span className="info-value">{r.service}</span>
+            </div>
+          ))}
+          {!hasChanges && <p>The file matches the current settings.</p>}
+          {preview.newBackendURLs.length > 0 && (
+            <div className="field-error">
+              ⚠️ Backend changes to {preview.newBackendURLs.join(', ')}. This device's credential will be sent there.
+            </div>
+          )}
+          {preview.warnings.map((w: string) => (
+            <div className="field-hint" key={w}>{w}</div>
+          ))}
+          {preview.errors.map((e: any) => (
+            <div className="field-error" key={e.field}>{e.field}: {e.message}</div>
+          ))}
+
+          <button
+            className="btn btn-primary"
+            style={{ marginTop: '10px' }}
+            onClick={handleImport}
+            disabled={isBusy || !hasChanges || preview.errors.length > 0}
+          >
+            {isBusy ? '⏳ Importing...' : '⬆️ Import'}
+          </button>
+        </>
+      )}
+    </div>
+  );
+}
+
+export default ImportExport;
@@ -0,0 +1,111 @@
+import { useState, useEffect } from 'react';
+
+interface ProfilesProps {
+  onActivated: () => void;
+}
+
+function Profiles({ onActivated }: ProfilesProps) {
+  const [profiles, setProfiles] = useState<any[]>([]);
+  const [selected, setSelected] = useState('');
+  const [isBusy, setIsBusy] = useState(false);
+
+  useEffect(() => {
+    loadProfiles();
+  }, []);
+
+  const loadProfiles = async () => {
+    try {
+      if (!window.go || !window.go.app || !window.go.app.App) {
+        throw new Error('Wails runtime not initialized');
+      }
+
+      const list = await window.go.app.App.ListProfiles();
+      setProfiles(list || []);
+      const active = (list || []).find((p) => p.active);
+      setSelected(active ? active.name : 'default');
+    } catch (error) {
+      console.error('Failed to load profiles:', error);
+    }
+  };
+
+  const run = async (action: () => Promise<void>, failure: string) => {
+    setIsBusy(true);
+    try {
+      await action();
+      await loadProfiles();
+    } catch (error: any) {
+      console.error(`${failure}:`, error);
+      alert(`${failure}: ${error.message || error}`);
+    } finally {
+      setIsBusy(false);
+    }
+  };
+
+  const handleActivate = () =>
+    run(async () => {
+      await window.go.app.App.ActivateProfile(selected);
+      onActivated();
+    }, 'Failed to activate profile');
+
+  const handleCreate = () => {
+    const name = prompt('Name for the new profile:');
+    if (name) {
+      run(() => window.go.app.App.CreateProfile(name), 'Failed to create profile');
+    }
+  };
+
+  const handleClone = () => {
+    const name = prompt(`Name for the copy of "${selected}":`);
+    if (name) {
+      run(() => window.go.app.App.CloneProfile(selected, name), 'Failed to clone profile');
+    }
+  };
+
+  const handleDelete = () => {
+    if (confirm(`Delete profile "${selected}"? Its device is unenrolled and its saved tokens are deleted. This cannot be undone.`)) {
+      run(() => window.go.app.App.DeleteProfile(selected), 'Failed to delete profile');
+    }
+  };
+
+  const activeProfile = profiles.find((p) => p.active);
+
+  return (
+    <div className="info-card">
+      <h3>👤 Profile</h3>
+      <div className="form-group">
+        <select
+          className="form-input"
+          value={selected}
+          onChange={(e) => setSelected(e.target.value)}
+          disabled={isBusy}
+        >
+          {profiles.map((p) => (
+            <option key={p.name} value={p.name}>
+              {p.name}{p.active ? ' (active)' : ''} — {p.backendURL}
+            </option>
+          ))}
+        </select>
+      </div>
+      <div style={{ display: 'flex', gap: '10px', flexWrap: 'wrap' }}>
+        <button
+          className="btn btn-primary"
+          onClick={handleActivate}
+          disabled={isBusy || selected === activeProfile?.name}
+        >
+          ✅ Activate
+        </button>
+        <button className="btn" onClick={handleCreate} disabled={isBusy}>➕ New</button>
+        <button className="btn" onClick={handleClone} disabled={isBusy}>📋 Clone</button>
+        <button
+          className="btn"
+          onClick={handleDelete}
+          disabled={isBusy || selected === 'default' || selected === activeProfile?.name}
+        >
+          🗑️ Delete
+        </button>
+      </div>
+    </div>
+  );
+}
+
+export default Profiles;
@@ -1,14 +1,180 @@
 import { useState, useEffect } from 'react';
+import Profiles from './Profiles';
+import ImportExport from './ImportExport';
 
 function Settings() {
   const [config, setConfig] = useState<any>(null);
   const [isSaving, setIsSaving] = useState(false);
   const [isLoading, setIsLoading] = useState(true);
+  const [updateStatus, setUpdateStatus] = useState<any>(null);
+  const [isCheckingUpdates, setIsCheckingUpdates] = useState(false);
+  const [fieldErrors, setFieldErrors] = useState<Record<string, string>>({});
+  const [conflicts, setConflicts] = useState<string[]>([]);
+  const [secretsStatus, setSecretsStatus] = useState<any>(null);
+  const [passphrase, setPassphrase] = useState('');
+  const [deviceStatus, setDeviceStatus] = useState<any>(null);
+  const [enrollmentCode, setEnrollmentCode] = useState('');
+  const [cloudflareApiToken, setCloudflareApiToken] = useState('');
 
   useEffect(() => {
     loadConfig();
+    loadUpdateStatus();
+    loadSecretsStatus();
+    loadDeviceStatus();
+    window.go?.app?.App?.GetConfigConflicts().then((c) => setConflicts(c || []));
+
+    if (window.runtime && window.runtime.EventsOn) {
+      // The backend pushes status whenever a check runs or an upgrade is applied
+      const offUpdate = window.runtime.EventsOn('cloudflared:update', (status: any) => setUpdateStatus(status));
+      // External edits to config.json are merged by the backend
+      const offReloaded = window.runtime.EventsOn('config:reloaded', (cfg: any) => {
+        setConfig(cfg);
+        setConflicts([]);
+      });
+      const offConflict = window.runtime.EventsOn('config:conflict', (fields: string[]) => setConflicts(fields));
+      // Sent when the backend stops accepting the device credential
+      const offDevice = window.runtime.EventsOn('device:status', (status: any) => setDeviceStatus(status));
+      return () => {
+        offUpdate();
+        offReloaded();
+        offConflict();
+        offDevice();
+      };
+    }
   }, []);
 
+  const handleResolveConflict = async (useDisk: boolean) => {
+    try {
+      await window.go.app.App.ResolveConfigConflict(useDisk);
+      setConflicts([]);
+      if (useDisk) {
+        await loadConfig();
+      }
+    } catch (error: any) {
+      console.error('Resolve conflict error:', error);
+      alert(`Failed to resolve conflict: ${error.message || error}`);
+    }
+  };
+
+  const loadSecretsStatus = async () => {
+    try {
+      setSecretsStatus(await window.go?.app?.App?.GetSecretsStatus());
+    } catch (error) {
+      console.error('Failed to load secrets status:', error);
+    }
+  };
+
+  const handleUnlockSecrets = async () => {
+    try {
+      await window.go.app.App.UnlockSecretStore(passphrase);
+      setPassphrase('');
+      await loadSecretsStatus();
+      await loadDeviceStatus();
+    } catch (error: any) {
+      console.error('Unlock secrets error:', error);
+      alert(`Failed to unlock secret store: ${error.message || error}`);
+    }
+  };
+
+  // Enrollment saves the credential reference; keep unsaved edits but pick it up
+  const syncDeviceFields = async () => {
+    const saved = await window.go.app.App.GetConfig();
+    setConfig((cfg: any) => ({ ...cfg, deviceId: saved.deviceId, deviceCredentialRef: saved.deviceCredentialRef }));
+  };
+
+  const loadDeviceStatus = async () => {
+    try {
+      setDeviceStatus(await window.go?.app?.App?.GetDeviceStatus());
+    } catch (error) {
+      console.error('Failed to load device status:', error);
+    }
+  };
+
+  const handleEnroll = async () => {
+    try {
+      setDeviceStatus(await window.go.app.App.EnrollDevice(enrollmentCode.trim()));
+      setEnrollmentCode('');
+      await syncDeviceFields();
+    } catch (error: any) {
+      console.error('Enroll error:', error);
+      alert(`Failed to enroll device: ${error.message || error}`);
+    }
+  };
+
+  const handleUnenroll = async () => {
+    if (!confirm('Remove this device from the backend? It will need a new enrollment code to reconnect.')) {
+      return;
+    }
+    try {
+      await window.go.app.App.UnenrollDevice();
+      await loadDeviceStatus();
+      await syncDeviceFields();
+    } catch (error: any) {
+      console.error('Unenroll error:', error);
+      alert(`Failed to unenroll device: ${error.message || error}`);
+    }
+  };
+
+  const handleSaveCloudflareToken = async () => {
+    try {
+      await window.go.app.App.SaveCloudflareAPIToken(cloudflareApiToken.trim());
+      setCloudflareApiToken('');
+      const saved = await window.go.app.App.GetConfig();
+      setConfig((cfg: any) => ({
+        ...cfg,
+        tokenSource: { ...(cfg.tokenSource || {}), apiTokenRef: saved.tokenSource?.apiTokenRef },
+      }));
+    } catch (error: any) {
+      console.error('Save API token error:', error);
+      alert(`Failed to save Cloudflare API token: ${error.message || error}`);
+    }
+  };
+
+  const loadUpdateStatus = async () => {
+    try {
+      if (!window.go || !window.go.app || !window.go.app.App) {
+        return;
+      }
+      setUpdateStatus(await window.go.app.App.GetUpdateStatus());
+    } catch (error) {
+      console.error('Failed to load update status:', error);
+    }
+  };
+
+  const handleCheckUpdates = async () => {
+    setIsCheckingUpdates(true);
+    try {
+      setUpdateStatus(await window.go.app.App.CheckForUpdates());
+    } catch (error: any) {
+      console.error('Update check error:', error);
+      alert(`Failed to check for updates: ${error.message || error}`);
+    } finally {
+      setIsCheckingUpdates(false);
+    }
+  };
+
+  const handleClearCache = async () => {
+    if (!confirm('Delete cached cloudflared binaries? The version in use is kept.')) {
+      return;
+    }
+    try {
+      await window.go.app.App.ClearBinaryCache();
+      alert('Binary cache cleared.');
+    } catch (error: any) {
+      console.error('Clear cache error:', error);
+      alert(`Failed to clear cache: ${error.message || error}`);
+    }
+  };
+
+  const handleApplyUpdate = async () => {
+    try {
+      await window.go.app.App.ApplyUpdateNow();
+    } catch (error: any) {
+      console.error('Apply update error:', error);
+      alert(`Failed to apply update: ${error.message || error}`);
+    }
+  };
+
   const loadConfig = async () => {
     try {
       if (!window.go || !window.go.app || !window.go.app.App) {
@@ -31,8 +197,30 @@ function Settings() {
         throw new Error('Wails runtime not initialized');
       }
       
-      await window.go.app.App.UpdateConfig(config);
-      alert('Settings saved successfully!');
+      // Show problems next to their inputs instead of a single alert
+      const errors = await window.go.app.App.ValidateConfig(config);
+      const byField: Record<string, string> = {};
+      (errors || []).forEach((e) => {
+        byField[e.field] = e.message;
+      });
+      setFieldErrors(byField);
+      if (Object.keys(byField).length > 0) {
+        return;
+      }
+
+      const result = await window.go.app.App.UpdateConfig(config);
+      loadSecretsStatus();
+      if (result?.errors?.length > 0) {
+        alert(`Settings saved, but some changes could not be applied:\n${result.errors.join('\n')}`);
+      } else {
+        alert('Settings saved successfully!');
+      }
+
+      // Tunnel name and route changes need a restart, which interrupts traffic
+      if (result?.tunnelRestartPending &&
+          confirm('The tunnel is running. Restart it now to apply the new tunnel settings?')) {
+        await window.go.app.App.RestartTunnel();
+      }
     } catch (error: any) {
       console.error('Save config error:', error);
       alert(`Failed to save settings: ${error.message || error}`);
@@ -45,6 +233,30 @@ function Settings() {
     setConfig({ ...config, [field]: value });
   };
 
+  const handleProxyChange = (field: string, value: any) => {
+    setConfig({ ...config, proxy: { ...(config.proxy || {}), [field]: value } });
+  };
+
+  const handleTokenSourceChange = (field: string, value: any) => {
+    setConfig({ ...config, tokenSource: { ...(config.tokenSource || {}), [field]: value } });
+  };
+
+  const fieldError = (field: string) =>
+    fieldErrors[field] ? <div className="field-error">{fieldErrors[field]}</div> : null;
+
+  // Env and command-line values win over config.json on every start
+  const sourceHint = (field: string) => {
+    const source = config?.provenance?.[field];
+    if (source !== 'env' && source !== 'flag') {
+      return null;
+    }
+    return (
+      <div className="field-hint">
+        Set by {source === 'env' ? 'an environment variable' : 'a command-line flag'}; saved changes apply until the next start
+      </div>
+    );
+  };
+
   if (isLoading) {
     return <div>Loading settings...</div>;
   }
@@ -57,6 +269,20 @@ function Settings() {
     <div className="settings">
       <h2>⚙️ Settings</h2>
 
+      <Profiles onActivated={loadConfig} />
+
+      {conflicts.length > 0 && (
+        <div className="info-card" style={{ borderLeft: '4px solid #e74c3c' }}>
+          <p>
+            config.json was edited outside the app and conflicts with changes to: <strong>{conflicts.join(', ')}</strong>
+          </p>
+          <div style={{ display: 'flex', gap: '10px' }}>
+            <button className="btn" onClick={() => handleResolveConflict(true)}>📄 Use file on disk</button>
+            <button className="btn" onClick={() => handleResolveConflict(false)}>💾 Keep app settings</button>
+          </div>
+        </div>
+      )}
+
       <div className="form-group">
         <label className="form-label">Backend URL</label>
         <input
@@ -66,6 +292,34 @@ function Settings() {
           onChange={(e) => handleChange('backendURL', e.target.value)}
           placeholder="https://api.example.com"
         />
+        {sourceHint('backendURL')}
+        {fieldError('backendURL')}
+      </div>
+
+      <div className="form-group">
+        <label className="form-label">Fallback Backend URLs (comma-separated, tried in order)</label>
+        <input
+          type="text"
+          className="form-input"
+          defaultValue={(config.fallbackBackendURLs || []).join(', ')}
+          onBlur={(e) => handleChange('fallbackBackendURLs', e.target.value.split(',').map((u) => u.trim()).filter((u) => u))}
+          placeholder="https://api-backup.example.com"
+        />
+        {Object.keys(fieldErrors)
+          .filter((field) => field.startsWith('fallbackBackendURLs'))
+          .map((field) => <div key={field} className="field-error">{fieldErrors[field]}</div>)}
+      </div>
+
+      <div className="form-group checkbox-group">
+        <input
+          type="checkbox"
+          id="cacheLastToken"
+          checked={config.cacheLastToken || false}
+          onChange={(e) => handleChange('cacheLastToken', e.target.checked)}
+        />
+        <label htmlFor="cacheLastToken" className="form-label" style={{ marginBottom: 0 }}>
+          Keep the last tunnel token to start the tunnel while the backend is down
+        </label>
       </div>
 
       <div className="form-group">
@@ -77,6 +331,8 @@ function Settings() {
           onChange={(e) => handleChange('tunnelName', e.target.value)}
           placeholder="my-tunnel"
         />
+        {sourceHint('tunnelName')}
+        {fieldError('tunnelName')}
       </div>
 
       <div className="form-group">
@@ -89,6 +345,7 @@ function Settings() {
           min="60"
           max="3600"
         />
+        {fieldError('refreshInterval')}
       </div>
 
       <div className="form-group checkbox-group">
@@ -102,6 +359,7 @@ function Settings() {
           Auto-start tunnel on application startup
         </label>
       </div>
+      {sourceHint('autoStart')}
 
       <div className="form-group checkbox-group">
         <input
@@ -115,6 +373,307 @@ function Settings() {
         </label>
       </div>
 
+      <h3>🌐 Network</h3>
+
+      <div className="form-group">
+        <label className="form-label">HTTP Proxy</label>
+        <input
+          type="text"
+          className="form-input"
+          value={config.proxy?.httpProxy || ''}
+          onChange={(e) => handleProxyChange('httpProxy', e.target.value)}
+          placeholder="http://proxy.corp:3128"
+        />
+        {fieldError('proxy.httpProxy')}
+      </div>
+
+      <div className="form-group">
+        <label className="form-label">HTTPS Proxy</label>
+        <input
+          type="text"
+          className="form-input"
+          value={config.proxy?.httpsProxy || ''}
+          onChange={(e) => handleProxyChange('httpsProxy', e.target.value)}
+          placeholder="http://proxy.corp:3128"
+        />
+        {fieldError('proxy.httpsProxy')}
+      </div>
+
+      <div className="form-group">
+        <label className="form-label">SOCKS5 Proxy (overrides HTTP/HTTPS)</label>
+        <input
+          type="text"
+          className="form-input"
+          value={config.proxy?.socks5Proxy || ''}
+          onChange={(e) => handleProxyChange('socks5Proxy', e.target.value)}
+          placeholder="socks5://127.0.0.1:1080"
+        />
+        {fieldError('proxy.socks5Proxy')}
+      </div>
+
+      <div className="form-group">
+        <label className="form-label">No Proxy (comma-separated)</label>
+        <input
+          type="text"
+          className="form-input"
+          defaultValue={(config.proxy?.noProxy || []).join(', ')}
+          onBlur={(e) => handleProxyChange('noProxy', e.target.value.split(',').map((h) => h.trim()).filter((h) => h))}
+          placeholder="localhost, .corp.example.com, 10.0.0.0/8"
+        />
+      </div>
+
+      <div className="form-group">
+        <label className="form-label">Extra CA Bundle (PEM file path)</label>
+        <input
+          type="text"
+          className="form-input"
+          value={config.caBundlePath || ''}
+          onChange={(e) => handleChange('caBundlePath', e.target.value)}
+          placeholder="/etc/ssl/certs/corp-root.pem"
+        />
+        {fieldError('caBundlePath')}
+      </div>
+
+      <h3>🔐 Secrets</h3>
+
+      <div className="form-group">
+        <label className="form-label">Store tokens in</label>
+        <select
+          className="form-input"
+          value={config.secretStore || ''}
+          onChange={(e) => handleChange('secretStore', e.target.value)}
+        >
+          <option value="">Automatic (OS keyring if available)</option>
+          <option value="keyring">OS keyring</option>
+          <option value="file">Encrypted file (passphrase)</option>
+        </select>
+        {fieldError('secretStore')}
+        {secretsStatus && !secretsStatus.keyringAvailable && (
+          <div className="field-hint">OS keyring unavailable: {secretsStatus.keyringError}</div>
+        )}
+      </div>
+
+      {secretsStatus?.store === 'file' && !secretsStatus.fileStoreUnlocked && (
+        <div className="form-group">
+          <label className="form-label">
+            {secretsStatus.fileStoreExists ? 'Passphrase to unlock saved secrets' : 'Choose a passphrase for saved secrets'}
+          </label>
+          <div style={{ display: 'flex', gap: '10px' }}>
+            <input
+              type="password"
+              className="form-input"
+              value={passphrase}
+              onChange={(e) => setPassphrase(e.target.value)}
+            />
+            <button className="btn" onClick={handleUnlockSecrets} disabled={!passphrase}>🔓 Unlock</button>
+          </div>
+        </div>
+      )}
+
+      <div className="form-group checkbox-group">
+        <input
+          type="checkbox"
+          id="applyUpdatesImmediately"
+          checked={config.applyUpdatesImmediately || false}
+          onChange={(e) => handleChange('applyUpdatesImmediately', e.target.checked)}
+        />
+        <label htmlFor="applyUpdatesImmediately" className="form-label" style={{ marginBottom: 0 }}>
+          Restart the tunnel as soon as a cloudflared update is downloaded
+        </label>
+      </div>
+
+      <div className="form-group">
+        <label className="form-label">When the backend rotates the tunnel token</label>
+        <select
+          className="form-input"
+          value={config.tokenRotation || 'seamless'}
+          onChange={(e) => handleChange('tokenRotation', e.target.value)}
+        >
+          <option value="seamless">Switch over without downtime</option>
+          <option value="restart">Restart the tunnel</option>
+          <option value="manual">Notify me only</option>
+        </select>
+        {fieldError('tokenRotation')}
+      </div>
+
+      <h3>🔑 Tunnel Token</h3>
+
+      <div className="form-group">
+        <label className="form-label">Get the tunnel token from</label>
+        <select
+          className="form-input"
+          value={config.tokenSource?.type || 'backend'}
+          onChange={(e) => handleTokenSourceChange('type', e.target.value)}
+        >
+          <option value="backend">The backend</option>
+          <option value="static">The token saved when starting the tunnel</option>
+          <option value="file">A file</option>
+          <option value="command">A shell command</option>
+          <option value="env">An environment variable</option>
+          <option value="cloudflare">The Cloudflare API</option>
+        </select>
+        {fieldError('tokenSource.type')}
+      </div>
+
+      {config.tokenSource?.type === 'file' && (
+        <div className="form-group">
+          <label className="form-label">Token file</label>
+          <input
+            type="text"
+            className="form-input"
+            value={config.tokenSource?.path || ''}
+            onChange={(e) => handleTokenSourceChange('path', e.target.value)}
+            placeholder="/etc/cloudflared/tunnel-token"
+          />
+          {fieldError('tokenSource.path')}
+        </div>
+      )}
+
+      {config.tokenSource?.type === 'command' && (
+        <div className="form-group">
+          <label className="form-label">Command (its output is the token)</label>
+          <input
+            type="text"
+            className="form-input"
+            value={config.tokenSource?.command || ''}
+            onChange={(e) => handleTokenSourceChange('command', e.target.value)}
+            placeholder="vault read -field=token secret/tunnel"
+          />
+          {fieldError('tokenSource.command')}
+        </div>
+      )}
+
+      {config.tokenSource?.type === 'env' && (
+        <div className="form-group">
+          <label className="form-label">Environment variable</label>
+          <input
+            type="text"
+            className="form-input"
+            value={config.tokenSource?.envVar || ''}
+            onChange={(e) => handleTokenSourceChange('envVar', e.target.value.trim())}
+            placeholder="TUNNEL_TOKEN"
+          />
+          {fieldError('tokenSource.envVar')}
+        </div>
+      )}
+
+      {config.tokenSource?.type === 'cloudflare' && (
+        <>
+          <div className="form-group">
+            <label className="form-label">Cloudflare account ID</label>
+            <input
+              type="text"
+              className="form-input"
+              value={config.tokenSource?.accountId || ''}
+              onChange={(e) => handleTokenSourceChange('accountId', e.target.value.trim())}
+            />
+            {fieldError('tokenSource.accountId')}
+          </div>
+          <div className="form-group">
+            <label className="form-label">Tunnel ID</label>
+            <input
+              type="text"
+              className="form-input"
+              value={config.tokenSource?.tunnelId || ''}
+              onChange={(e) => handleTokenSourceChange('tunnelId', e.target.value.trim())}
+            />
+            {fieldError('tokenSource.tunnelId')}
+          </div>
+          <div className="form-group">
+            <label className="form-label">
+              API token (Cloudflare Tunnel Read){config.tokenSource?.apiTokenRef ? ' — saved' : ''}
+            </label>
+            <div style={{ display: 'flex', gap: '10px' }}>
+              <input
+                type="password"
+                className="form-input"
+                value={cloudflareApiToken}
+                onChange={(e) => setCloudflareApiToken(e.target.value)}
+              />
+              <button className="btn" onClick={handleSaveCloudflareToken} disabled={!cloudflareApiToken.trim()}>
+                💾 Save
+              </button>
+            </div>
+          </div>
+        </>
+      )}
+
+      <h3>🖥️ Device</h3>
+
+      <div className="form-group">
+        <label className="form-label">Device ID</label>
+        <div>{deviceStatus?.deviceId || 'Not generated yet'}</div>
+        <div className="field-hint">
+          {deviceStatus?.rejected
+            ? 'The backend rejected this device. Enroll it again with a new code.'
+            : deviceStatus?.loaded
+              ? 'Enrolled; backend requests are authenticated.'
+              : deviceStatus?.enrolled
+                ? `Enrolled, but the credential could not be read: ${deviceStatus.lastError}`
+                : 'Not enrolled; backend requests are sent without credentials.'}
+        </div>
+      </div>
+
+      <div className="form-group">
+        <label className="form-label">{deviceStatus?.enrolled ? 'Re-enroll with a new code' : 'Enrollment code'}</label>
+        <div style={{ display: 'flex', gap: '10px' }}>
+          <input
+            type="text"
+            className="form-input"
+            value={enrollmentCode}
+            onChange={(e) => setEnrollmentCode(e.target.value)}
+            placeholder="One-time code from the backend"
+          />
+          <button className="btn btn-primary" onClick={handleEnroll} disabled={!enrollmentCode.trim()}>
+            Enroll
+          </button>
+          {deviceStatus?.enrolled && (
+            <button className="btn btn-danger" onClick={handleUnenroll}>
+              Unenroll
+            </button>
+          )}
+        </div>
+      </div>
+
+      <h3>📡 Remote Commands</h3>
+
+      <div className="form-group">
+        <label className="form-label">Backend command public key (Ed25519, base64)</label>
+        <input
+          type="text"
+          className="form-input"
+          value={config.commandPublicKey || ''}
+          onChange={(e) => handleChange('commandPublicKey', e.target.value.trim())}
+          placeholder="Commands are refused until a key is set"
+        />
+        {fieldError('commandPublicKey')}
+      </div>
+
+      <div className="form-group">
+        <label className="form-label">Allow the backend to</label>
+        {[
+          ['restart', 'Restart the tunnel'],
+          ['update', 'Install cloudflared versions'],
+          ['patch', 'Change settings'],
+        ].map(([type, label]) => (
+          <div className="checkbox-group" key={type}>
+            <input
+              type="checkbox"
+              id={`allow-${type}`}
+              checked={(config.allowedCommands || []).includes(type)}
+              onChange={(e) => {
+                const allowed = (config.allowedCommands || []).filter((t: string) => t !== type);
+                handleChange('allowedCommands', e.target.checked ? [...allowed, type] : allowed);
+              }}
+            />
+            <label htmlFor={`allow-${type}`} className="form-label" style={{ marginBottom: 0 }}>
+              {label}
+            </label>
+          </div>
+        ))}
+        {fieldError('allowedCommands')}
+      </div>
+
       <button
         className="btn btn-primary"
         onClick={handleSave}
@@ -123,6 +682,47 @@ function Settings() {
         {isSaving ? '⏳ Saving...' : '💾 Save Settings'}
       </button>
 
+      <div style={{ marginTop: '30px' }}>
+        <ImportExport onImported={loadConfig} />
+      </div>
+
+      <div className="info-card" style={{ marginTop: '30px' }}>
+        <h3>cloudflared Updates</h3>
+        <div className="info-row">
+          <span className="info-label">Installed:</span>
+          <span className="info-value">{updateStatus?.currentVersion || 'N/A'}</span>
+        </div>
+        <div className="info-row">
+          <span className="info-label">Latest:</span>
+          <span className="info-value">{updateStatus?.latestVersion || 'N/A'}</span>
+        </div>
+        {updateStatus?.stagedVersion && (
+          <div className="info-row">
+            <span className="info-label">Ready to apply:</span>
+            <span className="info-value">{updateStatus.stagedVersion} (on next tunnel restart)</span>
+          </div>
+        )}
+        {updateStatus?.lastError && (
+          <div className="info-row">
+            <span className="info-label">Last error:</span>
+            <span className="info-value">{updateStatus.lastError}</span>
+          </div>
+        )}
+        <div style={{ display: 'flex', gap: '10px', marginTop: '10px' }}>
+          <button className="btn" onClick={handleCheckUpdates} disabled={isCheckingUpdates}>
+            {isCheckingUpdates ? '⏳ Checking...' : '🔄 Check for Updates'}
+          </button>
+          {updateStatus?.stagedVersion && (
+            <button className="btn btn-primary" onClick={handleApplyUpdate}>
+              ⬆️ Apply Now
+            </button>
+          )}
+          <button className="btn" onClick={handleClearCache}>
+            🗑️ Clear Cache
+          </button>
+        </div>
+      </div>
+
       <div className="info-card" style={{ marginTop: '30px' }}>
         <h3>About</h3>
         <div className="info-row">
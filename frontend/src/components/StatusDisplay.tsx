@@ -2,6 +2,24 @@ interface StatusDisplayProps {
   status: any;
 }
 
+// Go zero times marshal as year 1
+const formatTime = (value?: string) =>
+  value && !value.startsWith('0001-') ? new Date(value).toLocaleString() : 'N/A';
+
+// The commands websocket: connecting, connected, or waiting to retry
+const formatBackendLink = (conn?: any) => {
+  switch (conn?.state) {
+    case 'connected':
+      return `Connected since ${formatTime(conn.since)}`;
+    case 'connecting':
+      return 'Connecting...';
+    case 'backoff':
+      return `Retrying at ${formatTime(conn.retryAt)}${conn.lastError ? ` (${conn.lastError})` : ''}`;
+    default:
+      return 'Disconnected';
+  }
+};
+
 function StatusDisplay({ status }: StatusDisplayProps) {
   const isRunning = status?.running || false;
 
@@ -27,6 +45,31 @@ function StatusDisplay({ status }: StatusDisplayProps) {
             {isRunning ? `https://${status?.tunnelName}.cfargotunnel.com` : 'Not running'}
           </span>
         </div>
+        <div className="info-row">
+          <span className="info-label">Next Token Refresh:</span>
+          <span className="info-value">{formatTime(status?.token?.nextRefresh)}</span>
+        </div>
+        <div className="info-row">
+          <span className="info-label">Backend Link:</span>
+          <span className="info-value">{formatBackendLink(status?.backend)}</span>
+        </div>
+        {status?.endpoints?.length > 1 && (
+          <div className="info-row">
+            <span className="info-label">Backend Endpoint:</span>
+            <span className="info-value">
+              {status.endpoints.find((ep: any) => ep.active)?.url}
+              {' '}({status.endpoints.filter((ep: any) => ep.healthy).length}/{status.endpoints.length} healthy)
+            </span>
+          </div>
+        )}
+        {status?.token?.lastError && (
+          <div className="info-row">
+            <span className="info-label">Token Error:</span>
+            <span className="info-value">
+              {status.token.lastError} ({status.token.failures} failed)
+            </span>
+          </div>
+        )}
       </div>
 
       <div>
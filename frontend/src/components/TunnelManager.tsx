@@ -1,4 +1,4 @@
-import { useState } from 'react';
+import { useState, useEffect } from 'react';
 
 interface TunnelManagerProps {
   status: any;
@@ -8,6 +8,30 @@ function TunnelManager({ status }: TunnelManagerProps) {
   const [isLoading, setIsLoading] = useState(false);
   const [manualToken, setManualToken] = useState('');
   const [showTokenInput, setShowTokenInput] = useState(false);
+  const [rememberToken, setRememberToken] = useState(false);
+  const [secretsStatus, setSecretsStatus] = useState<any>(null);
+
+  useEffect(() => {
+    loadSecretsStatus();
+  }, []);
+
+  const loadSecretsStatus = async () => {
+    try {
+      setSecretsStatus(await window.go?.app?.App?.GetSecretsStatus());
+    } catch (error) {
+      console.error('Failed to load secrets status:', error);
+    }
+  };
+
+  const handleForgetToken = async () => {
+    try {
+      await window.go.app.App.ForgetManualToken();
+      await loadSecretsStatus();
+    } catch (error: any) {
+      console.error('Forget token error:', error);
+      alert(`Failed to forget saved token: ${error.message || error}`);
+    }
+  };
 
   const handleStart = async () => {
     setIsLoading(true);
@@ -17,6 +41,12 @@ function TunnelManager({ status }: TunnelManagerProps) {
         throw new Error('Wails runtime not initialized. Please run: wails dev');
       }
       
+      // Save the token in the keyring or encrypted store before using it
+      if (manualToken && rememberToken) {
+        await window.go.app.App.SaveManualToken(manualToken);
+        await loadSecretsStatus();
+      }
+
       // Pass manual token (empty string if not provided)
       await window.go.app.App.StartTunnel(manualToken);
       console.log('Tunnel started successfully');
@@ -109,13 +139,33 @@ function TunnelManager({ status }: TunnelManagerProps) {
                 resize: 'vertical'
               }}
             />
+            <div className="checkbox-group" style={{ marginTop: '8px' }}>
+              <input
+                type="checkbox"
+                id="rememberToken"
+                checked={rememberToken}
+                onChange={(e) => setRememberToken(e.target.checked)}
+              />
+              <label htmlFor="rememberToken" style={{ fontSize: '0.9rem' }}>
+                Remember this token ({secretsStatus?.store === 'keyring' ? 'OS keyring' : 'encrypted file'})
+              </label>
+            </div>
             <p style={{ fontSize: '0.85rem', color: '#6c757d', marginTop: '8px', marginBottom: 0 }}>
               💡 <strong>Tip:</strong> Leave empty to fetch token from backend automatically.
             </p>
           </div>
         )}
 
-        {!showTokenInput && (
+        {!showTokenInput && secretsStatus?.manualTokenSaved && (
+          <div style={{ display: 'flex', alignItems: 'center', justifyContent: 'space-between' }}>
+            <p style={{ fontSize: '0.9rem', color: '#6c757d', margin: 0 }}>
+              A saved token will be used when you start the tunnel.
+            </p>
+            <button className="btn" onClick={handleForgetToken} disabled={isRunning}>🗑️ Forget</button>
+          </div>
+        )}
+
+        {!showTokenInput && !secretsStatus?.manualTokenSaved && (
           <p style={{ fontSize: '0.9rem', color: '#6c757d', margin: 0 }}>
             Token will be fetched from backend API when you start the tunnel.
           </p>
@@ -10,7 +10,33 @@ declare global {
           StopTunnel(): Promise<void>;
           GetTunnelStatus(): Promise<any>;
           GetConfig(): Promise<any>;
-          UpdateConfig(config: any): Promise<void>;
+          UpdateConfig(config: any): Promise<any>;
+          RestartTunnel(): Promise<void>;
+          GetConfigConflicts(): Promise<string[]>;
+          ResolveConfigConflict(useDisk: boolean): Promise<void>;
+          ValidateConfig(config: any): Promise<{ field: string; message: string }[]>;
+          ExportConfig(format: string): Promise<string>;
+          PreviewConfigImport(data: string, mode: string): Promise<any>;
+          ImportConfig(data: string, mode: string, confirmBackend: boolean): Promise<any>;
+          ListProfiles(): Promise<{ name: string; active: boolean; backendURL: string; tunnelName: string }[]>;
+          CreateProfile(name: string): Promise<void>;
+          CloneProfile(source: string, name: string): Promise<void>;
+          DeleteProfile(name: string): Promise<void>;
+          ActivateProfile(name: string): Promise<void>;
+          GetUpdateStatus(): Promise<any>;
+          CheckForUpdates(): Promise<any>;
+          ApplyUpdateNow(): Promise<void>;
+          GetBinaryCacheInfo(): Promise<any>;
+          ClearBinaryCache(): Promise<void>;
+          GetNotices(): Promise<string[]>;
+          GetSecretsStatus(): Promise<any>;
+          UnlockSecretStore(passphrase: string): Promise<void>;
+          SaveManualToken(token: string): Promise<void>;
+          ForgetManualToken(): Promise<void>;
+          SaveCloudflareAPIToken(token: string): Promise<void>;
+          GetDeviceStatus(): Promise<any>;
+          EnrollDevice(code: string): Promise<any>;
+          UnenrollDevice(): Promise<void>;
           Greet(name: string): Promise<string>;
         };
       };
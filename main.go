@@ -3,6 +3,7 @@ package main
 import (
 	"embed"
 	"log"
+	"os"
 
 	"github.com/votanchat/cloudflared-desktop-tunnel/app"
 	"github.com/wailsapp/wails/v2"
@@ -19,11 +20,26 @@ var mainLogger = app.GetLogger("MAIN")
 var assets embed.FS
 
 func main() {
+	// Subcommands such as export/import run without the GUI
+	if handled, err := app.RunCommand(os.Args[1:], os.Stdout); handled {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Create an instance of the app structure
 	appInstance := app.NewApp()
 
+	// CFDT_* environment variables and flags take precedence over config.json
+	overrides, err := app.CollectConfigOverrides(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	appInstance.SetConfigOverrides(overrides)
+
 	// Create application with options
-	err := wails.Run(&options.App{
+	err = wails.Run(&options.App{
 		Title:  "Cloudflared Desktop Tunnel",
 		Width:  1024,
 		Height: 768,
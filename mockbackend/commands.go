@@ -0,0 +1,289 @@
+package mockbackend
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultCommandLifetime is how long pushed commands are valid unless they set a Deadline
+const DefaultCommandLifetime = 5 * time.Minute
+
+// Command is pushed to clients over the /api/commands websocket
+type Command struct {
+	ID       string                 `json:"id"` // Filled in by Push if empty
+	Type     string                 `json:"type"`
+	Payload  map[string]interface{} `json:"payload"`
+	DeviceID string                 `json:"deviceId"` // Empty = the device ID each client connected with
+	IssuedAt time.Time              `json:"issuedAt"` // Filled in by Push if zero
+	Deadline time.Time              `json:"deadline"` // Zero = DefaultCommandLifetime after IssuedAt
+}
+
+// client is an open command websocket
+type client struct {
+	writeMu  sync.Mutex
+	deviceID string // From the X-Device-ID header it connected with
+}
+
+// CommandReport is an ack, progress or result report sent back by a client
+type CommandReport struct {
+	Type        string    `json:"type"` // "ack", "in_progress" or "result"
+	CommandID   string    `json:"commandId"`
+	CommandType string    `json:"commandType"`
+	Status      string    `json:"status,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// SetSigningKey signs every pushed command with key, as the app requires.
+// Give the app PublicKey() as its command public key.
+func (s *Server) SetSigningKey(key ed25519.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signingKey = key
+}
+
+// PublicKey returns the base64 public half of the signing key, or "" if
+// commands are not signed
+func (s *Server) PublicKey() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signingKey == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(s.signingKey.Public().(ed25519.PublicKey))
+}
+
+// Push sends cmd to every connected client, or to the next one to connect
+// if there are none, and returns it with its ID and times filled in
+func (s *Server) Push(cmd Command) (Command, error) {
+	s.mu.Lock()
+	if cmd.ID == "" {
+		s.nextID++
+		cmd.ID = fmt.Sprintf("cmd-%d", s.nextID)
+	}
+	if cmd.IssuedAt.IsZero() {
+		cmd.IssuedAt = time.Now()
+	}
+	if cmd.Deadline.IsZero() {
+		cmd.Deadline = cmd.IssuedAt.Add(DefaultCommandLifetime)
+	}
+	key := s.signingKey
+	if _, err := encodeCommand(cmd, key); err != nil {
+		s.mu.Unlock()
+		return cmd, err
+	}
+	if len(s.conns) == 0 {
+		s.pending = append(s.pending, cmd)
+		s.mu.Unlock()
+		s.logf("Queued %s command %s until a client connects", cmd.Type, cmd.ID)
+		return cmd, nil
+	}
+	conns := make(map[*websocket.Conn]*client, len(s.conns))
+	for conn, c := range s.conns {
+		conns[conn] = c
+	}
+	s.mu.Unlock()
+
+	for conn, c := range conns {
+		s.deliver(conn, c, cmd, key)
+	}
+	s.logf("Pushed %s command %s", cmd.Type, cmd.ID)
+	return cmd, nil
+}
+
+// deliver signs cmd for one client, addressed to its device unless cmd names one
+func (s *Server) deliver(conn *websocket.Conn, c *client, cmd Command, key ed25519.PrivateKey) {
+	if cmd.DeviceID == "" {
+		cmd.DeviceID = c.deviceID
+	}
+	message, err := encodeCommand(cmd, key)
+	if err != nil {
+		s.logf("Failed to encode %s command %s: %v", cmd.Type, cmd.ID, err)
+		return
+	}
+	writeMessage(conn, &c.writeMu, message)
+}
+
+// encodeCommand marshals cmd, adding a signature over the same canonical
+// form the app verifies: sorted keys, no whitespace, no HTML escaping
+func encodeCommand(cmd Command, key ed25519.PrivateKey) ([]byte, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return data, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+	canonical, err := marshalNoEscape(fields)
+	if err != nil {
+		return nil, err
+	}
+	fields["signature"] = base64.StdEncoding.EncodeToString(ed25519.Sign(key, canonical))
+	return marshalNoEscape(fields)
+}
+
+func marshalNoEscape(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Reports returns the command reports received so far, oldest first
+func (s *Server) Reports() []CommandReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CommandReport(nil), s.reports...)
+}
+
+// WaitReport waits for a report of reportType ("ack", "in_progress" or
+// "result") about the command with the given ID
+func (s *Server) WaitReport(timeout time.Duration, commandID, reportType string) (CommandReport, error) {
+	var found CommandReport
+	err := s.wait(timeout, func() bool {
+		for _, report := range s.reports {
+			if report.CommandID == commandID && report.Type == reportType {
+				found = report
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return found, fmt.Errorf("no %s for command %s: %w", reportType, commandID, err)
+	}
+	return found, nil
+}
+
+// Connected returns the number of open command websockets
+func (s *Server) Connected() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// WaitConnected waits until at least n command websockets are open
+func (s *Server) WaitConnected(timeout time.Duration, n int) error {
+	return s.wait(timeout, func() bool { return len(s.conns) >= n })
+}
+
+// WaitDisconnected waits until no command websocket is open
+func (s *Server) WaitDisconnected(timeout time.Duration) error {
+	return s.wait(timeout, func() bool { return len(s.conns) == 0 })
+}
+
+// DropSockets closes every open command websocket without a close message,
+// like a network failure would
+func (s *Server) DropSockets() {
+	s.mu.Lock()
+	conns := make([]*websocket.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.NetConn().Close()
+	}
+	if len(conns) > 0 {
+		s.logf("Dropped %d websockets", len(conns))
+	}
+}
+
+// handleCommands upgrades to the commands websocket, delivers queued
+// commands and records the reports the client sends back
+func (s *Server) handleCommands(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(w, r) {
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logf("Websocket upgrade failed: %v", err)
+		return
+	}
+	c := &client{deviceID: r.Header.Get("X-Device-ID")}
+
+	s.mu.Lock()
+	s.conns[conn] = c
+	pending := s.pending
+	s.pending = nil
+	key := s.signingKey
+	dropAfter := s.faults.DropSocketsAfter
+	s.notify()
+	s.mu.Unlock()
+	s.logf("Client connected from %s", r.RemoteAddr)
+
+	defer func() {
+		conn.Close()
+		s.logf("Client %s disconnected", r.RemoteAddr)
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.notify()
+		s.mu.Unlock()
+	}()
+
+	if dropAfter > 0 {
+		timer := time.AfterFunc(dropAfter, func() {
+			s.logf("Dropping websocket of %s (injected)", r.RemoteAddr)
+			conn.NetConn().Close()
+		})
+		defer timer.Stop()
+	}
+
+	for _, cmd := range pending {
+		s.deliver(conn, c, cmd, key)
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var report CommandReport
+		if err := json.Unmarshal(data, &report); err != nil {
+			s.logf("Ignoring malformed report: %v", err)
+			continue
+		}
+
+		s.mu.Lock()
+		s.reports = append(s.reports, report)
+		s.notify()
+		s.mu.Unlock()
+		if report.Error != "" {
+			s.logf("Report: %s %s %s %s (%s)", report.CommandType, report.CommandID, report.Type, report.Status, report.Error)
+		} else {
+			s.logf("Report: %s %s %s %s", report.CommandType, report.CommandID, report.Type, report.Status)
+		}
+
+		// Confirm results so the client stops replaying them
+		if report.Type == "result" {
+			receipt, _ := json.Marshal(map[string]string{"type": "result_received", "id": report.CommandID})
+			writeMessage(conn, &c.writeMu, receipt)
+		}
+	}
+}
+
+func writeMessage(conn *websocket.Conn, writeMu *sync.Mutex, message []byte) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	conn.WriteMessage(websocket.TextMessage, message)
+}
@@ -0,0 +1,29 @@
+// Package mocktest runs a mockbackend server inside Go tests. It is kept
+// apart from mockbackend so the app binary does not link the testing package.
+package mocktest
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/votanchat/cloudflared-desktop-tunnel/mockbackend"
+)
+
+// New starts a server on a loopback port for the duration of a test.
+// Its log goes to tb.Logf; its URL is in the returned httptest.Server.
+func New(tb testing.TB) (*mockbackend.Server, *httptest.Server) {
+	tb.Helper()
+	s := mockbackend.New()
+	s.Logf = tb.Logf
+	ts := httptest.NewServer(s)
+	tb.Cleanup(func() {
+		// Socket handlers log until they return, which must be before the test ends
+		s.DropSockets()
+		if err := s.WaitDisconnected(5 * time.Second); err != nil {
+			tb.Errorf("mock backend websockets did not close: %v", err)
+		}
+		ts.Close()
+	})
+	return s, ts
+}
@@ -0,0 +1,84 @@
+package mockbackend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ScriptStep pushes Command After the previous step (or the start of the script)
+type ScriptStep struct {
+	After   time.Duration
+	Command Command
+	Expires time.Duration // Deadline relative to the push; 0 = DefaultCommandLifetime
+}
+
+// scriptStepJSON is a step as written in a script file:
+//
+//	[{"after": "10s", "type": "restart"},
+//	 {"after": "1m", "type": "patch", "payload": {"autoStart": true}, "expires": "30s"}]
+type scriptStepJSON struct {
+	After   string                 `json:"after"`
+	Type    string                 `json:"type"`
+	Payload map[string]interface{} `json:"payload"`
+	Expires string                 `json:"expires"`
+}
+
+// LoadScript reads a JSON command script
+func LoadScript(path string) ([]ScriptStep, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script: %w", err)
+	}
+	var raw []scriptStepJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse script: %w", err)
+	}
+
+	steps := make([]ScriptStep, len(raw))
+	for i, r := range raw {
+		if r.Type == "" {
+			return nil, fmt.Errorf("script step %d: type is required", i)
+		}
+		step := ScriptStep{Command: Command{Type: r.Type, Payload: r.Payload}}
+		if step.After, err = parseOptionalDuration(r.After); err != nil {
+			return nil, fmt.Errorf("script step %d: after: %w", i, err)
+		}
+		if step.Expires, err = parseOptionalDuration(r.Expires); err != nil {
+			return nil, fmt.Errorf("script step %d: expires: %w", i, err)
+		}
+		steps[i] = step
+	}
+	return steps, nil
+}
+
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// RunScript pushes the steps in order, waiting between them, until the
+// script ends or ctx is cancelled
+func (s *Server) RunScript(ctx context.Context, steps []ScriptStep) error {
+	for _, step := range steps {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(step.After):
+		}
+
+		cmd := step.Command
+		if step.Expires > 0 {
+			cmd.IssuedAt = time.Now()
+			cmd.Deadline = cmd.IssuedAt.Add(step.Expires)
+		}
+		if _, err := s.Push(cmd); err != nil {
+			return fmt.Errorf("failed to push %s command: %w", cmd.Type, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+// Package mockbackend is a stand-in for the tunnel backend, for development
+// and end-to-end tests. It serves /api/token, /api/status, /api/health,
+// device enrollment and the /api/commands websocket, records what clients
+// send, pushes scripted commands and can inject faults.
+//
+// It speaks the wire protocol on its own rather than importing the app, so a
+// change on either side that breaks the protocol shows up in tests.
+package mockbackend
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultTokenLifetime is how long served tokens are valid unless SetToken says otherwise
+const DefaultTokenLifetime = time.Hour
+
+// StatusReport is what clients POST to /api/status
+type StatusReport struct {
+	DeviceID           string    `json:"deviceId"`
+	Time               time.Time `json:"time"`
+	Reason             string    `json:"reason"`
+	TunnelName         string    `json:"tunnelName"`
+	TunnelRunning      bool      `json:"tunnelRunning"`
+	Connections        int       `json:"connections"`
+	CloudflaredVersion string    `json:"cloudflaredVersion"`
+	AppVersion         string    `json:"appVersion"`
+	OS                 string    `json:"os"`
+	Arch               string    `json:"arch"`
+	UptimeSeconds      int64     `json:"uptimeSeconds"`
+	RoutesHash         string    `json:"routesHash"`
+	RecentErrors       []string  `json:"recentErrors"`
+
+	Received time.Time `json:"-"` // When the server got it
+}
+
+// Faults makes the server misbehave
+type Faults struct {
+	Delay            time.Duration // Added before every HTTP response
+	ErrorRate        float64       // Fraction of HTTP requests answered with a 500, 0 to 1
+	DropSocketsAfter time.Duration // Close each websocket this long after it connects; 0 = never
+}
+
+// Server is a mock backend. It is an http.Handler; use mocktest.New for a test
+// server or ListenAndServe for a standalone one.
+type Server struct {
+	// Logf, if set, receives a line for every request and websocket event
+	Logf func(format string, args ...interface{})
+
+	mu        sync.Mutex
+	token     string
+	expiresIn time.Duration
+	faults    Faults
+	failNext  int // Requests still to fail with a 500 before ErrorRate applies
+
+	requireAuth bool
+	codes       map[string]bool   // One-time enrollment codes, false once used; empty = any code is accepted
+	credentials map[string]string // Credential -> device ID
+
+	statuses []StatusReport
+	reports  []CommandReport
+	changed  chan struct{} // Closed and replaced whenever something is recorded
+
+	signingKey ed25519.PrivateKey
+	conns      map[*websocket.Conn]*client // Open command sockets
+	pending    []Command                   // Commands pushed while no client was connected
+	nextID     int
+
+	mux      *http.ServeMux
+	upgrader websocket.Upgrader
+}
+
+// New returns a server handing out a random tunnel token
+func New() *Server {
+	s := &Server{
+		token:       NewToken(),
+		expiresIn:   DefaultTokenLifetime,
+		codes:       map[string]bool{},
+		credentials: map[string]string{},
+		changed:     make(chan struct{}),
+		conns:       map[*websocket.Conn]*client{},
+		mux:         http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET /api/health", s.handleHealth)
+	s.mux.HandleFunc("GET /api/token", s.handleToken)
+	s.mux.HandleFunc("POST /api/status", s.handleStatus)
+	s.mux.HandleFunc("POST /api/devices/enroll", s.handleEnroll)
+	s.mux.HandleFunc("DELETE /api/devices/{id}", s.handleUnenroll)
+	s.mux.HandleFunc("GET /api/commands", s.handleCommands)
+	return s
+}
+
+// ListenAndServe serves on addr until ctx is cancelled
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: s}
+	go func() {
+		<-ctx.Done()
+		s.DropSockets()
+		srv.Close()
+	}()
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// NewToken returns a random token in cloudflared's format: base64 JSON with
+// the account tag, tunnel ID and tunnel secret
+func NewToken() string {
+	id := hex.EncodeToString(randomBytes(16))
+	data, _ := json.Marshal(map[string]string{
+		"a": hex.EncodeToString(randomBytes(16)),
+		"t": id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:32],
+		"s": base64.StdEncoding.EncodeToString(randomBytes(32)),
+	})
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// SetToken sets the token served from now on and how long it is valid for
+func (s *Server) SetToken(token string, expiresIn time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+	s.expiresIn = expiresIn
+}
+
+// RotateToken switches to a new random token and returns it
+func (s *Server) RotateToken() string {
+	token := NewToken()
+	s.mu.Lock()
+	s.token = token
+	s.mu.Unlock()
+	return token
+}
+
+// Token returns the token currently served
+func (s *Server) Token() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+// SetFaults replaces the injected faults
+func (s *Server) SetFaults(faults Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+}
+
+// FailNext answers the next n HTTP requests with a 500
+func (s *Server) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failNext = n
+}
+
+// RequireEnrollment makes the token, status and command endpoints answer 401
+// unless the request carries a credential issued by /api/devices/enroll
+func (s *Server) RequireEnrollment(require bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requireAuth = require
+}
+
+// AddEnrollmentCode adds a one-time enrollment code. Once any code is added,
+// only added codes are accepted.
+func (s *Server) AddEnrollmentCode(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[code] = true
+}
+
+// Statuses returns the status reports received so far, oldest first
+func (s *Server) Statuses() []StatusReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]StatusReport(nil), s.statuses...)
+}
+
+// WaitStatus waits until a status report matching match has been received
+func (s *Server) WaitStatus(timeout time.Duration, match func(StatusReport) bool) (StatusReport, error) {
+	var found StatusReport
+	err := s.wait(timeout, func() bool {
+		for _, status := range s.statuses {
+			if match(status) {
+				found = status
+				return true
+			}
+		}
+		return false
+	})
+	return found, err
+}
+
+// wait calls done with s.mu held whenever something is recorded, until it
+// returns true or timeout passes
+func (s *Server) wait(timeout time.Duration, done func() bool) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		ok := done()
+		changed := s.changed
+		s.mu.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+	}
+}
+
+// notify wakes up waiters. Callers hold s.mu.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf("[mock backend] "+format, args...)
+	}
+}
+
+// ServeHTTP applies the injected faults, then serves the mock API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	faults := s.faults
+	fail := s.failNext > 0 || (faults.ErrorRate > 0 && mathrand.Float64() < faults.ErrorRate)
+	if s.failNext > 0 {
+		s.failNext--
+	}
+	s.mu.Unlock()
+
+	if faults.Delay > 0 {
+		select {
+		case <-time.After(faults.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fail {
+		s.logf("%s %s -> injected 500", r.Method, r.URL.Path)
+		http.Error(w, "injected failure", http.StatusInternalServerError)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorized checks the device credential when enrollment is required
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.requireAuth {
+		return true
+	}
+	credential, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && s.credentials[credential] != "" && s.credentials[credential] == r.Header.Get("X-Device-ID") {
+		return true
+	}
+	s.logf("%s %s -> 401", r.Method, r.URL.Path)
+	http.Error(w, "device is not enrolled", http.StatusUnauthorized)
+	return false
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(w, r) {
+		return
+	}
+	s.mu.Lock()
+	resp := map[string]interface{}{"token": s.token}
+	if s.expiresIn > 0 {
+		resp["expiresAt"] = time.Now().Add(s.expiresIn)
+	}
+	s.mu.Unlock()
+	s.logf("GET /api/token")
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(w, r) {
+		return
+	}
+	var status StatusReport
+	if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status.Received = time.Now()
+
+	s.mu.Lock()
+	s.statuses = append(s.statuses, status)
+	s.notify()
+	s.mu.Unlock()
+	s.logf("POST /api/status: %s, running=%v, connections=%d", status.Reason, status.TunnelRunning, status.Connections)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code     string `json:"code"`
+		DeviceID string `json:"deviceId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" || req.DeviceID == "" {
+		http.Error(w, "code and deviceId are required", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	if len(s.codes) > 0 && !s.codes[req.Code] {
+		s.mu.Unlock()
+		http.Error(w, "unknown or used enrollment code", http.StatusUnauthorized)
+		return
+	}
+	if _, ok := s.codes[req.Code]; ok {
+		// Kept as used so the map never empties back to accepting any code
+		s.codes[req.Code] = false
+	}
+	credential := hex.EncodeToString(randomBytes(32))
+	s.credentials[credential] = req.DeviceID
+	s.mu.Unlock()
+
+	s.logf("Enrolled device %s", req.DeviceID)
+	writeJSON(w, map[string]string{"credential": credential})
+}
+
+func (s *Server) handleUnenroll(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	s.mu.Lock()
+	found := false
+	for credential, deviceID := range s.credentials {
+		if deviceID == id {
+			delete(s.credentials, credential)
+			found = true
+		}
+	}
+	s.mu.Unlock()
+
+	if !found {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	s.logf("Unenrolled device %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
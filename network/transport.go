@@ -0,0 +1,185 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Options describes the proxy and TLS settings shared by all outbound connections
+type Options struct {
+	HTTPProxy    string   // Proxy for http:// requests, e.g. "http://proxy.corp:3128"
+	HTTPSProxy   string   // Proxy for https:// requests
+	SOCKS5Proxy  string   // e.g. "socks5://127.0.0.1:1080"; overrides HTTPProxy and HTTPSProxy
+	NoProxy      []string // Hosts, domains (".corp") or CIDRs that bypass the proxy
+	CABundlePath string   // PEM file with extra root CAs trusted in addition to the system pool
+}
+
+// IsZero reports whether no proxy or CA settings are configured, in which case
+// the standard proxy environment variables apply
+func (o Options) IsZero() bool {
+	return o.HTTPProxy == "" && o.HTTPSProxy == "" && o.SOCKS5Proxy == "" &&
+		len(o.NoProxy) == 0 && o.CABundlePath == ""
+}
+
+// NewTransport builds an HTTP transport honoring the proxy and CA settings
+func NewTransport(opts Options) (*http.Transport, error) {
+	tlsConfig, err := tlsConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := proxyFunc(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// NewDialer builds a websocket dialer honoring the proxy and CA settings
+func NewDialer(opts Options) (*websocket.Dialer, error) {
+	tlsConfig, err := tlsConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := proxyFunc(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &websocket.Dialer{
+		Proxy:            proxy,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: 45 * time.Second,
+		NetDialContext:   (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	}, nil
+}
+
+// ProxyEnv returns HTTP_PROXY-style environment variables for child processes
+// such as cloudflared. Without a configured proxy it only adds the NoProxy
+// hosts to those in the environment.
+func ProxyEnv(opts Options) []string {
+	httpProxy, httpsProxy := opts.HTTPProxy, opts.HTTPSProxy
+	if opts.SOCKS5Proxy != "" {
+		httpProxy, httpsProxy = opts.SOCKS5Proxy, opts.SOCKS5Proxy
+	}
+
+	var env []string
+	if httpProxy != "" {
+		env = append(env, "HTTP_PROXY="+httpProxy, "http_proxy="+httpProxy)
+	}
+	if httpsProxy != "" {
+		env = append(env, "HTTPS_PROXY="+httpsProxy, "https_proxy="+httpsProxy)
+	}
+	if len(opts.NoProxy) > 0 {
+		noProxy := strings.Join(opts.NoProxy, ",")
+		if len(env) == 0 {
+			noProxy = joinNoProxy(httpproxy.FromEnvironment().NoProxy, opts.NoProxy)
+		}
+		env = append(env, "NO_PROXY="+noProxy, "no_proxy="+noProxy)
+	}
+	return env
+}
+
+// joinNoProxy adds hosts to a comma-separated NO_PROXY list
+func joinNoProxy(list string, hosts []string) string {
+	if list == "" {
+		return strings.Join(hosts, ",")
+	}
+	return list + "," + strings.Join(hosts, ",")
+}
+
+// ValidateProxyURL checks that raw is an absolute http, https or socks5 proxy URL
+func ValidateProxyURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid proxy URL %q", raw)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return nil
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q in %q", u.Scheme, raw)
+	}
+}
+
+// proxyFunc returns the proxy selector for opts, falling back to the
+// environment when no proxy is configured. NoProxy applies either way.
+func proxyFunc(opts Options) (func(*http.Request) (*url.URL, error), error) {
+	httpProxy, httpsProxy := opts.HTTPProxy, opts.HTTPSProxy
+	if opts.SOCKS5Proxy != "" {
+		httpProxy, httpsProxy = opts.SOCKS5Proxy, opts.SOCKS5Proxy
+	}
+
+	if httpProxy == "" && httpsProxy == "" {
+		if len(opts.NoProxy) == 0 {
+			return http.ProxyFromEnvironment, nil
+		}
+		cfg := httpproxy.FromEnvironment()
+		cfg.NoProxy = joinNoProxy(cfg.NoProxy, opts.NoProxy)
+		selector := cfg.ProxyFunc()
+		return func(req *http.Request) (*url.URL, error) {
+			return selector(req.URL)
+		}, nil
+	}
+
+	for _, raw := range []string{httpProxy, httpsProxy} {
+		if raw == "" {
+			continue
+		}
+		if err := ValidateProxyURL(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &httpproxy.Config{
+		HTTPProxy:  httpProxy,
+		HTTPSProxy: httpsProxy,
+		NoProxy:    strings.Join(opts.NoProxy, ","),
+	}
+	selector := cfg.ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return selector(req.URL)
+	}, nil
+}
+
+// tlsConfig returns a TLS config trusting the system roots plus the extra CA
+// bundle, or nil when no bundle is configured
+func tlsConfig(opts Options) (*tls.Config, error) {
+	if opts.CABundlePath == "" {
+		return nil, nil
+	}
+
+	pem, err := os.ReadFile(opts.CABundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", opts.CABundlePath)
+	}
+
+	return &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,236 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters for deriving the file key from the passphrase
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	fileKeySize  = 32 // AES-256
+	fileSaltSize = 16
+)
+
+// encryptedFile is the on-disk form of a FileStore
+type encryptedFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"` // AES-GCM sealed JSON object of key -> value
+}
+
+// FileStore keeps secrets in a file encrypted with a key derived from a
+// passphrase. It is the fallback where no OS keyring is available.
+type FileStore struct {
+	mu      sync.Mutex
+	path    string
+	key     []byte // nil while locked
+	salt    []byte
+	secrets map[string]string
+}
+
+// NewFileStore returns a locked store backed by path. The file is created on
+// the first Unlock.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Name implements Store
+func (s *FileStore) Name() string {
+	return StoreFile
+}
+
+// Exists reports whether the encrypted file has been created
+func (s *FileStore) Exists() bool {
+	_, err := os.Stat(s.path)
+	return err == nil
+}
+
+// Unlocked reports whether Unlock has succeeded
+func (s *FileStore) Unlocked() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.key != nil
+}
+
+// Unlock decrypts the file with passphrase, or creates an empty store
+// protected by it if the file does not exist yet
+func (s *FileStore) Unlock(passphrase string) error {
+	if passphrase == "" {
+		return fmt.Errorf("passphrase must not be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		salt := make([]byte, fileSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		key, err := deriveFileKey(passphrase, salt)
+		if err != nil {
+			return err
+		}
+		s.key, s.salt, s.secrets = key, salt, map[string]string{}
+		return s.save()
+	}
+	if err != nil {
+		return err
+	}
+
+	var file encryptedFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("secret store %s is corrupt: %w", s.path, err)
+	}
+	key, err := deriveFileKey(passphrase, file.Salt)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	plaintext, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return ErrBadPassphrase
+	}
+	secrets := map[string]string{}
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return fmt.Errorf("secret store %s is corrupt: %w", s.path, err)
+	}
+
+	s.key, s.salt, s.secrets = key, file.Salt, secrets
+	return nil
+}
+
+// Lock forgets the key and decrypted secrets
+func (s *FileStore) Lock() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key, s.secrets = nil, nil
+}
+
+// Get implements Store
+func (s *FileStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key == nil {
+		return "", ErrLocked
+	}
+	value, ok := s.secrets[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+// Set implements Store
+func (s *FileStore) Set(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key == nil {
+		return ErrLocked
+	}
+	s.secrets[key] = value
+	return s.save()
+}
+
+// Delete implements Store
+func (s *FileStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key == nil {
+		return ErrLocked
+	}
+	if _, ok := s.secrets[key]; !ok {
+		return ErrNotFound
+	}
+	delete(s.secrets, key)
+	return s.save()
+}
+
+// save encrypts the secrets with a fresh nonce and replaces the file. Callers hold s.mu.
+func (s *FileStore) save() error {
+	plaintext, err := json.Marshal(s.secrets)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(s.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(encryptedFile{
+		Version: 1,
+		Salt:    s.salt,
+		Nonce:   nonce,
+		Data:    gcm.Seal(nil, nonce, plaintext, nil),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFilePrivate(s.path, data)
+}
+
+// deriveFileKey stretches passphrase into an AES key
+func deriveFileKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, fileKeySize)
+}
+
+// newGCM returns an AES-GCM cipher for key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeFilePrivate writes data readable by the current user only, via a temp
+// file and rename so a crash never leaves a half-written store
+func writeFilePrivate(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	if err := tmpFile.Chmod(0600); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
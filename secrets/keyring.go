@@ -0,0 +1,38 @@
+package secrets
+
+// Keyring stores secrets in the OS keyring: the Secret Service over D-Bus on
+// Linux, the login keychain on macOS and Credential Manager on Windows
+type Keyring struct {
+	service string
+}
+
+// NewKeyring returns a keyring store that files secrets under service
+func NewKeyring(service string) *Keyring {
+	return &Keyring{service: service}
+}
+
+// Name implements Store
+func (k *Keyring) Name() string {
+	return StoreKeyring
+}
+
+// Available returns nil if the keyring can be used, or an error wrapping
+// ErrUnavailable explaining why not
+func (k *Keyring) Available() error {
+	return keyringProbe(k.service)
+}
+
+// Get implements Store
+func (k *Keyring) Get(key string) (string, error) {
+	return keyringGet(k.service, key)
+}
+
+// Set implements Store
+func (k *Keyring) Set(key, value string) error {
+	return keyringSet(k.service, key, value)
+}
+
+// Delete implements Store
+func (k *Keyring) Delete(key string) error {
+	return keyringDelete(k.service, key)
+}
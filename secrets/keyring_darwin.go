@@ -0,0 +1,66 @@
+//go:build darwin
+
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// securityItemNotFound is the exit code of `security` when no item matches
+const securityItemNotFound = 44
+
+// runSecurity runs the macOS security tool against the login keychain
+func runSecurity(args ...string) (string, error) {
+	return runSecurityInput("", args...)
+}
+
+// runSecurityInput runs the security tool with input on its stdin, so that
+// secrets never appear in its command line
+func runSecurityInput(input string, args ...string) (string, error) {
+	cmd := exec.Command("/usr/bin/security", args...)
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == securityItemNotFound {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("security %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSuffix(stdout.String(), "\n"), nil
+}
+
+func keyringProbe(service string) error {
+	if _, err := exec.LookPath("/usr/bin/security"); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return nil
+}
+
+func keyringGet(service, key string) (string, error) {
+	return runSecurity("find-generic-password", "-s", service, "-a", key, "-w")
+}
+
+func keyringSet(service, key, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("keychain secrets must not contain line breaks")
+	}
+	// -U updates an existing item instead of failing. A trailing -w without a
+	// value makes security prompt for the password and then its confirmation,
+	// which are read from stdin instead of being visible in the process list.
+	_, err := runSecurityInput(value+"\n"+value+"\n", "add-generic-password", "-U", "-s", service, "-a", key, "-w")
+	return err
+}
+
+func keyringDelete(service, key string) error {
+	_, err := runSecurity("delete-generic-password", "-s", service, "-a", key)
+	return err
+}
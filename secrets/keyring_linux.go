@@ -0,0 +1,247 @@
+//go:build linux
+
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Secret Service API, see https://specifications.freedesktop.org/secret-service-spec/
+const (
+	secretServiceDest = "org.freedesktop.secrets"
+	secretServicePath = dbus.ObjectPath("/org/freedesktop/secrets")
+	serviceIface      = "org.freedesktop.Secret.Service"
+	collectionIface   = "org.freedesktop.Secret.Collection"
+	itemIface         = "org.freedesktop.Secret.Item"
+	sessionIface      = "org.freedesktop.Secret.Session"
+	promptIface       = "org.freedesktop.Secret.Prompt"
+
+	noObject      = dbus.ObjectPath("/") // Returned when no prompt or collection exists
+	promptTimeout = 2 * time.Minute      // How long the user has to answer an unlock prompt
+)
+
+// secretValue is the Secret struct of the Secret Service API
+type secretValue struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// secretService is an open session with the Secret Service
+type secretService struct {
+	conn    *dbus.Conn
+	session dbus.ObjectPath
+}
+
+// openSecretService connects to the session bus and opens a plain-text
+// session; the bus itself is private to the user
+func openSecretService() (*secretService, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	err = conn.Object(secretServiceDest, secretServicePath).
+		Call(serviceIface+".OpenSession", 0, "plain", dbus.MakeVariant("")).
+		Store(&output, &session)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return &secretService{conn: conn, session: session}, nil
+}
+
+// close ends the session and the connection
+func (s *secretService) close() {
+	s.conn.Object(secretServiceDest, s.session).Call(sessionIface+".Close", 0)
+	s.conn.Close()
+}
+
+// attributes identify our items in the keyring
+func attributes(service, key string) map[string]string {
+	return map[string]string{"service": service, "account": key}
+}
+
+// defaultCollection returns the collection new secrets are stored in
+func (s *secretService) defaultCollection() (dbus.ObjectPath, error) {
+	var path dbus.ObjectPath
+	err := s.conn.Object(secretServiceDest, secretServicePath).
+		Call(serviceIface+".ReadAlias", 0, "default").
+		Store(&path)
+	if err != nil {
+		return "", err
+	}
+	if path == noObject {
+		return "", fmt.Errorf("%w: no default keyring collection", ErrUnavailable)
+	}
+	return path, nil
+}
+
+// findItem returns the unlocked item holding key
+func (s *secretService) findItem(service, key string) (dbus.ObjectPath, error) {
+	var unlocked, locked []dbus.ObjectPath
+	err := s.conn.Object(secretServiceDest, secretServicePath).
+		Call(serviceIface+".SearchItems", 0, attributes(service, key)).
+		Store(&unlocked, &locked)
+	if err != nil {
+		return "", err
+	}
+	if len(unlocked) > 0 {
+		return unlocked[0], nil
+	}
+	if len(locked) == 0 {
+		return "", ErrNotFound
+	}
+	if err := s.unlock(locked[:1]); err != nil {
+		return "", err
+	}
+	return locked[0], nil
+}
+
+// unlock unlocks objects, prompting the user if the keyring requires it
+func (s *secretService) unlock(objects []dbus.ObjectPath) error {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	err := s.conn.Object(secretServiceDest, secretServicePath).
+		Call(serviceIface+".Unlock", 0, objects).
+		Store(&unlocked, &prompt)
+	if err != nil {
+		return err
+	}
+	return s.prompt(prompt)
+}
+
+// prompt shows a Secret Service prompt and waits for the user to complete it
+func (s *secretService) prompt(prompt dbus.ObjectPath) error {
+	if prompt == noObject || prompt == "" {
+		return nil
+	}
+
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(prompt),
+		dbus.WithMatchInterface(promptIface),
+		dbus.WithMatchMember("Completed"),
+	}
+	if err := s.conn.AddMatchSignal(match...); err != nil {
+		return err
+	}
+	defer s.conn.RemoveMatchSignal(match...)
+
+	signals := make(chan *dbus.Signal, 1)
+	s.conn.Signal(signals)
+	defer s.conn.RemoveSignal(signals)
+
+	if err := s.conn.Object(secretServiceDest, prompt).Call(promptIface+".Prompt", 0, "").Err; err != nil {
+		return err
+	}
+
+	timeout := time.After(promptTimeout)
+	for {
+		select {
+		case signal := <-signals:
+			if signal.Path != prompt || signal.Name != promptIface+".Completed" {
+				continue
+			}
+			if len(signal.Body) > 0 {
+				if dismissed, _ := signal.Body[0].(bool); dismissed {
+					return errors.New("keyring prompt was dismissed")
+				}
+			}
+			return nil
+		case <-timeout:
+			return errors.New("timed out waiting for keyring prompt")
+		}
+	}
+}
+
+func keyringProbe(service string) error {
+	s, err := openSecretService()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	_, err = s.defaultCollection()
+	return err
+}
+
+func keyringGet(service, key string) (string, error) {
+	s, err := openSecretService()
+	if err != nil {
+		return "", err
+	}
+	defer s.close()
+
+	item, err := s.findItem(service, key)
+	if err != nil {
+		return "", err
+	}
+	var secret secretValue
+	err = s.conn.Object(secretServiceDest, item).
+		Call(itemIface+".GetSecret", 0, s.session).
+		Store(&secret)
+	if err != nil {
+		return "", err
+	}
+	return string(secret.Value), nil
+}
+
+func keyringSet(service, key, value string) error {
+	s, err := openSecretService()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	collection, err := s.defaultCollection()
+	if err != nil {
+		return err
+	}
+	if err := s.unlock([]dbus.ObjectPath{collection}); err != nil {
+		return err
+	}
+
+	properties := map[string]dbus.Variant{
+		itemIface + ".Label":      dbus.MakeVariant(fmt.Sprintf("%s (%s)", key, service)),
+		itemIface + ".Attributes": dbus.MakeVariant(attributes(service, key)),
+	}
+	secret := secretValue{
+		Session:     s.session,
+		Parameters:  []byte{},
+		Value:       []byte(value),
+		ContentType: "text/plain; charset=utf8",
+	}
+
+	var item, prompt dbus.ObjectPath
+	err = s.conn.Object(secretServiceDest, collection).
+		Call(collectionIface+".CreateItem", 0, properties, secret, true).
+		Store(&item, &prompt)
+	if err != nil {
+		return err
+	}
+	return s.prompt(prompt)
+}
+
+func keyringDelete(service, key string) error {
+	s, err := openSecretService()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	item, err := s.findItem(service, key)
+	if err != nil {
+		return err
+	}
+	var prompt dbus.ObjectPath
+	if err := s.conn.Object(secretServiceDest, item).Call(itemIface+".Delete", 0).Store(&prompt); err != nil {
+		return err
+	}
+	return s.prompt(prompt)
+}
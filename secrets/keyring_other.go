@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !windows
+
+package secrets
+
+import "fmt"
+
+func keyringProbe(service string) error {
+	return fmt.Errorf("%w on this platform", ErrUnavailable)
+}
+
+func keyringGet(service, key string) (string, error) {
+	return "", keyringProbe(service)
+}
+
+func keyringSet(service, key, value string) error {
+	return keyringProbe(service)
+}
+
+func keyringDelete(service, key string) error {
+	return keyringProbe(service)
+}
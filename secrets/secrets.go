@@ -0,0 +1,48 @@
+// Package secrets keeps tokens and credentials out of config.json, in the OS
+// keyring or in a file encrypted with a passphrase.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when a secret does not exist
+	ErrNotFound = errors.New("secret not found")
+	// ErrLocked is returned by a FileStore before Unlock has been called
+	ErrLocked = errors.New("secret store is locked")
+	// ErrUnavailable is returned when the OS keyring cannot be used
+	ErrUnavailable = errors.New("OS keyring is not available")
+	// ErrBadPassphrase is returned when a FileStore cannot be decrypted
+	ErrBadPassphrase = errors.New("wrong passphrase for secret store")
+)
+
+// Store names used in references
+const (
+	StoreKeyring = "keyring"
+	StoreFile    = "file"
+)
+
+// Store saves secrets by key
+type Store interface {
+	Name() string
+	Get(key string) (string, error)
+	Set(key, value string) error
+	Delete(key string) error
+}
+
+// FormatRef returns a reference to a secret, e.g. "keyring:manual-token"
+func FormatRef(store, key string) string {
+	return store + ":" + key
+}
+
+// ParseRef splits a reference made by FormatRef
+func ParseRef(ref string) (store, key string, err error) {
+	store, key, ok := strings.Cut(ref, ":")
+	if !ok || key == "" || (store != StoreKeyring && store != StoreFile) {
+		return "", "", fmt.Errorf("invalid secret reference %q (expected %s:<key> or %s:<key>)", ref, StoreKeyring, StoreFile)
+	}
+	return store, key, nil
+}